@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -17,12 +19,10 @@ import (
 	"github.com/BurntSushi/toml"
 	"github.com/andyfase/CURDashboard/go/curconvert"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/athena"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/jcxplorer/cwlogger"
 )
@@ -60,10 +60,67 @@ type Metric struct {
 }
 
 type Athena struct {
-	DbSQL       string `toml:"create_database"`
-	TablePrefix string `toml:"table_prefix"`
-	TableSQL    string `toml:"create_table"`
-	DbName      string `toml:"database_name"`
+	DbSQL                string `toml:"create_database"`
+	TablePrefix          string `toml:"table_prefix"`
+	TableSQL             string `toml:"create_table"`
+	DbName               string `toml:"database_name"`
+	ColumnsSQL           string `toml:"table_columns"`
+	DropSQL              string `toml:"drop_table"`
+	RepairSQL            string `toml:"repair_table"`
+	LocationSQL          string `toml:"location_table"`
+	PartitionsSQL        string `toml:"table_partitions"`
+	PartitionLocationSQL string `toml:"partition_location"`
+	DropPartitionSQL     string `toml:"drop_partition"`
+	AllSQL               string `toml:"create_all_table"`
+	AllColsSQL           string `toml:"update_all_table"`
+	AllAddSQL            string `toml:"add_all_partition"`
+	AllLocSQL            string `toml:"locate_all_partition"`
+}
+
+type CurConvert struct {
+	ColumnTypeFile   string   `toml:"column_type_file"`
+	SampleRows       int      `toml:"sample_rows"`
+	StringDates      bool     `toml:"string_dates"`
+	Partitions       []string `toml:"partitions"`
+	Compression      string   `toml:"compression"`
+	RowGroupSize     int64    `toml:"row_group_size"`
+	PageSize         int64    `toml:"page_size"`
+	Dictionary       *bool    `toml:"dictionary"`
+	IncludeColumns   []string `toml:"include_columns"`
+	ExcludeColumns   []string `toml:"exclude_columns"`
+	RowFilters       []string `toml:"row_filters"`
+	ResourceTagMap   bool     `toml:"resource_tag_map"`
+	Retries          int      `toml:"retries"`
+	RetryDelay       string   `toml:"retry_delay"`
+	RetryMaxDelay    string   `toml:"retry_max_delay"`
+	FailurePolicy    string   `toml:"failure_policy"`
+	FailureThreshold float64  `toml:"failure_threshold"`
+	Verify           string   `toml:"verify"`
+	Versioned        bool     `toml:"versioned"`
+	VersionRetention string   `toml:"version_retention"`
+	SchemaRegistry   bool     `toml:"schema_registry"`
+	RedactionFile    string   `toml:"redaction_file"`
+	RedactionKeyFile string   `toml:"redaction_key_file"`
+	SSE              string   `toml:"sse"`
+	SSEKMSKeyID      string   `toml:"sse_kms_key_id"`
+	SSEBucketKey     bool     `toml:"sse_bucket_key"`
+	DecryptSource    bool     `toml:"decrypt_source"`
+	TmpDir           string   `toml:"tmp_dir"`
+	FileConcurrency  int      `toml:"file_concurrency"`
+	Preflight        string   `toml:"preflight"`
+	MemoryLimit      int64    `toml:"memory_limit"`
+	DownloadPartSize int64    `toml:"download_part_size"`
+	DownloadWorkers  int      `toml:"download_concurrency"`
+	ResumeDownloads  *bool    `toml:"resume_downloads"`
+}
+
+type ReportSource struct {
+	Name       string `toml:"name"`
+	Bucket     string `toml:"bucket"`
+	ReportPath string `toml:"report_path"`
+	ReportName string `toml:"report_name"`
+	RoleArn    string `toml:"role_arn"`
+	ExternalID string `toml:"external_id"`
 }
 
 type AthenaResponse struct {
@@ -78,8 +135,10 @@ type Config struct {
 	General      General
 	RI           RI
 	Athena       Athena
+	CurConvert   CurConvert
 	MetricConfig MetricConfig
 	Metrics      []Metric
+	Sources      []ReportSource `toml:"source"`
 }
 
 /*
@@ -122,7 +181,7 @@ func getInstanceMetadata(sess *session.Session) map[string]interface{} {
 /*
 Function reads in and validates command line parameters
 */
-func getParams(configFile *string, sourceBucket *string, destBucket *string, account *string, curReportName *string, curReportPath *string, curDestPath *string, dateOverride *string) error {
+func getParams(configFile *string, sourceBucket *string, destBucket *string, account *string, curReportName *string, curReportPath *string, curDestPath *string, dateOverride *string, s3Options *curconvert.S3Options, streaming *bool, dataExport *bool) error {
 
 	// Define input command line config parameter and parse it
 	flag.StringVar(configFile, "config", defaultConfigPath, "Input config file for analyzeDBR")
@@ -133,6 +192,13 @@ func getParams(configFile *string, sourceBucket *string, destBucket *string, acc
 	flag.StringVar(curReportPath, "reportpath", "", "CUR Report PAth")
 	flag.StringVar(curDestPath, "destpath", "", "Destination Path for converted CUR to be uploaded too")
 	flag.StringVar(dateOverride, "date", "", "Optional date flag to over-ride the processing CUR month")
+	flag.BoolVar(streaming, "stream", false, "Optional convert CUR files without using local disk")
+	flag.BoolVar(dataExport, "dataexport", false, "Optional report is a CUR 2.0 Data Export, reportname is then the export name")
+	flag.StringVar(&s3Options.Endpoint, "s3endpoint", "", "Optional custom S3 endpoint URL for S3 compatible services e.g. MinIO")
+	flag.StringVar(&s3Options.Region, "s3region", "", "Optional region to use with a custom S3 endpoint, defaults to us-east-1")
+	flag.BoolVar(&s3Options.ForcePathStyle, "s3pathstyle", false, "Optional use path-style S3 addressing")
+	flag.BoolVar(&s3Options.DisableSSL, "s3disablessl", false, "Optional connect to the S3 endpoint using plain HTTP")
+	flag.BoolVar(&s3Options.InsecureSkipVerify, "s3insecuretls", false, "Optional skip TLS certificate verification of the S3 endpoint")
 
 	flag.Parse()
 
@@ -147,9 +213,6 @@ func getParams(configFile *string, sourceBucket *string, destBucket *string, acc
 	if !regexAccount.MatchString(*account) {
 		return errors.New("Config Error: Must provide valid AWS account number")
 	}
-	if regexEmpty.MatchString(*curReportName) {
-		return errors.New("Config Error: Must provide valid CUR Report Name")
-	}
 	if destBucket == nil || len(*destBucket) < 1 {
 		*destBucket = *sourceBucket
 	}
@@ -585,14 +648,149 @@ func riUtilization(sess *session.Session, svcAthena *athena.Athena, conf Config,
 	return nil
 }
 
-func processCUR(sourceBucket string, reportName string, reportPath string, destPath string, destBucket string, logger *cwlogger.Logger, dateOverride string) ([]curconvert.CurColumn, string, string, error) {
+// convertOptions - returns the [curconvert] options of the config, unset options keep the curconvert defaults
+func convertOptions(convertConf CurConvert, s3Options curconvert.S3Options, streaming bool) (curconvert.ConvertOptions, error) {
+	opts := curconvert.DefaultOptions()
+	opts.S3 = s3Options
+	opts.Streaming = streaming
+
+	// column types and parquet output
+	opts.ColumnTypeFile = convertConf.ColumnTypeFile
+	opts.SampleRows = convertConf.SampleRows
+	opts.StringDates = convertConf.StringDates
+	opts.Partitions = convertConf.Partitions
+	if len(convertConf.Compression) > 0 {
+		opts.Compression = convertConf.Compression
+	}
+	if convertConf.RowGroupSize > 0 {
+		opts.RowGroupSize = convertConf.RowGroupSize
+	}
+	if convertConf.PageSize > 0 {
+		opts.PageSize = convertConf.PageSize
+	}
+	if convertConf.Dictionary != nil {
+		opts.Dictionary = *convertConf.Dictionary
+	}
+
+	// columns and rows converted
+	opts.IncludeColumns = convertConf.IncludeColumns
+	opts.ExcludeColumns = convertConf.ExcludeColumns
+	opts.RowFilters = convertConf.RowFilters
+	opts.ResourceTagMap = convertConf.ResourceTagMap
+	opts.RedactionFile = convertConf.RedactionFile
+	if len(convertConf.RedactionKeyFile) > 0 {
+		// surrounding whitespace such as a trailing newline is not part of the key
+		b, err := ioutil.ReadFile(convertConf.RedactionKeyFile)
+		if err != nil {
+			return opts, errors.New("Could not read redaction key file: " + err.Error())
+		}
+		opts.RedactionKey = bytes.TrimSpace(b)
+	}
+	opts.SchemaRegistry = convertConf.SchemaRegistry
+
+	// temp directory, file concurrency and the preflight check of them, unset options keep the defaults
+	if len(convertConf.TmpDir) > 0 {
+		opts.TmpDir = convertConf.TmpDir
+	}
+	if convertConf.FileConcurrency > 0 {
+		opts.FileConcurrency = convertConf.FileConcurrency
+	}
+	if len(convertConf.Preflight) > 0 {
+		mode, err := curconvert.ParsePreflightMode(convertConf.Preflight)
+		if err != nil {
+			return opts, err
+		}
+		opts.Preflight = mode
+	}
+	opts.MemoryLimit = convertConf.MemoryLimit
+
+	// ranged downloads of CUR files, unset options keep the defaults
+	if convertConf.DownloadPartSize > 0 {
+		opts.DownloadPartSize = convertConf.DownloadPartSize
+	}
+	if convertConf.DownloadWorkers > 0 {
+		opts.DownloadWorkers = convertConf.DownloadWorkers
+	}
+	if convertConf.ResumeDownloads != nil {
+		opts.ResumeDownloads = *convertConf.ResumeDownloads
+	}
+
+	// encryption of uploaded parquet and decryption of the CUR
+	if len(convertConf.SSE) > 0 {
+		mode, err := curconvert.ParseSSEMode(convertConf.SSE)
+		if err != nil {
+			return opts, err
+		}
+		opts.SSE = curconvert.SSEOptions{Mode: mode, KMSKeyID: convertConf.SSEKMSKeyID, BucketKey: convertConf.SSEBucketKey}
+	}
+	opts.DecryptSource = convertConf.DecryptSource
+
+	// failure handling, verification and publishing
+	if convertConf.Retries > 0 {
+		opts.Retries = convertConf.Retries
+	}
+	if len(convertConf.RetryDelay) > 0 {
+		d, err := time.ParseDuration(convertConf.RetryDelay)
+		if err != nil {
+			return opts, errors.New("Invalid retry_delay: " + err.Error())
+		}
+		opts.RetryDelay = d
+	}
+	if len(convertConf.RetryMaxDelay) > 0 {
+		d, err := time.ParseDuration(convertConf.RetryMaxDelay)
+		if err != nil {
+			return opts, errors.New("Invalid retry_max_delay: " + err.Error())
+		}
+		opts.RetryMaxDelay = d
+	}
+	if len(convertConf.FailurePolicy) > 0 {
+		policy, err := curconvert.ParseFailurePolicy(convertConf.FailurePolicy)
+		if err != nil {
+			return opts, err
+		}
+		opts.FailurePolicy = policy
+		opts.FailureThreshold = convertConf.FailureThreshold
+	}
+	if len(convertConf.Verify) > 0 {
+		mode, err := curconvert.ParseVerifyMode(convertConf.Verify)
+		if err != nil {
+			return opts, err
+		}
+		opts.Verify = mode
+	}
+	opts.Versioned = convertConf.Versioned
+	if len(convertConf.VersionRetention) > 0 {
+		d, err := time.ParseDuration(convertConf.VersionRetention)
+		if err != nil {
+			return opts, errors.New("Invalid version_retention: " + err.Error())
+		}
+		opts.Retention = d
+	}
+	return opts, nil
+}
+
+// converter - a CUR Converter, or a merge of several CUR reports
+type converter interface {
+	CheckCURExists() error
+	SetDestPath(path string) error
+	ConvertCurContext(ctx context.Context) error
+	Verify() (curconvert.VerifyReport, error)
+	CollectVersions(ctx context.Context) error
+	GetCURColumns() ([]curconvert.CurColumn, error)
+	GetCURPartitions() []curconvert.CurColumn
+	GetCURPartitionPaths() []string
+	GetCURColumnsByPosition() bool
+	GetCURLocation() string
+}
+
+func processCUR(ctx context.Context, sourceBucket string, reportName string, reportPath string, destPath string, destBucket string, logger *cwlogger.Logger, dateOverride string, s3Options curconvert.S3Options, streaming bool, dataExport bool, convertConf CurConvert, sources []ReportSource) ([]curconvert.CurColumn, []curconvert.CurColumn, []string, bool, string, string, error) {
 
 	var t1 time.Time
 	var err error
 	if len(dateOverride) == 8 {
 		t1, err = time.Parse("20060102", dateOverride)
 		if err != nil {
-			return nil, "", "", errors.New("Could not parse given date ovrride: " + dateOverride + ", " + err.Error())
+			return nil, nil, nil, false, "", "", errors.New("Could not parse given date ovrride: " + dateOverride + ", " + err.Error())
 		}
 	} else {
 		t1 = time.Now()
@@ -600,11 +798,13 @@ func processCUR(sourceBucket string, reportName string, reportPath string, destP
 
 	t1First := time.Date(t1.Year(), t1.Month(), 1, 0, 0, 0, 0, time.Local)
 
-	t2 := t1First.AddDate(0, 1, 0)
-	t2First := time.Date(t2.Year(), t2.Month(), 1, 0, 0, 0, 0, time.Local)
-
-	curDate := fmt.Sprintf("%d%02d01-%d%02d01", t1First.Year(), t1First.Month(), t2First.Year(), t2First.Month())
-	manifest := reportPath + "/" + curDate + "/" + reportName + "-Manifest.json"
+	// CUR 2.0 Data Exports use a different manifest layout to the legacy CUR
+	manifestKey := func(reportPath string, reportName string, t time.Time) string {
+		if dataExport {
+			return curconvert.ExportManifestKey(reportPath, reportName, t)
+		}
+		return curconvert.ManifestKey(reportPath, reportName, t)
+	}
 
 	// Set or extend destPath
 	destPathDate := fmt.Sprintf("%d%02d", t1First.Year(), t1First.Month())
@@ -615,26 +815,66 @@ func processCUR(sourceBucket string, reportName string, reportPath string, destP
 		destPathFull = destPath + "/" + destPathDate
 	}
 
-	// Init CUR Converter
-	cc := curconvert.NewCurConvert(sourceBucket, manifest, destBucket, destPathFull)
+	// Parse the [curconvert] options used for every conversion
+	opts, err := convertOptions(convertConf, s3Options, streaming)
+	if err != nil {
+		return nil, nil, nil, false, "", "", err
+	}
+	configure := func(cur *curconvert.CurConvert) error {
+		return cur.SetOptions(opts)
+	}
+
+	// Init CUR Converter, merging every [[source]] into one dataset when sources are configured
+	reports := sources
+	if len(reports) < 1 {
+		if len(reportName) < 1 {
+			return nil, nil, nil, false, "", "", errors.New("Config Error: Must provide valid CUR Report Name")
+		}
+		reports = []ReportSource{{Bucket: sourceBucket, ReportPath: reportPath, ReportName: reportName}}
+	}
+	var cc converter
+	var converters []*curconvert.CurConvert
+	if len(sources) > 0 {
+		var merge []curconvert.ReportSource
+		for _, src := range sources {
+			merge = append(merge, curconvert.ReportSource{
+				Name:       src.Name,
+				Bucket:     src.Bucket,
+				Manifest:   manifestKey(src.ReportPath, src.ReportName, t1First),
+				RoleArn:    src.RoleArn,
+				ExternalID: src.ExternalID,
+			})
+		}
+		mc, err := curconvert.NewMergeCur(merge, destBucket, destPathFull, configure)
+		if err != nil {
+			return nil, nil, nil, false, "", "", err
+		}
+		cc = mc
+		converters = mc.Converters()
+	} else {
+		sc := curconvert.NewCurConvert(sourceBucket, manifestKey(reportPath, reportName, t1First), destBucket, destPathFull)
+		if err := configure(sc); err != nil {
+			return nil, nil, nil, false, "", "", err
+		}
+		cc = sc
+		converters = []*curconvert.CurConvert{sc}
+	}
 
 	// Check current months manifest exists
 	if err := cc.CheckCURExists(); err != nil {
-		if err.(awserr.Error).Code() != s3.ErrCodeNoSuchKey {
-			return nil, "", "", errors.New("Error fetching CUR Manifest: " + err.Error())
+		if !curconvert.IsNotExist(err) {
+			return nil, nil, nil, false, "", "", errors.New("Error fetching CUR Manifest: " + err.Error())
 		}
 		if t1.Day() > 3 {
-			return nil, "", "", errors.New("Error fetching CUR Manifest, NoSuchKey and too delayed: " + err.Error())
+			return nil, nil, nil, false, "", "", errors.New("Error fetching CUR Manifest, NoSuchKey and too delayed: " + err.Error())
 		}
 		// Regress to processing last months CUR. Error is ErrCodeNoSuchKey and still early in the month
-		doLog(logger, "Reseting to previous months CUR for "+reportName)
 		t1First = t1First.AddDate(0, 0, -1)
-		t2First = t2First.AddDate(0, 0, -1)
-		curDate = fmt.Sprintf("%d%02d01-%d%02d01", t1First.Year(), t1First.Month(), t2First.Year(), t2First.Month())
 		destPathDate = fmt.Sprintf("%d%02d", t1First.Year(), t1First.Month())
-
-		manifest := reportPath + "/" + curDate + "/" + reportName + "-Manifest.json"
-		cc.SetSourceManifest(manifest)
+		for i, report := range reports {
+			doLog(logger, "Reseting to previous months CUR for "+report.ReportName)
+			converters[i].SetSourceManifest(manifestKey(report.ReportPath, report.ReportName, t1First))
+		}
 
 		if len(destPath) < 1 {
 			destPathFull = "parquet-cur/" + destPathDate
@@ -645,32 +885,214 @@ func processCUR(sourceBucket string, reportName string, reportPath string, destP
 	}
 
 	// Convert CUR
-	if err := cc.ConvertCur(); err != nil {
-		return nil, "", "", errors.New("Could not convert CUR: " + err.Error())
+	if err := cc.ConvertCurContext(ctx); err != nil {
+		// failures allowed by the failure policy are logged, the converted files are still loaded into Athena
+		if _, partial := err.(*curconvert.PartialError); !partial {
+			return nil, nil, nil, false, "", "", errors.New("Could not convert CUR: " + err.Error())
+		}
+		doLog(logger, "CUR partially converted: "+err.Error())
+	}
+
+	// Log verification totals and any mismatches
+	if opts.Verify != curconvert.VerifyOff {
+		report, err := cc.Verify()
+		doLog(logger, "CUR verification totals, source "+report.Source.String()+", parquet "+report.Parquet.String()+", filtered "+report.Filtered.String())
+		for _, f := range report.Mismatches() {
+			doLog(logger, "CUR verification mismatch for "+f.Key+", source "+f.Source.String()+", parquet "+f.Parquet.String()+", filtered "+f.Filtered.String())
+		}
+		if err != nil {
+			doLog(logger, err.Error())
+		}
+	}
+
+	// Delete versions superseded for longer than the retention, anything left is collected on the next run
+	if convertConf.Versioned {
+		if err := cc.CollectVersions(ctx); err != nil {
+			doLog(logger, "Could not delete superseded CUR versions: "+err.Error())
+		}
 	}
 
 	cols, err := cc.GetCURColumns()
 	if err != nil {
-		return nil, "", "", errors.New("Could not obtain CUR columns: " + err.Error())
+		return nil, nil, nil, false, "", "", errors.New("Could not obtain CUR columns: " + err.Error())
 	}
-	return cols, "s3://" + destBucket + "/" + destPathFull + "/", destPathDate, nil
+	return cols, cc.GetCURPartitions(), cc.GetCURPartitionPaths(), cc.GetCURColumnsByPosition(), "s3://" + destBucket + "/" + cc.GetCURLocation() + "/", destPathDate, nil
 }
 
-func createAthenaTable(svcAthena *athena.Athena, dbName string, tablePrefix string, sql string, columns []curconvert.CurColumn, s3Path string, date string, region string, account string) error {
+func createAthenaTable(svcAthena *athena.Athena, conf Athena, columns []curconvert.CurColumn, partitions []curconvert.CurColumn, partitionPaths []string, byPosition bool, s3Path string, date string, versioned bool, region string, account string) error {
+
+	if len(columns) < 1 {
+		return errors.New("CUR has no columns to create the table with")
+	}
 
 	var cols string
 	for col := range columns {
 		cols += "`" + columns[col].Name + "` " + columns[col].Type + ",\n"
 	}
 	cols = cols[:strings.LastIndex(cols, ",")]
-	sql = substituteParams(sql, map[string]string{"**DBNAME**": dbName, "**PREFIX**": tablePrefix, "**DATE**": date, "**COLUMNS**": cols, "**S3**": s3Path})
-	if _, err := sendQuery(svcAthena, dbName, sql, region, account); err != nil {
+
+	// partitioned output is declared as partition columns, rather than table columns
+	var parts string
+	if len(partitions) > 0 {
+		for part := range partitions {
+			parts += "`" + partitions[part].Name + "` " + partitions[part].Type + ", "
+		}
+		parts = "PARTITIONED BY (" + parts[:strings.LastIndex(parts, ",")] + ")"
+	}
+
+	// copied Parquet CUR files keep their original column names, so are read by position
+	var serde string
+	if byPosition {
+		serde = "ROW FORMAT SERDE 'org.apache.hadoop.hive.ql.io.parquet.serde.ParquetHiveSerDe' WITH SERDEPROPERTIES ('parquet.column.index.access'='true')"
+	}
+
+	params := map[string]string{"**DBNAME**": conf.DbName, "**PREFIX**": conf.TablePrefix, "**DATE**": date, "**COLUMNS**": cols, "**PARTITIONS**": parts, "**SERDE**": serde, "**S3**": s3Path}
+
+	// "if not exists" keeps a table whose schema no longer matches the converted CUR, e.g. after column types changed,
+	// so such a table is dropped and re-created. information_schema lists partition columns as table columns
+	if len(conf.ColumnsSQL) > 0 && len(conf.DropSQL) > 0 {
+		existing, err := sendQuery(svcAthena, conf.DbName, substituteParams(conf.ColumnsSQL, params), region, account)
+		if err != nil {
+			return err
+		}
+		all := append(append([]curconvert.CurColumn{}, columns...), partitions...)
+		if columnsChanged(existing, all) {
+			if _, err := sendQuery(svcAthena, conf.DbName, substituteParams(conf.DropSQL, params), region, account); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := sendQuery(svcAthena, conf.DbName, substituteParams(conf.TableSQL, params), region, account); err != nil {
 		return err
 	}
 
+	// switch an existing table to the published version, in place so that the table can be queried throughout
+	if versioned && len(conf.LocationSQL) > 0 {
+		if _, err := sendQuery(svcAthena, conf.DbName, substituteParams(conf.LocationSQL, params), region, account); err != nil {
+			return err
+		}
+	}
+
+	// load any new partitions into the table
+	if len(partitions) > 0 && len(conf.RepairSQL) > 0 {
+		if _, err := sendQuery(svcAthena, conf.DbName, substituteParams(conf.RepairSQL, params), region, account); err != nil {
+			return err
+		}
+	}
+
+	// partitions already in the table keep their own location, so are each switched to the published version
+	if versioned && len(partitions) > 0 {
+		return switchPartitions(svcAthena, conf, params, partitionPaths, s3Path, region, account)
+	}
+
+	return nil
+}
+
+// switchPartitions - points each partition of a versioned table at its folder in the published version s3Path, and
+// drops partitions the published version no longer has. Each partition switches with a single statement, so queries
+// see either the previous or the published version of a partition
+func switchPartitions(svcAthena *athena.Athena, conf Athena, params map[string]string, partitionPaths []string, s3Path string, region string, account string) error {
+	if len(conf.PartitionLocationSQL) < 1 {
+		return errors.New("partition_location must be set to publish versioned partitioned tables")
+	}
+
+	published := make(map[string]bool, len(partitionPaths))
+	for _, path := range partitionPaths {
+		published[path] = true
+		params["**PARTITION**"] = partitionSpec(path)
+		params["**S3**"] = s3Path + path + "/"
+		if _, err := sendQuery(svcAthena, conf.DbName, substituteParams(conf.PartitionLocationSQL, params), region, account); err != nil {
+			return err
+		}
+	}
+
+	if len(conf.PartitionsSQL) < 1 || len(conf.DropPartitionSQL) < 1 {
+		return nil
+	}
+	existing, err := sendQuery(svcAthena, conf.DbName, substituteParams(conf.PartitionsSQL, params), region, account)
+	if err != nil {
+		return err
+	}
+	for _, row := range existing.Rows {
+		if path := row["partition"]; len(path) > 0 && !published[path] {
+			params["**PARTITION**"] = partitionSpec(path)
+			if _, err := sendQuery(svcAthena, conf.DbName, substituteParams(conf.DropPartitionSQL, params), region, account); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// createAllMonthsTable - creates or updates the table of all converted months, partitioned by month, and points the
+// partition of this month at s3Path. Requires the schema registry so that every month has the same columns
+func createAllMonthsTable(svcAthena *athena.Athena, conf Athena, columns []curconvert.CurColumn, s3Root string, s3Path string, date string, region string, account string) error {
+
+	if len(columns) < 1 {
+		return errors.New("CUR has no columns to create the table with")
+	}
+
+	var cols string
+	for col := range columns {
+		cols += "`" + columns[col].Name + "` " + columns[col].Type + ",\n"
+	}
+	cols = cols[:strings.LastIndex(cols, ",")]
+
+	params := map[string]string{"**DBNAME**": conf.DbName, "**PREFIX**": conf.TablePrefix, "**DATE**": date, "**COLUMNS**": cols, "**S3ROOT**": s3Root, "**S3**": s3Path}
+	for _, sql := range []string{conf.AllSQL, conf.AllColsSQL, conf.AllAddSQL, conf.AllLocSQL} {
+		if len(sql) < 1 {
+			continue
+		}
+		if _, err := sendQuery(svcAthena, conf.DbName, substituteParams(sql, params), region, account); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// partitionSpec - returns the Athena partition spec of a Hive-style partition path, e.g. day=2026-10-01/account=123
+// as `day` = '2026-10-01', `account` = '123'
+func partitionSpec(path string) string {
+	var spec []string
+	for _, part := range strings.Split(path, "/") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 {
+			spec = append(spec, "`"+kv[0]+"` = '"+strings.Replace(kv[1], "'", "''", -1)+"'")
+		}
+	}
+	return strings.Join(spec, ", ")
+}
+
+// columnsChanged - returns true if existing, the column_name and data_type rows of a table, has different columns or
+// column types to columns. No rows means there is no table
+func columnsChanged(existing AthenaResponse, columns []curconvert.CurColumn) bool {
+	if len(existing.Rows) < 1 {
+		return false
+	}
+	if len(existing.Rows) != len(columns) {
+		return true
+	}
+
+	types := make(map[string]string, len(existing.Rows))
+	for _, row := range existing.Rows {
+		types[strings.ToLower(row["column_name"])] = normalizeType(row["data_type"])
+	}
+	for _, col := range columns {
+		if t, ok := types[strings.ToLower(col.Name)]; !ok || t != normalizeType(col.Type) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeType - returns a column type given in DDL (e.g. map<string,string>) in the form information_schema reports
+// it (e.g. map(varchar, varchar)), ignoring case, spaces and timestamp precision so that the two can be compared
+func normalizeType(t string) string {
+	t = strings.ToLower(strings.Replace(t, " ", "", -1))
+	return strings.NewReplacer("<", "(", ">", ")", "string", "varchar", "timestamp(3)", "timestamp").Replace(t)
+}
+
 func doLog(logger *cwlogger.Logger, m string) {
 	if logger != nil {
 		logger.Log(time.Now(), m)
@@ -706,7 +1128,9 @@ func main() {
 
 	// read in command line params
 	var configFile, account, sourceBucket, destBucket, curReportName, curReportPath, curDestPath, dateOverride string
-	if err := getParams(&configFile, &sourceBucket, &destBucket, &account, &curReportName, &curReportPath, &curDestPath, &dateOverride); err != nil {
+	var s3Options curconvert.S3Options
+	var streaming, dataExport bool
+	if err := getParams(&configFile, &sourceBucket, &destBucket, &account, &curReportName, &curReportPath, &curDestPath, &dateOverride, &s3Options, &streaming, &dataExport); err != nil {
 		doLog(logger, err.Error())
 		return
 	}
@@ -717,10 +1141,17 @@ func main() {
 		doLog(logger, err.Error())
 	}
 
-	// convert CUR
-	columns, s3Path, curDate, err := processCUR(sourceBucket, curReportName, curReportPath, curDestPath, destBucket, logger, dateOverride)
+	// convert CUR, SIGINT / SIGTERM stops the conversion and removes partial files
+	ctx, cancel := curconvert.SignalContext()
+	defer cancel()
+	columns, partitions, partitionPaths, byPosition, s3Path, curDate, err := processCUR(ctx, sourceBucket, curReportName, curReportPath, curDestPath, destBucket, logger, dateOverride, s3Options, streaming, dataExport, conf.CurConvert, conf.Sources)
+	if err == nil && ctx.Err() != nil {
+		err = errors.New("CUR conversion interrupted: " + ctx.Err().Error())
+	}
 	if err != nil {
+		// tables and metrics can not be updated without a converted CUR
 		doLog(logger, err.Error())
+		os.Exit(1)
 	}
 
 	// initialize Athena class
@@ -733,10 +1164,26 @@ func main() {
 	}
 
 	// make sure current Athena table exists
-	if err := createAthenaTable(svcAthena, conf.Athena.DbName, conf.Athena.TablePrefix, conf.Athena.TableSQL, columns, s3Path, curDate, meta["region"].(string), account); err != nil {
+	if err := createAthenaTable(svcAthena, conf.Athena, columns, partitions, partitionPaths, byPosition, s3Path, curDate, conf.CurConvert.Versioned, meta["region"].(string), account); err != nil {
 		doLog(logger, "Could not create Athena Table: "+err.Error())
 	}
 
+	// make sure the all months Athena table exists and includes this month
+	// merged sources always use the schema registry
+	if (conf.CurConvert.SchemaRegistry || len(conf.Sources) > 0) && len(conf.Athena.AllSQL) > 0 {
+		if len(partitions) > 0 {
+			doLog(logger, "All months Athena table is not supported with partitioned CUR conversion")
+		} else {
+			s3Root := "s3://" + destBucket + "/parquet-cur/"
+			if len(curDestPath) > 0 {
+				s3Root = "s3://" + destBucket + "/" + curDestPath + "/"
+			}
+			if err := createAllMonthsTable(svcAthena, conf.Athena, columns, s3Root, s3Path, curDate, meta["region"].(string), account); err != nil {
+				doLog(logger, "Could not update all months Athena Table: "+err.Error())
+			}
+		}
+	}
+
 	// // If RI analysis enabled - do it
 	// if conf.RI.Enabled {
 	// 	if err := riUtilization(sess, svcAthena, conf, key, secret, meta["region"].(string), account, date); err != nil {
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/andyfase/CURDashboard/go/curconvert"
+)
+
+func TestColumnsChanged(t *testing.T) {
+	columns := []curconvert.CurColumn{
+		{Name: "lineitem/usagestartdate", Type: "TIMESTAMP"},
+		{Name: "lineitem/unblendedcost", Type: "DOUBLE"},
+		{Name: "resourcetags", Type: "MAP<STRING,STRING>"},
+		{Name: "product/region", Type: "STRING"},
+	}
+	row := func(name, dataType string) map[string]string {
+		return map[string]string{"column_name": name, "data_type": dataType}
+	}
+	tests := []struct {
+		name     string
+		existing []map[string]string
+		want     bool
+	}{
+		{name: "no table", want: false},
+		{
+			name: "unchanged",
+			existing: []map[string]string{
+				row("lineitem/usagestartdate", "timestamp(3)"), row("lineitem/unblendedcost", "double"),
+				row("resourcetags", "map(varchar, varchar)"), row("product/region", "varchar"),
+			},
+			want: false,
+		},
+		{
+			name: "type changed",
+			existing: []map[string]string{
+				row("lineitem/usagestartdate", "varchar"), row("lineitem/unblendedcost", "double"),
+				row("resourcetags", "map(varchar, varchar)"), row("product/region", "varchar"),
+			},
+			want: true,
+		},
+		{
+			name: "column added",
+			existing: []map[string]string{
+				row("lineitem/usagestartdate", "timestamp"), row("lineitem/unblendedcost", "double"), row("product/region", "varchar"),
+			},
+			want: true,
+		},
+		{
+			name: "column renamed",
+			existing: []map[string]string{
+				row("lineitem/usagestartdate", "timestamp"), row("lineitem/unblendedcost", "double"),
+				row("resourcetags", "map(varchar, varchar)"), row("product/location", "varchar"),
+			},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		if got := columnsChanged(AthenaResponse{Rows: tt.existing}, columns); got != tt.want {
+			t.Errorf("%s: columnsChanged = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPartitionSpec(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "day=2026-10-01", want: "`day` = '2026-10-01'"},
+		{path: "day=2026-10-01/account=123456789012", want: "`day` = '2026-10-01', `account` = '123456789012'"},
+		{path: "product=it's", want: "`product` = 'it''s'"},
+		{path: "", want: ""},
+	}
+	for _, tt := range tests {
+		if got := partitionSpec(tt.path); got != tt.want {
+			t.Errorf("partitionSpec(%q) = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
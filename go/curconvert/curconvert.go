@@ -1,29 +1,22 @@
 package curconvert
 
 import (
-	"compress/gzip"
-	"encoding/csv"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"log"
+	"net/url"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/kms"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3crypto"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+
 	"github.com/xitongsys/parquet-go/ParquetFile"
-	"github.com/xitongsys/parquet-go/ParquetWriter"
-	"github.com/xitongsys/parquet-go/SchemaHandler"
+	"github.com/xitongsys/parquet-go/parquet"
 )
 
 //
@@ -32,6 +25,12 @@ type CurColumn struct {
 	Type string
 }
 
+// defaultTempDir - directory CUR files are downloaded to and parquet files written in, unless set with SetTmpLocation
+const defaultTempDir = "/tmp"
+
+// defaultFileConcurrency - number of CUR files converted in parallel, unless set with SetFileConcurrency
+const defaultFileConcurrency = 30
+
 //
 // CurConvert class and functions
 type CurConvert struct {
@@ -40,21 +39,78 @@ type CurConvert struct {
 	destBucket   string
 	destObject   string
 	destKMSKey   string
+	destSSE      SSEOptions
+	sourceCSE    bool
 
 	sourceArn        string
 	sourceExternalID string
 	destArn          string
 	destExternalID   string
 
+	s3Options S3Options
+
+	storageLock   sync.Mutex
+	sourceStorage Storage
+	destStorage   Storage
+
 	tempDir         string
 	concurrency     int
 	fileConcurrency int
+	streaming       bool
+	force           bool
+	sampleRows      int
+	stringDates     bool
+	partitions      []string
+	compression     parquet.CompressionCodec
+	rowGroupSize    int64
+	pageSize        int64
+	plainEncoding   bool
+	inputFormat     string
+	columnIncludes  []columnPattern
+	columnExcludes  []columnPattern
+	rowFilters      []rowFilter
+	tagMap          bool
+	redactions      []redaction
+	redactionKey    []byte
+	preflight       PreflightMode
+	memoryLimit     int64
+
+	downloadPartSize    int64
+	downloadConcurrency int
+	resumable           bool
+
+	retryAttempts    int
+	retryDelay       time.Duration
+	retryMaxDelay    time.Duration
+	failurePolicy    FailurePolicy
+	failureThreshold float64
+	cleanDryRun      bool
+	schemaRegistry   bool
+	schema           SchemaRegistry
+	schemaChanged    bool
+	cleanObjects     []string
+	verifyMode       VerifyMode
+	verified         verifyResults
+	versioned        bool
+	retention        time.Duration
+	version          string
+	published        PublishState
+	sourceReport     string
 
 	CurColumns     []string
 	CurFiles       []string
 	CurParqetFiles map[string]bool
 	CurColumnTypes map[string]string
-	skipCols       map[int]bool
+	fields         []curField
+	columnIndex    map[string]int
+	tagColumns     []tagColumn
+	mapFields      []curField
+	redactedCols   map[int]redaction
+	filesLock      sync.Mutex
+
+	assemblyID string
+	prevState  ConvertState
+	state      ConvertState
 }
 
 //
@@ -66,25 +122,22 @@ func NewCurConvert(sBucket string, sObject string, dBucket string, dObject strin
 	cur.destBucket = dBucket
 	cur.destObject = dObject
 
-	cur.tempDir = "/tmp"
+	cur.tempDir = defaultTempDir
 	cur.concurrency = 10
-	cur.fileConcurrency = 30
-
-	// over-ride CUR column types
+	cur.compression = parquet.CompressionCodec_SNAPPY
+	cur.rowGroupSize = defaultRowGroupSize
+	cur.pageSize = defaultPageSize
+	cur.fileConcurrency = defaultFileConcurrency
+	cur.downloadPartSize = defaultDownloadPartSize
+	cur.downloadConcurrency = defaultDownloadConcurrency
+	cur.resumable = true
+	cur.retryAttempts = defaultRetryAttempts
+	cur.retryDelay = defaultRetryDelay
+	cur.retryMaxDelay = defaultRetryMaxDelay
+	cur.retention = defaultRetention
+
+	// over-ride CUR column types, these take precedence over defaults, manifest and sampled types
 	cur.CurColumnTypes = make(map[string]string)
-	cur.CurColumnTypes["lineitem/usageamount"] = "DOUBLE"
-	cur.CurColumnTypes["lineitem/normalizationfactor"] = "DOUBLE"
-	cur.CurColumnTypes["lineitem/normalizedusageamount"] = "DOUBLE"
-	cur.CurColumnTypes["lineitem/unblendedrate"] = "DOUBLE"
-	cur.CurColumnTypes["lineitem/unblendedcost"] = "DOUBLE"
-	cur.CurColumnTypes["lineitem/blendedrate"] = "DOUBLE"
-	cur.CurColumnTypes["lineitem/blendedcost"] = "DOUBLE"
-	cur.CurColumnTypes["pricing/publicondemandcost"] = "DOUBLE"
-	cur.CurColumnTypes["pricing/publicondemandrate"] = "DOUBLE"
-	cur.CurColumnTypes["reservation/normalizedunitsperreservation"] = "DOUBLE"
-	cur.CurColumnTypes["reservation/totalreservednormalizedunits"] = "DOUBLE"
-	cur.CurColumnTypes["reservation/totalreservedunits"] = "DOUBLE"
-	cur.CurColumnTypes["reservation/unitsperreservation"] = "DOUBLE"
 
 	// init parquet file map
 	cur.CurParqetFiles = make(map[string]bool)
@@ -102,6 +155,19 @@ func (c *CurConvert) SetFileConcurrency(concurrency int) error {
 	return nil
 }
 
+//
+// SetStreaming - when enabled CUR files are converted and uploaded without being written to the temp directory, see StreamCur.
+// ZIP CUR files are the exception, as an archive can not be read sequentially it is still spooled to the temp directory
+func (c *CurConvert) SetStreaming(enabled bool) {
+	c.streaming = enabled
+}
+
+//
+// SetForce - when enabled every CUR file is converted, even if unchanged since the previous conversion
+func (c *CurConvert) SetForce(force bool) {
+	c.force = force
+}
+
 //
 // SetSourceRole - configures the source profile data for retrieving CUR from different AWS account
 func (c *CurConvert) SetSourceRole(arn string, externalID string) error {
@@ -145,7 +211,8 @@ func (c *CurConvert) SetDestPath(path string) error {
 }
 
 //
-// SetDestKMSKey - sets the KMS Master key arn to use for
+// SetDestKMSKey - sets the KMS Master key arn to use for client-side encryption of uploaded parquet files (S3 destinations only).
+// Athena cannot read client-side encrypted files, use SetDestSSE for output that is queried
 func (c *CurConvert) SetDestKMSKey(key string) error {
 	if len(key) < 1 {
 		return errors.New("Must supply a Key ARN")
@@ -155,205 +222,190 @@ func (c *CurConvert) SetDestKMSKey(key string) error {
 }
 
 //
-// SetTmpLocation - sets the temp directory for CUR files to be downloaded to, and parquet files to be written too
-func (c *CurConvert) SetTmpLocation(path string) error {
-	r, err := regexp.Compile("^/[A-Z,a-z,0-9,_,-,/]+[^/]$")
-	if err != nil {
-		return fmt.Errorf("Failed to set TempLocation, regexp error: %s", err)
-	}
-	if len(path) < 1 || !r.MatchString(path) {
-		return errors.New("Must supply a valid path that starts with '/' and is not terminated with '/'")
+// SetDestSSE - sets the server-side encryption (SSE-S3 or SSE-KMS) of uploaded parquet files (S3 destinations only).
+// Unlike SetDestKMSKey the converted CUR remains readable by Athena, given kms:Decrypt on the key
+func (c *CurConvert) SetDestSSE(sse SSEOptions) error {
+	if err := sse.validate(); err != nil {
+		return err
 	}
-	c.tempDir = path
+	c.destSSE = sse
 	return nil
 }
 
 //
-// GetCURColumns - Converts processed CUR columns into map and returns it
-func (c *CurConvert) GetCURColumns() ([]CurColumn, error) {
-
-	if len(c.CurColumns) < 1 {
-		return nil, errors.New("Cannot fetch CUR column data, call ParseCUR first")
-	}
-
-	sh := SchemaHandler.NewSchemaHandlerFromMetadata(c.CurColumns)
-	cols := []CurColumn{}
-
-	for i := range sh.SchemaElements {
-		if sh.SchemaElements[i].Type == nil {
-			continue
-		}
+// SetSourceDecryption - when enabled CUR objects client-side encrypted with KMS (s3crypto envelope encryption) are
+// decrypted as they are read (S3 sources only)
+func (c *CurConvert) SetSourceDecryption(enabled bool) {
+	c.sourceCSE = enabled
+}
 
-		var t string
-		if sh.SchemaElements[i].ConvertedType != nil {
-			t = sh.SchemaElements[i].ConvertedType.String()
-		} else if sh.SchemaElements[i].Type != nil {
-			t = sh.SchemaElements[i].Type.String()
-		} else {
-			return nil, errors.New("Cannot fetch CUR column data, Failed to find Type for CurColumn")
+//
+// SetS3Options - configures a custom S3 endpoint (e.g. MinIO), path-style addressing and TLS options for source and dest buckets
+func (c *CurConvert) SetS3Options(opts S3Options) error {
+	if len(opts.Endpoint) > 0 {
+		if _, err := url.Parse(opts.Endpoint); err != nil {
+			return fmt.Errorf("Invalid S3 endpoint %s: %s", opts.Endpoint, err)
 		}
+	}
 
-		if t == "UTF8" {
-			t = "STRING"
+	c.storageLock.Lock()
+	defer c.storageLock.Unlock()
+	c.s3Options = opts
+	for _, s := range []Storage{c.sourceStorage, c.destStorage} {
+		if s3s, ok := s.(*S3Storage); ok {
+			s3s.SetOptions(opts)
 		}
-		cols = append(cols, CurColumn{Name: sh.SchemaElements[i].GetName(), Type: t})
 	}
-	return cols, nil
+	return nil
 }
 
-func (c *CurConvert) getCreds(arn string, externalID string, sess *session.Session) *credentials.Credentials {
-	if len(arn) < 1 {
-		return nil
-	}
-	if len(externalID) > 0 {
-		return stscreds.NewCredentials(sess, arn, func(p *stscreds.AssumeRoleProvider) {
-			p.ExternalID = &externalID
-		})
+//
+// SetSourceStorage - over-rides the Storage the CUR manifest and files are read from. By default this is derived from the source bucket
+func (c *CurConvert) SetSourceStorage(s Storage) error {
+	if s == nil {
+		return errors.New("Must supply a Storage")
 	}
-	return stscreds.NewCredentials(sess, arn, func(p *stscreds.AssumeRoleProvider) {})
+	c.sourceStorage = s
+	return nil
 }
 
-func (c *CurConvert) getBucketLocation(bucket string, arn string, externalID string) (string, error) {
-
-	// Init Session
-	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-east-1")})
-	if err != nil {
-		return "", err
-	}
-
-	// if needed set creds for AssumeRole and reset session
-	if len(arn) > 0 {
-		sess = sess.Copy(&aws.Config{Credentials: c.getCreds(arn, externalID, sess)})
+//
+// SetDestStorage - over-rides the Storage converted parquet files are written to. By default this is derived from the dest bucket
+func (c *CurConvert) SetDestStorage(s Storage) error {
+	if s == nil {
+		return errors.New("Must supply a Storage")
 	}
+	c.destStorage = s
+	return nil
+}
 
-	// Get Bucket location
-	svc := s3.New(sess)
-	res, err := svc.GetBucketLocation(&s3.GetBucketLocationInput{
-		Bucket: aws.String(bucket),
-	})
-
+//
+// SetTmpLocation - sets the temp directory for CUR files to be downloaded to, and parquet files to be written too
+func (c *CurConvert) SetTmpLocation(path string) error {
+	r, err := regexp.Compile("^/[A-Z,a-z,0-9,_,-,/]+[^/]$")
 	if err != nil {
-		return "", err
+		return fmt.Errorf("Failed to set TempLocation, regexp error: %s", err)
 	}
-
-	// empty string returned for buckets existing in us-east-1! https://docs.aws.amazon.com/AmazonS3/latest/API/RESTBucketGETlocation.html
-	if res.LocationConstraint == nil || len(*res.LocationConstraint) < 1 {
-		return "us-east-1", nil
+	if len(path) < 1 || !r.MatchString(path) {
+		return errors.New("Must supply a valid path that starts with '/' and is not terminated with '/'")
 	}
-	return *res.LocationConstraint, nil
+	c.tempDir = path
+	return nil
 }
 
-func (c *CurConvert) initS3Downloader(bucket string, arn string, externalID string) (*s3manager.Downloader, error) {
+//
+// GetCURColumns - Converts processed CUR columns into map and returns it
+func (c *CurConvert) GetCURColumns() ([]CurColumn, error) {
 
-	// get location of bucket
-	bucketLocation, err := c.getBucketLocation(bucket, arn, externalID)
-	if err != nil {
-		return nil, err
+	if len(c.fields) < 1 && len(c.mapFields) < 1 {
+		return nil, errors.New("Cannot fetch CUR column data, call ParseCUR first")
 	}
 
-	// Init Session
-	sess, err := session.NewSession(&aws.Config{Region: aws.String(bucketLocation), DisableRestProtocolURICleaning: aws.Bool(true)})
-	if err != nil {
-		return nil, err
+	fields := append(append([]curField{}, c.fields...), c.mapFields...)
+	if c.GetCURColumnsByPosition() {
+		sort.SliceStable(fields, func(i, j int) bool { return fields[i].index < fields[j].index })
 	}
 
-	// if needed set creds for AssumeRole and reset session
-	if len(arn) > 0 {
-		sess = sess.Copy(&aws.Config{Credentials: c.getCreds(arn, externalID, sess)})
+	cols := []CurColumn{}
+	for i := range fields {
+		cols = append(cols, CurColumn{Name: fields[i].name, Type: fields[i].athenaType})
 	}
-
-	return s3manager.NewDownloader(sess), nil
+	return cols, nil
 }
 
-func (c *CurConvert) initS3Uploader(bucket string, arn string, externalID string) (*s3manager.Uploader, error) {
-
-	// get location of bucket
-	bucketLocation, err := c.getBucketLocation(bucket, arn, externalID)
-	if err != nil {
-		return nil, err
-	}
+//
+// GetCURColumnsByPosition - returns true if the parquet output must be read by column position rather than name, in the
+// order given by GetCURColumns. Parquet CUR reports are copied unchanged, so their column names differ from those returned
+func (c *CurConvert) GetCURColumnsByPosition() bool {
+	return c.inputFormat == formatParquet
+}
 
-	// Init Session
-	sess, err := session.NewSession(&aws.Config{Region: aws.String(bucketLocation), DisableRestProtocolURICleaning: aws.Bool(true)})
-	if err != nil {
-		return nil, err
+// getSourceStorage - returns the configured source Storage, creating one from the source bucket if not set
+func (c *CurConvert) getSourceStorage() Storage {
+	c.storageLock.Lock()
+	defer c.storageLock.Unlock()
+
+	if c.sourceStorage == nil {
+		c.sourceStorage = NewStorage(c.sourceBucket, c.sourceArn, c.sourceExternalID)
+		if s3s, ok := c.sourceStorage.(*S3Storage); ok {
+			s3s.SetOptions(c.s3Options)
+			s3s.SetDecryption(c.sourceCSE)
+			s3s.SetDownloadOptions(c.downloadPartSize, c.downloadConcurrency)
+		}
 	}
+	return c.sourceStorage
+}
 
-	// if needed set creds for AssumeRole and reset session
-	if len(arn) > 0 {
-		sess = sess.Copy(&aws.Config{Credentials: c.getCreds(arn, externalID, sess)})
+// getDestStorage - returns the configured dest Storage, creating one from the dest bucket if not set
+func (c *CurConvert) getDestStorage() Storage {
+	c.storageLock.Lock()
+	defer c.storageLock.Unlock()
+
+	if c.destStorage == nil {
+		c.destStorage = NewStorage(c.destBucket, c.destArn, c.destExternalID)
+		if s3s, ok := c.destStorage.(*S3Storage); ok {
+			s3s.SetOptions(c.s3Options)
+			if len(c.destKMSKey) > 0 {
+				s3s.SetKMSKey(c.destKMSKey)
+			}
+			s3s.SetSSE(c.destSSE)
+		}
 	}
-
-	return s3manager.NewUploader(sess), nil
+	return c.destStorage
 }
 
 //
-// CheckCURExists - Attempts to fetch manifest file to confirm existence of CUR
+// CheckCURExists - Attempts to fetch manifest file to confirm existence of CUR. Use IsNotExist to test for a missing manifest
 func (c *CurConvert) CheckCURExists() error {
-
-	// get location of bucket
-	bucketLocation, err := c.getBucketLocation(c.sourceBucket, c.sourceArn, c.sourceExternalID)
-	if err != nil {
-		return err
-	}
-
-	// Init Session
-	sess, err := session.NewSession(&aws.Config{Region: aws.String(bucketLocation), DisableRestProtocolURICleaning: aws.Bool(true)})
-	if err != nil {
-		return err
+	source := c.getSourceStorage()
+	if _, err := source.Stat(aws.BackgroundContext(), c.sourceObject); err != nil {
+		return &ManifestError{Bucket: source.String(), Key: c.sourceObject, Err: err}
 	}
-
-	// if needed set creds for AssumeRole and reset session
-	if len(c.sourceArn) > 0 {
-		sess = sess.Copy(&aws.Config{Credentials: c.getCreds(c.sourceArn, c.sourceExternalID, sess)})
-	}
-
-	svc := s3.New(sess)
-	_, err = svc.GetObject(
-		&s3.GetObjectInput{
-			Bucket: aws.String(c.sourceBucket),
-			Key:    aws.String(c.sourceObject),
-		})
-
-	return err
+	return nil
 }
 
 //
 // ParseCur - Reads JSON manifest file from S3 and adds needed data into struct
 func (c *CurConvert) ParseCur() error {
+	return c.parseCur(aws.BackgroundContext())
+}
 
-	// init S3 manager
-	s3dl, err := c.initS3Downloader(c.sourceBucket, c.sourceArn, c.sourceExternalID)
-	if err != nil {
-		return err
-	}
+// parseCur - ParseCur, stopping when ctx is cancelled
+func (c *CurConvert) parseCur(ctx context.Context) error {
+
+	source := c.getSourceStorage()
 
 	// Download CUR manifest JSON
-	buff := &aws.WriteAtBuffer{}
-	_, err = s3dl.Download(buff, &s3.GetObjectInput{
-		Bucket: aws.String(c.sourceBucket),
-		Key:    aws.String(c.sourceObject),
-	})
+	body, err := source.Get(ctx, c.sourceObject)
 	if err != nil {
-		return fmt.Errorf("failed to download manifest, bucket: %s, object: %s, error: %s", c.sourceBucket, c.sourceObject, err.Error())
+		return &ManifestError{Bucket: source.String(), Key: c.sourceObject, Err: err}
 	}
+	defer body.Close()
 
 	// Unmarshall JSON
 	var j map[string]interface{}
-	err = json.Unmarshal(buff.Bytes(), &j)
+	err = json.NewDecoder(body).Decode(&j)
 	if err != nil {
-		return fmt.Errorf("failed to parse manifest, bucket: %s, object: %s, error: %s", c.sourceBucket, c.sourceObject, err.Error())
+		return &ManifestError{Bucket: source.String(), Key: c.sourceObject, Err: err}
+	}
+
+	m, err := parseManifest(j)
+	if err != nil {
+		return &ManifestError{Bucket: source.String(), Key: c.sourceObject, Err: err}
 	}
 
 	// Store all column names from manifests
-	cols := j["columns"].([]interface{})
 	seen := make(map[string]bool)
-	c.skipCols = make(map[int]bool)
-	i := -1
-	for column := range cols {
-		i++
-		t := cols[column].(map[string]interface{})
-		columnName := t["category"].(string) + "/" + t["name"].(string)
+	manifestTypes := make(map[int]string)
+	c.fields = nil
+	c.columnIndex = make(map[string]int)
+	c.tagColumns = nil
+	c.mapFields = nil
+	c.CurColumns = nil
+	c.CurFiles = nil
+	for i, col := range m.columns {
+		manifestTypes[i] = col.colType
+		columnName := col.name
 
 		// convert columns names to allowed characters (lowercase) and substitute '_' for any non-allowed character
 		columnName = strings.ToLower(columnName)
@@ -373,23 +425,76 @@ func (c *CurConvert) ParseCur() error {
 
 		// Skip duplicate columns
 		if _, ok := seen[columnName]; ok {
-			c.skipCols[i] = true
 			continue
 		}
-		// Check for type over-ride
-		colType, ok := c.CurColumnTypes[columnName]
-		if !ok {
-			colType = "UTF8"
-		}
 
-		c.CurColumns = append(c.CurColumns, "name="+columnName+", type="+colType+", encoding=PLAIN_DICTIONARY")
 		seen[columnName] = true
+		c.columnIndex[columnName] = i
+
+		// Skip columns not selected by the column filter or dropped by redaction, they remain available to row filters
+		if !c.projected(columnName) || c.dropped(columnName) {
+			continue
+		}
+
+		// Collect resource tags into the tag map column rather than a column per tag, if enabled
+		if c.tagMap && isTagColumn(columnName) {
+			c.tagColumns = append(c.tagColumns, tagColumn{key: col.key, index: i})
+			continue
+		}
+
+		// CUR 2.0 MAP columns (e.g. resource_tags) are held in the CSV as JSON
+		if isMapType(col.colType) {
+			c.mapFields = append(c.mapFields, curField{name: columnName, athenaType: mapType, index: i})
+			continue
+		}
+
+		c.fields = append(c.fields, curField{name: columnName, index: i})
+	}
+	c.addTagMap()
+	if len(c.fields) < 1 && len(c.mapFields) < 1 {
+		return &ManifestError{Bucket: source.String(), Key: c.sourceObject, Err: errors.New("no columns selected by column filter")}
+	}
+
+	// Store assemblyId and CUR files
+	c.assemblyID = m.assemblyID
+	c.CurFiles = m.files
+
+	// Parquet CUR reports are copied as is, so take columns from the parquet schema rather than the manifest
+	c.inputFormat = manifestFormat(j, m.files)
+	if c.inputFormat == formatParquet {
+		if opt := c.parquetInputOptions(); len(opt) > 0 {
+			return &ManifestError{Bucket: source.String(), Key: c.sourceObject, Err: fmt.Errorf("%s cannot be used with Parquet CUR reports", opt)}
+		}
+		if err := c.parseParquetSchema(ctx); err != nil {
+			return &ManifestError{Bucket: source.String(), Key: c.sourceObject, Err: err}
+		}
+		return nil
+	}
+
+	// Determine column types and build parquet metadata
+	if err := c.resolveTypes(ctx, manifestTypes); err != nil {
+		return &ManifestError{Bucket: source.String(), Key: c.sourceObject, Err: fmt.Errorf("failed to determine column types: %s", err)}
+	}
+	if err := c.resolveRedactions(); err != nil {
+		return &ManifestError{Bucket: source.String(), Key: c.sourceObject, Err: fmt.Errorf("failed to apply redaction: %s", err)}
 	}
 
-	// Store CSV CUR files
-	reportKeys := j["reportKeys"].([]interface{})
-	for key := range reportKeys {
-		c.CurFiles = append(c.CurFiles, reportKeys[key].(string))
+	// Rows of merged reports are labelled with the report they were converted from
+	if len(c.sourceReport) > 0 {
+		c.fields = append(c.fields, curField{name: sourceReportColumn, athenaType: "STRING", index: sourceReportIndex})
+	}
+
+	// Merge columns with those of previously converted months
+	if c.schemaRegistry {
+		if err := c.loadSchema(ctx); err != nil {
+			return err
+		}
+		if err := c.applySchema(); err != nil {
+			return &ManifestError{Bucket: source.String(), Key: c.sourceObject, Err: fmt.Errorf("failed to apply schema registry: %s", err)}
+		}
+	}
+	for i := range c.fields {
+		c.CurColumns = append(c.CurColumns, columnMetadata(c.fields[i], !c.plainEncoding))
 	}
 	return nil
 }
@@ -397,289 +502,425 @@ func (c *CurConvert) ParseCur() error {
 //
 // DownloadCur -
 func (c *CurConvert) DownloadCur(curObject string) (string, error) {
+	return c.downloadCur(aws.BackgroundContext(), curObject)
+}
+
+// downloadCur - DownloadCur, stopping when ctx is cancelled. Downloads are resumable where the source supports it, see
+// SetDownloadOptions
+func (c *CurConvert) downloadCur(ctx context.Context, curObject string) (string, error) {
 
 	// define localfile name
 	localFile := c.tempDir + "/" + curObject[strings.LastIndex(curObject, "/")+1:]
+	source := c.getSourceStorage()
+
+	// download by range into a partial file, which is kept on failure to resume from
+	if rs, ok := c.rangeSource(source); ok {
+		if err := c.resumeDownload(ctx, rs, curObject, localFile); err != nil {
+			return "", &SourceFileError{Bucket: source.String(), Key: curObject, Err: err}
+		}
+		return localFile, nil
+	}
 
 	// create localfile
 	file, err := os.Create(localFile)
 	if err != nil {
-		return "", err
+		return "", &SourceFileError{Bucket: source.String(), Key: curObject, Err: err}
 	}
 	defer file.Close()
 
-	// init S3 manager
-	s3dl, err := c.initS3Downloader(c.sourceBucket, c.sourceArn, c.sourceExternalID)
-	if err != nil {
-		return "", err
-	}
-
-	// download S3 object to file
-	_, err = s3dl.Download(file,
-		&s3.GetObjectInput{
-			Bucket: aws.String(c.sourceBucket),
-			Key:    aws.String(curObject),
-		})
-
-	if err != nil {
-		return "", fmt.Errorf("failed to download CUR object, bucket: %s, object: %s, error: %s", c.sourceBucket, curObject, err.Error())
+	// download CUR object to file, removing any partial download
+	if err := source.Download(ctx, curObject, file); err != nil {
+		os.Remove(localFile)
+		return "", &SourceFileError{Bucket: source.String(), Key: curObject, Err: err}
 	}
 
 	return localFile, nil
 }
 
 //
-// ParquetCur -
+// ParquetCur - Converts a downloaded CUR file into a local parquet file. Not supported when output is partitioned, as a
+// CUR file then produces a parquet file per partition, use ConvertCur instead
 func (c *CurConvert) ParquetCur(inputFile string) (string, error) {
 
-	// open input
-	file, err := os.Open(inputFile)
-	if err != nil {
-		return "", err
+	if len(c.partitions) > 0 {
+		return "", errors.New("ParquetCur cannot be used with partitioned output, use ConvertCur")
 	}
-	defer file.Close()
 
-	// init gzip library on input
-	gr, err := gzip.NewReader(file)
+	outputs, _, err := c.parquetCur(aws.BackgroundContext(), inputFile, "file://", inputFile)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
-	defer gr.Close()
-
-	// init csv reader
-	cr := csv.NewReader(gr)
+	return outputs[0].localFile, nil
+}
 
-	// read and ignore header record
-	_, err = cr.Read()
-	if err != nil {
-		log.Fatal(err)
-	}
+// parquetCur - converts inputFile, downloaded from bucket and key, into local parquet files, one per partition
+func (c *CurConvert) parquetCur(ctx context.Context, inputFile string, bucket string, key string) ([]*parquetOutput, csvTotals, error) {
 
-	// create local parquet file
-	localParquetFile := c.tempDir + "/" + inputFile[strings.LastIndex(inputFile, "/")+1:strings.Index(inputFile, ".")] + ".parquet"
-	f, err := ParquetFile.NewLocalFileWriter(localParquetFile)
+	// open input
+	file, err := os.Open(inputFile)
 	if err != nil {
-		return "", fmt.Errorf("failed to create parquet file %s, error: %s", localParquetFile, err.Error())
+		return nil, csvTotals{}, &SourceFileError{Bucket: bucket, Key: key, Err: err}
 	}
+	defer file.Close()
 
-	// init Parquet writer
-	ph, err := ParquetWriter.NewCSVWriter(c.CurColumns, f, int64(c.concurrency))
+	// create local parquet file per partition
+	name := c.parquetName(inputFile)
+	outputs, totals, err := c.writeParquet(ctx, file, bucket, key, func(partition string) (*parquetOutput, error) {
+		localParquetFile := c.outputFile(partition, name)
+		f, err := ParquetFile.NewLocalFileWriter(localParquetFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create parquet file %s, error: %s", localParquetFile, err.Error())
+		}
+		return &parquetOutput{partition: partition, localFile: localParquetFile, destKey: c.outputKey(partition, name), file: f}, nil
+	})
 	if err != nil {
-		return "", err
+		removeOutputs(outputs)
+		return nil, totals, err
 	}
+	return outputs, totals, nil
+}
 
-	// read all remaining records of CSV file and write to parquet
-	i := 1
-	for {
-		if i%5000 == 0 {
-			ph.Flush(true)
-			i = 1
-		}
-
-		rec, err := cr.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return "", err
+// removeOutputs - removes local parquet files
+func removeOutputs(outputs []*parquetOutput) {
+	for _, out := range outputs {
+		if len(out.localFile) > 0 {
+			os.Remove(out.localFile)
 		}
+	}
+}
 
-		var recParquet []*string
-		for k := range rec {
-			_, skip := c.skipCols[k]
-			if !skip {
-				recParquet = append(recParquet, &rec[k])
+// curExtensions - file extensions of CUR files, replaced by .parquet in output file names
+var curExtensions = []string{".gz", ".zip", ".csv", ".parquet", ".snappy"}
+
+// parquetFileName - returns the parquet file name for a CUR object or file, i.e. the base name with CUR extensions
+// replaced. Report names may themselves contain '.'
+func parquetFileName(name string) string {
+	name = name[strings.LastIndex(name, "/")+1:]
+	for trimmed := true; trimmed; {
+		trimmed = false
+		for _, ext := range curExtensions {
+			if strings.HasSuffix(strings.ToLower(name), ext) && len(name) > len(ext) {
+				name = name[:len(name)-len(ext)]
+				trimmed = true
 			}
 		}
-		ph.WriteString(recParquet)
-		i++
-	}
-
-	if i > 1 {
-		ph.Flush(true)
 	}
-	ph.WriteStop()
-	f.Close()
+	return name + ".parquet"
+}
 
-	return localParquetFile, nil
+//
+// UploadCur -
+func (c *CurConvert) UploadCur(parquetFile string) error {
+	return c.uploadCur(aws.BackgroundContext(), parquetFile, c.destObject+"/"+parquetFile[strings.LastIndex(parquetFile, "/")+1:])
 }
 
-func (c *CurConvert) uploadCUR(destObject string, file io.Reader) error {
+// uploadCur - uploads a local parquet file to destObject
+func (c *CurConvert) uploadCur(ctx context.Context, parquetFile string, destObject string) error {
 
-	// init S3 manager
-	s3up, err := c.initS3Uploader(c.destBucket, c.destArn, c.destExternalID)
+	dest := c.getDestStorage()
+	file, err := os.Open(parquetFile)
 	if err != nil {
-		return err
+		return &UploadError{Bucket: dest.String(), Key: destObject, Err: err}
 	}
+	defer file.Close()
 
-	_, err = s3up.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(c.destBucket),
-		Key:    aws.String(destObject),
-		Body:   file,
-	})
-
-	if err != nil {
-		return fmt.Errorf("failed to upload CUR parquet object, bucket: %s, object: %s, error: %s", c.destBucket, destObject, err.Error())
+	if err := dest.Put(ctx, destObject, file); err != nil {
+		return &UploadError{Bucket: dest.String(), Key: destObject, Err: err}
 	}
 
+	c.addParquetFile(destObject)
 	return nil
 }
 
-func (c *CurConvert) uploadEncryptedCUR(destObject string, file io.ReadSeeker) error {
+// addParquetFile - records an uploaded parquet object so CleanCur keeps it, safe for concurrent use
+func (c *CurConvert) addParquetFile(destObject string) {
+	c.filesLock.Lock()
+	c.CurParqetFiles[destObject] = true
+	c.filesLock.Unlock()
+}
 
-	// get location of bucket
-	bucketLocation, err := c.getBucketLocation(c.destBucket, c.destArn, c.destExternalID)
-	if err != nil {
-		return err
+//
+// SetCleanDryRun - when enabled CleanCur does not delete anything, the objects it would delete are returned by GetCleanObjects
+func (c *CurConvert) SetCleanDryRun(enabled bool) {
+	c.cleanDryRun = enabled
+}
+
+//
+// GetCleanObjects - returns the keys deleted by the last CleanCur, or that would have been deleted when a dry-run
+func (c *CurConvert) GetCleanObjects() []string {
+	return c.cleanObjects
+}
+
+//
+// CleanCUr - deletes objects in the dest path that were not uploaded by this conversion. Nothing is deleted if no
+// parquet files were uploaded, as that would remove the whole month
+func (c *CurConvert) CleanCur() error {
+	return c.cleanCur(aws.BackgroundContext())
+}
+
+// cleanCur - CleanCur, stopping when ctx is cancelled
+func (c *CurConvert) cleanCur(ctx context.Context) error {
+
+	dest := c.getDestStorage()
+	prefix := c.outputPrefix() + "/"
+	c.cleanObjects = nil
+
+	if len(c.CurParqetFiles) < 1 {
+		return &UploadError{Bucket: dest.String(), Key: prefix, Err: errors.New("refusing to clean as no parquet files were uploaded")}
 	}
 
-	// Init Session
-	sess, err := session.NewSession(&aws.Config{Region: aws.String(bucketLocation), DisableRestProtocolURICleaning: aws.Bool(true)})
+	// List all objects in current parquet destination path, only the staged version when versioned
+	objects, err := dest.List(ctx, prefix)
 	if err != nil {
-		return err
+		return &UploadError{Bucket: dest.String(), Key: prefix, Err: fmt.Errorf("listing objects to clean: %s", err)}
 	}
 
-	// if needed set creds for AssumeRole and reset session
-	if len(c.destArn) > 0 {
-		sess = sess.Copy(&aws.Config{Credentials: c.getCreds(c.destArn, c.destExternalID, sess)})
+	// Build delete list of all objects not in c.CurParqetFiles map i.e. have not been uploaded on this conversion.
+	// Metadata such as the conversion state is kept, as is the output of other reports when merging
+	var deleteObjects []string
+	for object := range objects {
+		key := objects[object].Key
+		if strings.HasPrefix(key[strings.LastIndex(key, "/")+1:], "_") || !c.ownsOutput(key) {
+			continue
+		}
+		if _, ok := c.CurParqetFiles[key]; !ok {
+			deleteObjects = append(deleteObjects, key)
+		}
+	}
+	c.cleanObjects = deleteObjects
+	if c.cleanDryRun {
+		return nil
 	}
 
-	// init crypto lib
-	handler := s3crypto.NewKMSKeyGenerator(kms.New(sess), c.destKMSKey)
-	encryptionClient := s3crypto.NewEncryptionClient(sess, s3crypto.AESGCMContentCipherBuilder(handler))
-
-	req, _ := encryptionClient.PutObjectRequest(&s3.PutObjectInput{
-		Bucket: aws.String(c.destBucket),
-		Key:    aws.String(destObject),
-		Body:   file,
-	})
-
-	err = req.Send()
+	// Proccess object delection / cleanup
+	err = dest.Delete(ctx, deleteObjects)
 	if err != nil {
-		return fmt.Errorf("failed to upload CUR parquet object, bucket: %s, object: %s, error: %s", c.destBucket, destObject, err.Error())
+		return &UploadError{Bucket: dest.String(), Key: prefix, Err: fmt.Errorf("deleting objects when cleaning: %s", err)}
 	}
-
 	return nil
 }
 
 //
-// UploadCur -
-func (c *CurConvert) UploadCur(parquetFile string) error {
+// ConvertCur - Performs Download, Conversion
+func (c *CurConvert) ConvertCur() error {
+	return c.ConvertCurContext(aws.BackgroundContext())
+}
 
-	destObject := c.destObject + "/" + parquetFile[strings.LastIndex(parquetFile, "/")+1:]
+//
+// ConvertCurContext - ConvertCur, stopping early when ctx is cancelled. CUR files are converted by a pool of
+// fileConcurrency workers, each stage of a file is retried as set by SetRetry. Files that still fail are handled by
+// the failure policy, once it is broken the remaining work is cancelled and the returned ConvertErrors lists every
+// file that failed. Partial local and destination files are removed, and CleanCur / state saving are skipped on failure.
+// Failures the policy allows are returned as a PartialError after the conversion completes. When versioning is enabled
+// a failed conversion removes its staged version and the published version is left unchanged. When a preflight mode
+// is set the conversion is planned first, see SetPreflight
+func (c *CurConvert) ConvertCurContext(ctx context.Context) error {
 
-	file, err := os.Open(parquetFile)
-	if err != nil {
+	if c.streaming && len(c.destKMSKey) > 0 {
+		return errors.New("Streaming conversion cannot be used with client-side KMS encryption")
+	}
+	if len(c.destKMSKey) > 0 && len(c.destSSE.Mode) > 0 {
+		return errors.New("Client-side KMS encryption and server-side encryption cannot both be used")
+	}
+
+	if err := c.parseCur(ctx); err != nil {
 		return err
 	}
-	defer file.Close()
 
-	if len(c.destKMSKey) > 0 {
-		if err := c.uploadEncryptedCUR(destObject, file); err != nil {
+	// remove partial downloads no longer needed, left by earlier runs that failed or were interrupted
+	c.cleanPartials()
+
+	// load previous conversion state so unchanged files can be skipped
+	if err := c.retry(ctx, func() error { return c.loadState(ctx) }); err != nil {
+		return err
+	}
+	c.resetVerify()
+
+	// versioned output is staged into a new version folder, which is published once every file has converted
+	c.version = ""
+	if c.versioned {
+		upToDate, err := c.stageVersion(ctx)
+		if err != nil {
 			return err
 		}
-	} else {
-		if err := c.uploadCUR(destObject, file); err != nil {
-			return err
+		if upToDate {
+			return nil
 		}
 	}
+	published := false
+	defer func() {
+		if !published {
+			c.discardVersion()
+		}
+	}()
 
-	c.CurParqetFiles[destObject] = true
-	return nil
-}
-
-//
-// CleanCUr
-func (c *CurConvert) CleanCur() error {
-
-	// init S3 manager
-	s3up, err := c.initS3Uploader(c.destBucket, c.destArn, c.destExternalID)
+	// HEAD every file to check the temp directory and memory limit can hold the conversion, once unchanged files of the
+	// staged version are known
+	fileConcurrency, err := c.preflightCheck(ctx)
 	if err != nil {
 		return err
 	}
 
-	// List all objects in current parquet destination path
-	result, err := s3up.S3.ListObjectsV2(
-		&s3.ListObjectsV2Input{
-			Bucket:  aws.String(c.destBucket),
-			Prefix:  aws.String(c.destObject + "/"),
-			MaxKeys: aws.Int64(500),
-		})
-	if err != nil {
-		return fmt.Errorf("Error listing oject list when cleaning CUR: %s", err.Error())
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan string)
+	var lock sync.Mutex
+	var errs ConvertErrors
+	var wg sync.WaitGroup
+	workers := fileConcurrency
+	if workers > len(c.CurFiles) {
+		workers = len(c.CurFiles)
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for object := range jobs {
+				if err := c.convertFile(workCtx, object); err != nil {
+					lock.Lock()
+					// errors caused by cancelling other workers are noise, only the cause is reported
+					if workCtx.Err() == nil || !isCanceled(err) {
+						errs = append(errs, err)
+					}
+					if c.tooManyFailures(len(errs), len(c.CurFiles)) {
+						cancel()
+					}
+					lock.Unlock()
+				}
+			}
+		}()
 	}
 
-	// Build delete list of all objects not in c.CurParqetFiles map i.e. have not been uploaded on this conversion.
-	var deleteObjects []s3manager.BatchDeleteObject
-	for object := range result.Contents {
-		_, ok := c.CurParqetFiles[*result.Contents[object].Key]
-		if !ok {
-			deleteObjects = append(deleteObjects, s3manager.BatchDeleteObject{
-				Object: &s3.DeleteObjectInput{
-					Key:    aws.String(*result.Contents[object].Key),
-					Bucket: aws.String(c.destBucket),
-				},
-			})
+feed:
+	for _, object := range c.CurFiles {
+		select {
+		case jobs <- object:
+		case <-workCtx.Done():
+			break feed
 		}
 	}
+	close(jobs)
+	wg.Wait()
 
-	// Proccess object delection / cleanup
-	batcher := s3manager.NewBatchDeleteWithClient(s3up.S3)
-	err = batcher.Delete(aws.BackgroundContext(), &s3manager.DeleteObjectsIterator{
-		Objects: deleteObjects,
-	})
-	if err != nil {
-		return fmt.Errorf("Error deleting objects when cleaning CUR: %s", err.Error())
+	if ctx.Err() != nil {
+		return append(errs, ctx.Err())
+	}
+	if c.tooManyFailures(len(errs), len(c.CurFiles)) {
+		return errs
+	}
+
+	if err := c.cleanCur(ctx); err != nil {
+		return err
+	}
+	if c.versioned {
+		if err := c.publishVersion(ctx); err != nil {
+			return err
+		}
+	}
+	published = true
+	if err := c.saveState(ctx); err != nil {
+		return err
+	}
+	if err := c.saveSchema(ctx); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return &PartialError{Failed: len(errs), Total: len(c.CurFiles), Errs: errs}
 	}
 	return nil
 }
 
-//
-// ConvertCur - Performs Download, Conversion
-func (c *CurConvert) ConvertCur() error {
+// convertFile - converts and uploads a single CUR file, unless it is unchanged since the previous conversion. Each
+// stage is retried independently, so a failed upload does not repeat the download and conversion
+func (c *CurConvert) convertFile(ctx context.Context, object string) error {
 
-	if err := c.ParseCur(); err != nil {
-		return fmt.Errorf("Error Parsing CUR Manifest: %s", err.Error())
+	source := c.getSourceStorage()
+	var info ObjectInfo
+	err := c.retry(ctx, func() error {
+		var err error
+		info, err = source.Stat(ctx, object)
+		return err
+	})
+	if err != nil {
+		return &SourceFileError{Bucket: source.String(), Key: object, Err: err}
 	}
 
-	result := make(chan error)
-	limit := make(chan bool, c.fileConcurrency)
-	i := 0
-	for reportKey := range c.CurFiles {
-		go func(object string) {
-			limit <- true
-			gzipFile, err := c.DownloadCur(object)
-			if err != nil {
-				result <- fmt.Errorf("Error Downloading CUR: %s", err.Error())
-				return
-			}
+	if prev, ok := c.unchanged(ctx, object, info.ETag); ok {
+		for _, key := range prev.OutputKeys {
+			c.addParquetFile(key)
+		}
+		c.setFileState(object, prev)
+		c.setVerification(FileVerification{Key: object, Skipped: true})
+		return nil
+	}
 
-			parquetFile, err := c.ParquetCur(gzipFile)
-			if err != nil {
-				result <- fmt.Errorf("Error Converting CUR: %s", err.Error())
-				return
+	// copies and streams are a single stage
+	if c.inputFormat == formatParquet || c.streaming {
+		var outputs []*parquetOutput
+		err := c.retry(ctx, func() error {
+			var err error
+			if c.inputFormat == formatParquet {
+				outputs, err = c.copyCur(ctx, object)
+				c.setVerification(FileVerification{Key: object, Skipped: true})
+				return err
 			}
-
-			if err := c.UploadCur(parquetFile); err != nil {
-				result <- fmt.Errorf("Error Uploading CUR: %s", err.Error())
-				return
+			var totals csvTotals
+			if outputs, totals, err = c.streamCur(ctx, object); err != nil {
+				return err
+			}
+			if err = c.verifyOutputs(ctx, object, totals, outputs); err != nil {
+				return cleanupFailed(err, c.deleteOutputs(outputs))
 			}
+			for _, out := range outputs {
+				c.addParquetFile(out.destKey)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		c.setFileState(object, newFileState(info.ETag, outputs))
+		return nil
+	}
+
+	var localFile string
+	err = c.retry(ctx, func() error {
+		var err error
+		localFile, err = c.downloadCur(ctx, object)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localFile)
 
-			os.Remove(gzipFile)
-			os.Remove(parquetFile)
-			<-limit
-			result <- nil
-		}(c.CurFiles[reportKey])
-		i++
+	var outputs []*parquetOutput
+	err = c.retry(ctx, func() error {
+		var err error
+		var totals csvTotals
+		if outputs, totals, err = c.parquetCur(ctx, localFile, source.String(), object); err != nil {
+			return err
+		}
+		if err = c.verifyOutputs(ctx, object, totals, outputs); err != nil {
+			removeOutputs(outputs)
+		}
+		return err
+	})
+	if err != nil {
+		return err
 	}
+	defer removeOutputs(outputs)
 
-	// wait for jobs to complete
-	for w := 0; w < i; w++ {
-		err := <-result
+	for _, out := range outputs {
+		err := c.retry(ctx, func() error {
+			return c.uploadCur(ctx, out.localFile, out.destKey)
+		})
 		if err != nil {
 			return err
 		}
 	}
 
-	return c.CleanCur()
+	c.setFileState(object, newFileState(info.ETag, outputs))
+	return nil
 }
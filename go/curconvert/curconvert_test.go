@@ -0,0 +1,138 @@
+package curconvert
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestParquetFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"cur/20261001-20261101/a1/cur-1.csv.gz", "cur-1.parquet"},
+		{"cur-1.csv.zip", "cur-1.parquet"},
+		{"cur-1.csv", "cur-1.parquet"},
+		{"export/data/part-0.snappy.parquet", "part-0.parquet"},
+		{"/tmp/cur-1.CSV.GZ", "cur-1.parquet"},
+		{"my.report-1.csv.gz", "my.report-1.parquet"},
+		{"cur-1", "cur-1.parquet"},
+		{".gz", ".gz.parquet"},
+	}
+	for _, tt := range tests {
+		if got := parquetFileName(tt.name); got != tt.want {
+			t.Errorf("parquetFileName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsCanceled(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "canceled", err: context.Canceled, want: true},
+		{name: "wrapped", err: &ConversionError{Key: "cur-1.csv.gz", Err: context.Canceled}, want: true},
+		{name: "aws", err: awserr.New(request.CanceledErrorCode, "canceled", nil), want: true},
+		{name: "deadline", err: context.DeadlineExceeded, want: false},
+		{name: "other", err: &UploadError{Err: errors.New("AccessDenied")}, want: false},
+		{name: "nil", err: nil, want: false},
+	}
+	for _, tt := range tests {
+		if got := isCanceled(tt.err); got != tt.want {
+			t.Errorf("%s: isCanceled = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSignalContext(t *testing.T) {
+	ctx, cancel := SignalContext()
+	defer cancel()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not cancelled on SIGTERM")
+	}
+}
+
+func TestConvertCurContextCancelled(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	source := NewLocalStorage(dir + "/source")
+	dest := NewLocalStorage(dir + "/dest")
+	putObject(t, source, "cur/cur-Manifest.json", `{"assemblyId": "a1",
+		"columns": [{"category": "lineItem", "name": "UsageAmount", "type": "OptionalBigDecimal"}],
+		"reportKeys": ["cur/a1/cur-1.csv.gz", "cur/a1/cur-2.csv.gz"]}`)
+	putObject(t, source, "cur/a1/cur-1.csv.gz", gzipCSV(t, "a\n1.5\n"))
+	putObject(t, source, "cur/a1/cur-2.csv.gz", gzipCSV(t, "a\n2.5\n"))
+
+	c := NewCurConvert("", "cur/cur-Manifest.json", "", "parquet/202610")
+	c.SetSourceStorage(source)
+	c.SetDestStorage(dest)
+	c.SetStreaming(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.ConvertCurContext(ctx); err == nil {
+		t.Fatal("expected a cancelled conversion to fail")
+	}
+
+	// nothing is published, and no state is saved
+	if keys := listKeys(t, dest, "parquet/"); len(keys) > 0 {
+		t.Errorf("dest holds %v after a cancelled conversion", keys)
+	}
+}
+
+func TestCleanCur(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	dest := NewLocalStorage(dir)
+	for _, key := range []string{"parquet/202610/cur-1.parquet", "parquet/202610/cur-old.parquet", "parquet/202610/" + stateFileName} {
+		putObject(t, dest, key, "parquet")
+	}
+
+	c := NewCurConvert("", "", "", "parquet/202610")
+	c.SetDestStorage(dest)
+
+	// nothing uploaded would clean the whole month
+	if err := c.CleanCur(); err == nil {
+		t.Error("expected clean without uploaded files to fail")
+	}
+
+	c.addParquetFile("parquet/202610/cur-1.parquet")
+	c.SetCleanDryRun(true)
+	if err := c.CleanCur(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"parquet/202610/cur-old.parquet"}
+	if got := c.GetCleanObjects(); !reflect.DeepEqual(got, want) {
+		t.Errorf("dry-run clean objects %v, want %v", got, want)
+	}
+	if keys := listKeys(t, dest, "parquet/"); len(keys) != 3 {
+		t.Errorf("dry-run deleted objects, left %v", keys)
+	}
+
+	// metadata such as the conversion state is kept
+	c.SetCleanDryRun(false)
+	if err := c.CleanCur(); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"parquet/202610/" + stateFileName, "parquet/202610/cur-1.parquet"}
+	if got := listKeys(t, dest, "parquet/"); !reflect.DeepEqual(got, want) {
+		t.Errorf("clean left %v, want %v", got, want)
+	}
+}
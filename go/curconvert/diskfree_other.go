@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package curconvert
+
+import "errors"
+
+// diskFree - free space cannot be read on this platform, so the temp directory is not checked
+func diskFree(dir string) (int64, error) {
+	return 0, errors.New("free disk space is not supported on this platform")
+}
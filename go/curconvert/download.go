@@ -0,0 +1,286 @@
+package curconvert
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// download defaults, large enough parts that a multi-GB CUR file is a few hundred GETs
+const (
+	defaultDownloadPartSize    = 32 * 1024 * 1024
+	defaultDownloadConcurrency = 5
+	minDownloadPartSize        = 5 * 1024 * 1024
+)
+
+// partialSuffix - suffix of a CUR file being downloaded, its sidecar adds .json
+const partialSuffix = ".partial"
+
+// partialMaxAge - partial downloads not written to for this long are removed whatever their manifest, as the
+// conversion that left them has not been run again
+const partialMaxAge = 7 * 24 * time.Hour
+
+// downloadRange - an inclusive byte range of a CUR file, as in a HTTP Range header
+type downloadRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// downloadState - sidecar of a partial download, recording the ranges completed so far. The download is only resumed
+// if the object has the same ETag and size. Manifest is that of the conversion, to find partial downloads it no longer
+// needs
+type downloadState struct {
+	Manifest  string          `json:"manifest"`
+	Key       string          `json:"key"`
+	ETag      string          `json:"etag"`
+	Size      int64           `json:"size"`
+	Completed []downloadRange `json:"completed"`
+}
+
+//
+// SetDownloadOptions - sets the part size and number of parts downloaded concurrently for each CUR file. When resumable
+// each downloaded part is recorded in a sidecar of a .partial file in the temp directory, so a download interrupted by a
+// failure, cancellation or the process being killed continues from the completed parts on the next attempt or run.
+// Resumable downloads are the default, and are not used for local or client-side encrypted sources
+func (c *CurConvert) SetDownloadOptions(partSize int64, concurrency int, resumable bool) error {
+	if partSize < minDownloadPartSize {
+		return fmt.Errorf("Download part size must be at least %d bytes", minDownloadPartSize)
+	}
+	if concurrency < 1 || concurrency > 100 {
+		return errors.New("Download concurrency must be between 1-100")
+	}
+	c.downloadPartSize = partSize
+	c.downloadConcurrency = concurrency
+	c.resumable = resumable
+	return nil
+}
+
+// rangeSource - returns the source if downloads can be resumed from it
+func (c *CurConvert) rangeSource(source Storage) (RangeStorage, bool) {
+	if !c.resumable {
+		return nil, false
+	}
+	if s3s, ok := source.(*S3Storage); ok && s3s.decrypt {
+		return nil, false
+	}
+	rs, ok := source.(RangeStorage)
+	return rs, ok
+}
+
+// resumeDownload - downloads curObject into localFile by range, via a .partial file and sidecar. Parts completed by a
+// previous attempt are not downloaded again, and the partial file is kept on failure so it can be resumed. Every range
+// is read conditional on the ETag of the partial download, if the object is replaced the download restarts
+func (c *CurConvert) resumeDownload(ctx context.Context, source RangeStorage, curObject string, localFile string) error {
+	err := c.downloadRanges(ctx, source, curObject, localFile)
+	if IsChanged(err) {
+		os.Remove(localFile + partialSuffix)
+		os.Remove(localFile + partialSuffix + ".json")
+		err = c.downloadRanges(ctx, source, curObject, localFile)
+	}
+	return err
+}
+
+// downloadRanges - downloads the ranges of curObject not yet recorded in the sidecar of its partial file, renaming the
+// partial file to localFile once complete
+func (c *CurConvert) downloadRanges(ctx context.Context, source RangeStorage, curObject string, localFile string) error {
+	info, err := source.Stat(ctx, curObject)
+	if err != nil {
+		return err
+	}
+
+	partialFile := localFile + partialSuffix
+	sidecar := partialFile + ".json"
+	state := loadDownloadState(sidecar)
+	if len(info.ETag) < 1 || state.Key != curObject || state.ETag != info.ETag || state.Size != info.Size {
+		os.Remove(partialFile)
+		state = downloadState{Key: curObject, ETag: info.ETag, Size: info.Size}
+	}
+	state.Manifest = c.sourceObject
+
+	// the sidecar is written first so an interrupted download can always be found by cleanPartials
+	if err := state.save(sidecar); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(partialFile, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := file.Truncate(info.Size); err != nil {
+		return err
+	}
+
+	// parts are only complete if recorded with the same range, so changing the part size downloads them again
+	completed := make(map[downloadRange]bool, len(state.Completed))
+	for _, r := range state.Completed {
+		completed[r] = true
+	}
+	var pending []downloadRange
+	for start := int64(0); start < info.Size; start += c.downloadPartSize {
+		r := downloadRange{Start: start, End: start + c.downloadPartSize - 1}
+		if r.End >= info.Size {
+			r.End = info.Size - 1
+		}
+		if !completed[r] {
+			pending = append(pending, r)
+		}
+	}
+
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan downloadRange)
+	var lock sync.Mutex
+	var downloadErr error
+	var wg sync.WaitGroup
+	workers := c.downloadConcurrency
+	if workers > len(pending) {
+		workers = len(pending)
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range jobs {
+				err := c.downloadPart(workCtx, source, curObject, info.ETag, file, r)
+				lock.Lock()
+				if err == nil {
+					state.Completed = append(state.Completed, r)
+					err = state.save(sidecar)
+				}
+				if err != nil && downloadErr == nil {
+					downloadErr = err
+					cancel()
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, r := range pending {
+		select {
+		case jobs <- r:
+		case <-workCtx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if downloadErr != nil {
+		return downloadErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(partialFile, localFile); err != nil {
+		return err
+	}
+	os.Remove(sidecar)
+	return nil
+}
+
+// downloadPart - downloads range r of curObject, if it still has etag, into file and syncs it so the range can be
+// recorded as complete
+func (c *CurConvert) downloadPart(ctx context.Context, source RangeStorage, curObject string, etag string, file *os.File, r downloadRange) error {
+	length := r.End - r.Start + 1
+	body, err := source.GetRange(ctx, curObject, r.Start, length, etag)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	n, err := copyAtOffset(ctx, file, body, r.Start)
+	if err != nil {
+		return err
+	}
+	if n != length {
+		return fmt.Errorf("short read of bytes %d-%d, got %d of %d bytes: %w", r.Start, r.End, n, length, io.ErrUnexpectedEOF)
+	}
+	return file.Sync()
+}
+
+// cleanPartials - removes the partial downloads of this conversion's manifest whose CUR file is no longer in it, e.g.
+// left by an interrupted run of a superseded CUR assembly, and those of any manifest not written to for partialMaxAge,
+// e.g. of a month that is not converted again. Recent partial downloads of other conversions sharing the temp
+// directory are left alone
+func (c *CurConvert) cleanPartials() {
+	files, err := filepath.Glob(filepath.Join(c.tempDir, "*"+partialSuffix))
+	if err != nil {
+		return
+	}
+	sidecars, err := filepath.Glob(filepath.Join(c.tempDir, "*"+partialSuffix+".json"))
+	if err != nil {
+		return
+	}
+
+	// a partial file or its sidecar may be missing if a download was interrupted as it started or finished
+	partials := make(map[string]bool, len(files))
+	for _, file := range files {
+		partials[file] = true
+	}
+	for _, sidecar := range sidecars {
+		partials[strings.TrimSuffix(sidecar, ".json")] = true
+	}
+
+	current := make(map[string]bool, len(c.CurFiles))
+	for _, object := range c.CurFiles {
+		current[object] = true
+	}
+	for partialFile := range partials {
+		sidecar := partialFile + ".json"
+		stale := olderThan(partialFile, partialMaxAge) && olderThan(sidecar, partialMaxAge)
+		if !stale {
+			state := loadDownloadState(sidecar)
+			stale = state.Manifest == c.sourceObject && !current[state.Key]
+		}
+		if stale {
+			os.Remove(partialFile)
+			os.Remove(sidecar)
+		}
+	}
+}
+
+// olderThan - returns true if file was last modified more than age ago, or does not exist
+func olderThan(file string, age time.Duration) bool {
+	info, err := os.Stat(file)
+	return err != nil || time.Since(info.ModTime()) > age
+}
+
+// loadDownloadState - reads the sidecar of a partial download, a missing or unreadable sidecar has no completed ranges
+func loadDownloadState(sidecar string) downloadState {
+	var state downloadState
+	b, err := ioutil.ReadFile(sidecar)
+	if err != nil {
+		return state
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return downloadState{}
+	}
+	return state
+}
+
+// save - writes the sidecar, via a temp file so an interrupted write leaves the previous sidecar intact
+func (s downloadState) save(sidecar string) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(sidecar+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(sidecar+".tmp", sidecar)
+}
@@ -0,0 +1,245 @@
+package curconvert
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rangeStorage - a RangeStorage over LocalStorage with a fixed ETag, recording the ranges read. GETs fail once
+// failAfter ranges have been read, and when stale the first Stat returns the previous ETag as if the object was replaced
+// after it
+type rangeStorage struct {
+	*LocalStorage
+	etag      string
+	stale     bool
+	failAfter int
+
+	lock   sync.Mutex
+	ranges []downloadRange
+}
+
+func (r *rangeStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := r.LocalStorage.Stat(ctx, key)
+	info.ETag = r.etag
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stale {
+		r.stale = false
+		info.ETag = "previous"
+	}
+	return info, err
+}
+
+func (r *rangeStorage) GetRange(ctx context.Context, key string, offset int64, length int64, etag string) (io.ReadCloser, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(etag) > 0 && etag != r.etag {
+		return nil, ErrChanged
+	}
+	if r.failAfter >= 0 && len(r.ranges) >= r.failAfter {
+		return nil, timeoutError{}
+	}
+	file, err := os.Open(r.path(key))
+	if err != nil {
+		return nil, err
+	}
+	r.ranges = append(r.ranges, downloadRange{Start: offset, End: offset + length - 1})
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(file, offset, length), file}, nil
+}
+
+func TestResumeDownload(t *testing.T) {
+	const (
+		curObject = "cur/a1/cur-1.csv.gz"
+		content   = "0123456789"
+	)
+	all := []downloadRange{{0, 3}, {4, 7}, {8, 9}}
+	tests := []struct {
+		name       string
+		partial    string
+		sidecar    *downloadState
+		stale      bool
+		wantRanges []downloadRange
+	}{
+		{name: "new download", wantRanges: all},
+		{
+			name:       "resumed",
+			partial:    "0123xxxxxx",
+			sidecar:    &downloadState{Key: curObject, ETag: "e1", Size: 10, Completed: []downloadRange{{0, 3}}},
+			wantRanges: []downloadRange{{4, 7}, {8, 9}},
+		},
+		{
+			name:       "resumed out of order",
+			partial:    "xxxx456789",
+			sidecar:    &downloadState{Key: curObject, ETag: "e1", Size: 10, Completed: []downloadRange{{8, 9}, {4, 7}}},
+			wantRanges: []downloadRange{{0, 3}},
+		},
+		{
+			name:       "different part size",
+			partial:    "01234xxxxx",
+			sidecar:    &downloadState{Key: curObject, ETag: "e1", Size: 10, Completed: []downloadRange{{0, 4}}},
+			wantRanges: all,
+		},
+		{
+			name:       "object changed",
+			partial:    "0123xxxxxx",
+			sidecar:    &downloadState{Key: curObject, ETag: "e0", Size: 10, Completed: []downloadRange{{0, 3}}},
+			wantRanges: all,
+		},
+		{
+			name:       "object replaced during download",
+			partial:    "0123xxxxxx",
+			sidecar:    &downloadState{Key: curObject, ETag: "previous", Size: 10, Completed: []downloadRange{{0, 3}}},
+			stale:      true,
+			wantRanges: all,
+		},
+		{
+			name:       "other object",
+			partial:    "0123xxxxxx",
+			sidecar:    &downloadState{Key: "cur/a0/cur-1.csv.gz", ETag: "e1", Size: 10, Completed: []downloadRange{{0, 3}}},
+			wantRanges: all,
+		},
+	}
+	for _, tt := range tests {
+		func() {
+			dir, cleanup := testDir(t)
+			defer cleanup()
+
+			source := &rangeStorage{LocalStorage: NewLocalStorage(dir + "/source"), etag: "e1", stale: tt.stale, failAfter: -1}
+			putObject(t, source, curObject, content)
+
+			localFile := dir + "/cur-1.csv.gz"
+			if len(tt.partial) > 0 {
+				if err := ioutil.WriteFile(localFile+partialSuffix, []byte(tt.partial), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.sidecar != nil {
+				if err := tt.sidecar.save(localFile + partialSuffix + ".json"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c := NewCurConvert("", "cur/cur-Manifest.json", "", "parquet/202610")
+			c.downloadPartSize = 4
+			c.downloadConcurrency = 1
+			if err := c.resumeDownload(context.Background(), source, curObject, localFile); err != nil {
+				t.Fatalf("%s: %s", tt.name, err)
+			}
+
+			if !reflect.DeepEqual(source.ranges, tt.wantRanges) {
+				t.Errorf("%s: downloaded %v, want %v", tt.name, source.ranges, tt.wantRanges)
+			}
+			b, err := ioutil.ReadFile(localFile)
+			if err != nil || string(b) != content {
+				t.Errorf("%s: downloaded %q (%v), want %q", tt.name, b, err, content)
+			}
+			for _, leftover := range []string{localFile + partialSuffix, localFile + partialSuffix + ".json"} {
+				if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+					t.Errorf("%s: %s was not removed", tt.name, leftover)
+				}
+			}
+		}()
+	}
+}
+
+func TestResumeDownloadInterrupted(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	const curObject = "cur/a1/cur-1.csv.gz"
+	source := &rangeStorage{LocalStorage: NewLocalStorage(dir + "/source"), etag: "e1", failAfter: 2}
+	putObject(t, source, curObject, "0123456789")
+
+	c := NewCurConvert("", "cur/cur-Manifest.json", "", "parquet/202610")
+	c.downloadPartSize = 4
+	c.downloadConcurrency = 1
+	localFile := dir + "/cur-1.csv.gz"
+	if err := c.resumeDownload(ctx, source, curObject, localFile); err == nil {
+		t.Fatal("expected the interrupted download to fail")
+	}
+
+	// the completed parts are recorded for the next attempt
+	state := loadDownloadState(localFile + partialSuffix + ".json")
+	want := downloadState{Manifest: c.sourceObject, Key: curObject, ETag: "e1", Size: 10, Completed: []downloadRange{{0, 3}, {4, 7}}}
+	if !reflect.DeepEqual(state, want) {
+		t.Errorf("sidecar %+v, want %+v", state, want)
+	}
+
+	source.failAfter = -1
+	source.ranges = nil
+	if err := c.resumeDownload(ctx, source, curObject, localFile); err != nil {
+		t.Fatal(err)
+	}
+	if want := []downloadRange{{8, 9}}; !reflect.DeepEqual(source.ranges, want) {
+		t.Errorf("resumed download of %v, want %v", source.ranges, want)
+	}
+	if b, err := ioutil.ReadFile(localFile); err != nil || string(b) != "0123456789" {
+		t.Errorf("downloaded %q (%v)", b, err)
+	}
+}
+
+func TestCleanPartials(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	c := NewCurConvert("", "cur/cur-Manifest.json", "", "parquet/202610")
+	c.tempDir = dir
+	c.CurFiles = []string{"cur/a2/cur-1.csv.gz"}
+
+	old := time.Now().Add(-partialMaxAge - time.Hour)
+	partials := []struct {
+		file  string
+		state downloadState
+		age   bool
+		kept  bool
+	}{
+		{file: "current.csv.gz", state: downloadState{Manifest: c.sourceObject, Key: "cur/a2/cur-1.csv.gz"}, kept: true},
+		{file: "current-old.csv.gz", state: downloadState{Manifest: c.sourceObject, Key: "cur/a2/cur-1.csv.gz"}, age: true},
+		{file: "superseded.csv.gz", state: downloadState{Manifest: c.sourceObject, Key: "cur/a1/cur-1.csv.gz"}},
+		{file: "other.csv.gz", state: downloadState{Manifest: "other/other-Manifest.json", Key: "other/a1/cur-1.csv.gz"}, kept: true},
+		{file: "other-old.csv.gz", state: downloadState{Manifest: "other/other-Manifest.json", Key: "other/a1/cur-1.csv.gz"}, age: true},
+	}
+	for _, p := range partials {
+		partial := dir + "/" + p.file + partialSuffix
+		if err := ioutil.WriteFile(partial, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.state.save(partial + ".json"); err != nil {
+			t.Fatal(err)
+		}
+		if p.age {
+			os.Chtimes(partial, old, old)
+			os.Chtimes(partial+".json", old, old)
+		}
+	}
+
+	// a partial file left without its sidecar is removed once old
+	orphan := dir + "/orphan.csv.gz" + partialSuffix
+	if err := ioutil.WriteFile(orphan, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(orphan, old, old)
+
+	c.cleanPartials()
+	for _, p := range partials {
+		for _, f := range []string{p.file + partialSuffix, p.file + partialSuffix + ".json"} {
+			_, err := os.Stat(dir + "/" + f)
+			if kept := err == nil; kept != p.kept {
+				t.Errorf("%s: kept %t, want %t", f, kept, p.kept)
+			}
+		}
+	}
+	if _, err := os.Stat(orphan); err == nil {
+		t.Error("old partial file without a sidecar was kept")
+	}
+}
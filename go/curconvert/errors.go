@@ -0,0 +1,187 @@
+package curconvert
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+//
+// ManifestError - the CUR manifest could not be fetched or parsed, so no CUR files can be converted
+type ManifestError struct {
+	Bucket string
+	Key    string
+	Err    error
+}
+
+func (e *ManifestError) Error() string {
+	return fmt.Sprintf("failed to read manifest, bucket: %s, object: %s, error: %s", e.Bucket, e.Key, e.Err)
+}
+
+// Unwrap - returns the underlying error
+func (e *ManifestError) Unwrap() error {
+	return e.Err
+}
+
+//
+// SourceFileError - a CUR file could not be fetched from the source
+type SourceFileError struct {
+	Bucket string
+	Key    string
+	Err    error
+}
+
+func (e *SourceFileError) Error() string {
+	return fmt.Sprintf("failed to download CUR object, bucket: %s, object: %s, error: %s", e.Bucket, e.Key, e.Err)
+}
+
+// Unwrap - returns the underlying error
+func (e *SourceFileError) Unwrap() error {
+	return e.Err
+}
+
+//
+// ConversionError - a CUR file could not be converted to parquet. Row is the data row (1 being the first row after the
+// header) conversion failed on, or 0 if conversion failed before reading rows, e.g. due to an invalid file or header
+type ConversionError struct {
+	Bucket string
+	Key    string
+	Row    int64
+	Err    error
+}
+
+func (e *ConversionError) Error() string {
+	return fmt.Sprintf("failed to convert CUR object, bucket: %s, object: %s, row: %d, error: %s", e.Bucket, e.Key, e.Row, e.Err)
+}
+
+// Unwrap - returns the underlying error
+func (e *ConversionError) Unwrap() error {
+	return e.Err
+}
+
+//
+// UploadError - converted output could not be written to, or cleaned from, the destination
+type UploadError struct {
+	Bucket string
+	Key    string
+	Err    error
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("failed to upload CUR parquet object, bucket: %s, object: %s, error: %s", e.Bucket, e.Key, e.Err)
+}
+
+// Unwrap - returns the underlying error
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+//
+// ConvertErrors - every error from a failed ConvertCurContext, one per failed CUR file plus the context error if the
+// conversion was cancelled
+type ConvertErrors []error
+
+func (e ConvertErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i := range e {
+		msgs[i] = e[i].Error()
+	}
+	return fmt.Sprintf("%d CUR conversion errors: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// isCanceled - returns true if err, or the error it wraps, is the result of a cancelled context
+func isCanceled(err error) bool {
+	for err != nil {
+		if err == context.Canceled {
+			return true
+		}
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
+			return true
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = u.Unwrap()
+	}
+	return false
+}
+
+// isTransient - returns true if err, or the error it wraps, may succeed when retried: throttling, a 5xx response, a
+// network error or timeout, a truncated read, or a source object replaced mid-download (see IsChanged), which is
+// downloaded again from the start. Invalid CUR data and responses such as AccessDenied or NoSuchKey are permanent
+func isTransient(err error) bool {
+	if IsChanged(err) {
+		return true
+	}
+	for err != nil {
+		switch e := err.(type) {
+		case awserr.RequestFailure:
+			return e.StatusCode() >= 500 || e.StatusCode() == 429 || request.IsErrorThrottle(e) || request.IsErrorRetryable(e)
+		case awserr.Error:
+			if request.IsErrorThrottle(e) || request.IsErrorRetryable(e) {
+				return true
+			}
+			// errors sending a request wrap the underlying network error
+			err = e.OrigErr()
+			continue
+		case net.Error:
+			return true
+		}
+		if err == io.ErrUnexpectedEOF {
+			return true
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = u.Unwrap()
+	}
+	return false
+}
+
+// cleanupFailed - returns err, with the error of cleaning up after it attached if cleaning up failed too
+func cleanupFailed(err error, cleanupErr error) error {
+	if cleanupErr == nil {
+		return err
+	}
+	return fmt.Errorf("%w, cleanup also failed: %s", err, cleanupErr)
+}
+
+//
+// PartialError - some CUR files failed but the failure policy allowed the conversion to complete. Converted files are
+// uploaded and recorded in the conversion state, so only the failed files are converted again on the next run
+type PartialError struct {
+	Failed int
+	Total  int
+	Errs   ConvertErrors
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%d of %d CUR files failed to convert: %s", e.Failed, e.Total, e.Errs)
+}
+
+// Unwrap - returns the errors of the failed files
+func (e *PartialError) Unwrap() error {
+	return e.Errs
+}
+
+//
+// VerifyError - the parquet written for a CUR file, plus the records dropped by row filters, does not match the row
+// count or cost totals of the source
+type VerifyError struct {
+	Bucket   string
+	Key      string
+	Source   VerifyTotals
+	Parquet  VerifyTotals
+	Filtered VerifyTotals
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("failed to verify CUR parquet, bucket: %s, object: %s, source %s, parquet %s, filtered %s", e.Bucket, e.Key, e.Source, e.Parquet, e.Filtered)
+}
@@ -0,0 +1,164 @@
+package curconvert
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// columnPattern - a column name pattern, either a glob (e.g. resourcetags/*) or a regular expression prefixed with re:
+type columnPattern struct {
+	pattern string
+	glob    string
+	re      *regexp.Regexp
+}
+
+// match - returns true if the normalized column name matches the pattern
+func (p columnPattern) match(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	ok, _ := path.Match(p.glob, name)
+	return ok
+}
+
+// newColumnPattern - parses a column pattern
+func newColumnPattern(pattern string) (columnPattern, error) {
+	if strings.HasPrefix(pattern, "re:") {
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, "re:"))
+		if err != nil {
+			return columnPattern{}, fmt.Errorf("Invalid column regex %s: %s", pattern, err)
+		}
+		return columnPattern{pattern: pattern, re: re}, nil
+	}
+
+	glob := strings.ToLower(pattern)
+	if _, err := path.Match(glob, ""); err != nil {
+		return columnPattern{}, fmt.Errorf("Invalid column glob %s: %s", pattern, err)
+	}
+	return columnPattern{pattern: pattern, glob: glob}, nil
+}
+
+//
+// SetColumnFilter - restricts the converted columns. Patterns match normalized column names (e.g. lineitem/usageamount)
+// and are globs, e.g. resourcetags/*, or regular expressions when prefixed with re:. When include is empty all columns
+// are included, exclude patterns are then applied to the included columns
+func (c *CurConvert) SetColumnFilter(include []string, exclude []string) error {
+	var includes, excludes []columnPattern
+	for _, pattern := range include {
+		p, err := newColumnPattern(pattern)
+		if err != nil {
+			return err
+		}
+		includes = append(includes, p)
+	}
+	for _, pattern := range exclude {
+		p, err := newColumnPattern(pattern)
+		if err != nil {
+			return err
+		}
+		excludes = append(excludes, p)
+	}
+	c.columnIncludes = includes
+	c.columnExcludes = excludes
+	return nil
+}
+
+// projected - returns true if the column is selected by the column filter
+func (c *CurConvert) projected(name string) bool {
+	included := len(c.columnIncludes) < 1
+	for _, p := range c.columnIncludes {
+		if p.match(name) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, p := range c.columnExcludes {
+		if p.match(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// rowFilter - a predicate on the value of a single CUR column
+type rowFilter struct {
+	expr   string
+	column string
+	negate bool
+	values map[string]bool
+}
+
+var (
+	regexRowFilter  = regexp.MustCompile(`(?i)^\s*([a-z0-9_/]+)\s*(=|!=|<>|not\s+in|in)\s*(.+?)\s*$`)
+	regexValueList  = regexp.MustCompile(`^\(\s*('(?:[^']|'')*'\s*(?:,\s*'(?:[^']|'')*'\s*)*)\)$`)
+	regexQuotedItem = regexp.MustCompile(`'((?:[^']|'')*)'`)
+)
+
+// newRowFilter - parses a row filter expression
+func newRowFilter(expr string) (rowFilter, error) {
+	m := regexRowFilter.FindStringSubmatch(expr)
+	if m == nil {
+		return rowFilter{}, fmt.Errorf("Invalid row filter \"%s\", expected <column> =, !=, in or not in <'value'>", expr)
+	}
+
+	f := rowFilter{expr: expr, column: strings.ToLower(m[1]), values: make(map[string]bool)}
+	op := strings.ToLower(strings.Join(strings.Fields(m[2]), " "))
+	f.negate = op == "!=" || op == "<>" || op == "not in"
+
+	operand := m[3]
+	if op == "in" || op == "not in" {
+		list := regexValueList.FindStringSubmatch(operand)
+		if list == nil {
+			return rowFilter{}, fmt.Errorf("Invalid row filter \"%s\", expected a list of values e.g. ('a', 'b')", expr)
+		}
+		operand = list[1]
+	} else if !regexQuotedItem.MatchString(operand) || regexQuotedItem.FindString(operand) != operand {
+		return rowFilter{}, fmt.Errorf("Invalid row filter \"%s\", value must be a single quoted string", expr)
+	}
+
+	for _, v := range regexQuotedItem.FindAllStringSubmatch(operand, -1) {
+		f.values[strings.Replace(v[1], "''", "'", -1)] = true
+	}
+	return f, nil
+}
+
+//
+// AddRowFilter - only rows matching every added filter are converted. A filter compares a normalized column name
+// against single quoted values, e.g. lineitem/lineitemtype != 'Tax' or lineitem/usageaccountid in ('123', '456').
+// Supported operators are =, !=, in and not in. Columns missing from the CUR compare as empty strings
+func (c *CurConvert) AddRowFilter(expr string) error {
+	f, err := newRowFilter(expr)
+	if err != nil {
+		return err
+	}
+	c.rowFilters = append(c.rowFilters, f)
+	return nil
+}
+
+// keepRow - returns true if the CSV record matches every row filter
+func (c *CurConvert) keepRow(rec []string) bool {
+	for _, f := range c.rowFilters {
+		var v string
+		if i, ok := c.columnIndex[f.column]; ok && i < len(rec) {
+			v = rec[i]
+		}
+		if f.values[v] == f.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// filterExprs - returns the row filter expressions, as recorded in conversion state
+func (c *CurConvert) filterExprs() []string {
+	var exprs []string
+	for _, f := range c.rowFilters {
+		exprs = append(exprs, f.expr)
+	}
+	return exprs
+}
@@ -0,0 +1,86 @@
+package curconvert
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewRowFilter(t *testing.T) {
+	tests := []struct {
+		expr    string
+		column  string
+		negate  bool
+		values  []string
+		wantErr bool
+	}{
+		{expr: "lineitem/lineitemtype = 'Usage'", column: "lineitem/lineitemtype", values: []string{"Usage"}},
+		{expr: "LineItem/LineItemType != 'Tax'", column: "lineitem/lineitemtype", negate: true, values: []string{"Tax"}},
+		{expr: "lineitem/lineitemtype <> 'Tax'", column: "lineitem/lineitemtype", negate: true, values: []string{"Tax"}},
+		{expr: "product/productname = 'It''s'", column: "product/productname", values: []string{"It's"}},
+		{expr: "lineitem/usageaccountid in ('123', '456')", column: "lineitem/usageaccountid", values: []string{"123", "456"}},
+		{expr: "lineitem/usageaccountid NOT  IN ('123')", column: "lineitem/usageaccountid", negate: true, values: []string{"123"}},
+		{expr: "lineitem/lineitemtype = ''", column: "lineitem/lineitemtype", values: []string{""}},
+		{expr: "lineitem/lineitemtype", wantErr: true},
+		{expr: "lineitem/lineitemtype = Usage", wantErr: true},
+		{expr: "lineitem/lineitemtype = 'a', 'b'", wantErr: true},
+		{expr: "lineitem/lineitemtype in 'a'", wantErr: true},
+		{expr: "lineitem/lineitemtype in ()", wantErr: true},
+		{expr: "lineitem/lineitemtype > 'a'", wantErr: true},
+	}
+	for _, tt := range tests {
+		f, err := newRowFilter(tt.expr)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("newRowFilter(%q): expected an error", tt.expr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newRowFilter(%q): unexpected error: %s", tt.expr, err)
+			continue
+		}
+		want := make(map[string]bool)
+		for _, v := range tt.values {
+			want[v] = true
+		}
+		if f.column != tt.column || f.negate != tt.negate || !reflect.DeepEqual(f.values, want) || f.expr != tt.expr {
+			t.Errorf("newRowFilter(%q) = %+v, want column %s, negate %t, values %v", tt.expr, f, tt.column, tt.negate, tt.values)
+		}
+	}
+}
+
+func TestKeepRow(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters []string
+		rec     []string
+		want    bool
+	}{
+		{name: "no filters", rec: []string{"Usage", "123"}, want: true},
+		{name: "equal", filters: []string{"lineitem/lineitemtype = 'Usage'"}, rec: []string{"Usage", "123"}, want: true},
+		{name: "not equal", filters: []string{"lineitem/lineitemtype != 'Tax'"}, rec: []string{"Tax", "123"}, want: false},
+		{name: "in", filters: []string{"lineitem/usageaccountid in ('123', '456')"}, rec: []string{"Usage", "456"}, want: true},
+		{name: "not in", filters: []string{"lineitem/usageaccountid not in ('123', '456')"}, rec: []string{"Usage", "456"}, want: false},
+		{
+			name:    "every filter must match",
+			filters: []string{"lineitem/lineitemtype = 'Usage'", "lineitem/usageaccountid = '123'"},
+			rec:     []string{"Usage", "456"},
+			want:    false,
+		},
+		{name: "missing column is empty", filters: []string{"product/productcode = ''"}, rec: []string{"Usage", "123"}, want: true},
+		{name: "missing column not equal", filters: []string{"product/productcode != ''"}, rec: []string{"Usage", "123"}, want: false},
+		{name: "short record is empty", filters: []string{"lineitem/usageaccountid = ''"}, rec: []string{"Usage"}, want: true},
+	}
+	for _, tt := range tests {
+		c := NewCurConvert("", "", "", "")
+		c.columnIndex = map[string]int{"lineitem/lineitemtype": 0, "lineitem/usageaccountid": 1}
+		for _, expr := range tt.filters {
+			if err := c.AddRowFilter(expr); err != nil {
+				t.Fatalf("%s: %s", tt.name, err)
+			}
+		}
+		if got := c.keepRow(tt.rec); got != tt.want {
+			t.Errorf("%s: keepRow(%v) = %t, want %t", tt.name, tt.rec, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package curconvert
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/xitongsys/parquet-go/ParquetFile"
+	"github.com/xitongsys/parquet-go/ParquetReader"
+	"github.com/xitongsys/parquet-go/parquet"
+)
+
+// CUR file formats, detected from the manifest and the leading bytes of each file
+const (
+	formatCSV     = "CSV"
+	formatGzip    = "GZIP"
+	formatZip     = "ZIP"
+	formatParquet = "PARQUET"
+)
+
+// magic numbers of the supported compressed and Parquet formats
+var (
+	magicGzip    = []byte{0x1f, 0x8b}
+	magicZip     = []byte("PK\x03\x04")
+	magicParquet = []byte("PAR1")
+)
+
+// detectFormat - returns the format of a CUR file from its leading bytes, anything unrecognised is taken as plain CSV
+func detectFormat(magic []byte) string {
+	switch {
+	case bytes.HasPrefix(magic, magicGzip):
+		return formatGzip
+	case bytes.HasPrefix(magic, magicZip):
+		return formatZip
+	case bytes.HasPrefix(magic, magicParquet):
+		return formatParquet
+	}
+	return formatCSV
+}
+
+// manifestFormat - returns the format of the CUR files given by the manifest compression and contentType fields, or
+// the file extensions of the report files, an empty string if the format of each file is detected from its content
+func manifestFormat(j map[string]interface{}, files []string) string {
+	compression, _ := j["compression"].(string)
+	contentType, _ := j["contentType"].(string)
+	switch {
+	case strings.EqualFold(compression, "parquet") || strings.Contains(strings.ToLower(contentType), "parquet"):
+		return formatParquet
+	case len(files) > 0 && strings.HasSuffix(strings.ToLower(files[0]), ".parquet"):
+		return formatParquet
+	case strings.EqualFold(compression, "gzip"):
+		return formatGzip
+	case strings.EqualFold(compression, "zip"):
+		return formatZip
+	}
+	return ""
+}
+
+// openCSV - returns a reader of the CSV content of a gzip, zip or plain CSV CUR file, and a func to release it.
+// ZIP archives cannot be read sequentially, so unless in is a local file the archive is first spooled to the temp directory
+func (c *CurConvert) openCSV(in io.Reader) (io.Reader, func(), error) {
+	br := bufio.NewReader(in)
+	magic, _ := br.Peek(4)
+
+	switch detectFormat(magic) {
+	case formatGzip:
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read gzip CUR file, error: %s", err.Error())
+		}
+		return gr, func() { gr.Close() }, nil
+
+	case formatZip:
+		return c.openZip(in, br)
+
+	case formatParquet:
+		return nil, nil, errors.New("CUR file is Parquet, but the manifest is not for a Parquet report")
+	}
+	return br, func() {}, nil
+}
+
+// openZip - opens the first CSV file within a zip archive. br must read the archive from the start
+func (c *CurConvert) openZip(in io.Reader, br io.Reader) (io.Reader, func(), error) {
+	cleanup := func() {}
+
+	file, ok := in.(*os.File)
+	if !ok {
+		tmp, err := ioutil.TempFile(c.tempDir, "curconvert-zip-")
+		if err != nil {
+			return nil, nil, err
+		}
+		cleanup = func() {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+		if _, err := io.Copy(tmp, br); err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("failed to spool zip CUR file, error: %s", err.Error())
+		}
+		file = tmp
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	zr, err := zip.NewReader(file, fi.Size())
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("failed to read zip CUR file, error: %s", err.Error())
+	}
+
+	for _, zf := range zr.File {
+		if strings.HasSuffix(zf.Name, "/") || (len(zr.File) > 1 && !strings.HasSuffix(strings.ToLower(zf.Name), ".csv")) {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		return rc, func() {
+			rc.Close()
+			cleanup()
+		}, nil
+	}
+
+	cleanup()
+	return nil, nil, errors.New("zip CUR file does not contain a CSV file")
+}
+
+// parquetInputOptions - returns the name of a set option that requires rows to be re-written, which is not supported
+// for Parquet CUR reports, or an empty string
+func (c *CurConvert) parquetInputOptions() string {
+	switch {
+	case len(c.partitions) > 0:
+		return "partitions"
+	case len(c.columnIncludes) > 0 || len(c.columnExcludes) > 0:
+		return "column filters"
+	case len(c.rowFilters) > 0:
+		return "row filters"
+	case c.tagMap:
+		return "resource tag map"
+	case len(c.redactions) > 0:
+		return "redaction"
+	case len(c.sourceReport) > 0:
+		return "report merging"
+	case c.schemaRegistry:
+		return "schema registry"
+	}
+	return ""
+}
+
+// parquetColumnType - maps the type of a parquet column to an Athena type
+func parquetColumnType(physical string, converted string) string {
+	switch converted {
+	case "UTF8", "ENUM", "JSON":
+		return "STRING"
+	case "TIMESTAMP_MILLIS", "TIMESTAMP_MICROS":
+		return "TIMESTAMP"
+	case "DATE":
+		return "DATE"
+	}
+	switch physical {
+	case "BOOLEAN":
+		return "BOOLEAN"
+	case "INT32":
+		return "INT"
+	case "INT64":
+		return "BIGINT"
+	case "INT96":
+		return "TIMESTAMP"
+	case "FLOAT":
+		return "FLOAT"
+	case "DOUBLE":
+		return "DOUBLE"
+	}
+	return "STRING"
+}
+
+// parseParquetSchema - sets the CUR fields from the schema of the first file of a Parquet CUR report. Columns are named
+// as for CSV reports (e.g. line_item_usage_start_date as lineitem/usagestartdate, see exportColumnName), but as the files
+// are copied unchanged their columns keep the original names and must be read by position, see GetCURColumnsByPosition
+func (c *CurConvert) parseParquetSchema(ctx context.Context) error {
+	if len(c.CurFiles) < 1 {
+		return errors.New("Parquet CUR report has no files")
+	}
+
+	localFile, err := c.downloadCur(ctx, c.CurFiles[0])
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localFile)
+
+	pf, err := ParquetFile.NewLocalFileReader(localFile)
+	if err != nil {
+		return err
+	}
+	defer pf.Close()
+
+	pr, err := ParquetReader.NewParquetColumnReader(pf, 1)
+	if err != nil {
+		return fmt.Errorf("failed to read Parquet CUR schema, object: %s, error: %s", c.CurFiles[0], err.Error())
+	}
+	defer pr.ReadStop()
+
+	c.fields = nil
+	c.mapFields = nil
+	c.columnIndex = make(map[string]int)
+
+	// elements are the depth-first flattened schema tree, top-level columns are the children of the root element
+	elements := pr.SchemaHandler.SchemaElements
+	for i := 1; i < len(elements); i = skipElement(elements, i) {
+		el := elements[i]
+		switch {
+		case el.Type != nil:
+			var converted string
+			if el.ConvertedType != nil {
+				converted = el.ConvertedType.String()
+			}
+			name := exportColumnName(el.GetName())
+			c.columnIndex[name] = i
+			c.fields = append(c.fields, curField{name: name, athenaType: parquetColumnType(el.Type.String(), converted), index: i})
+		case el.ConvertedType != nil && *el.ConvertedType == parquet.ConvertedType_MAP:
+			c.columnIndex[el.GetName()] = i
+			c.mapFields = append(c.mapFields, curField{name: el.GetName(), athenaType: mapType, index: i})
+		}
+	}
+	return nil
+}
+
+// skipElement - returns the index of the schema element following element i and all of its descendants
+func skipElement(elements []*parquet.SchemaElement, i int) int {
+	children := int(elements[i].GetNumChildren())
+	i++
+	for ; children > 0 && i < len(elements); children-- {
+		i = skipElement(elements, i)
+	}
+	return i
+}
+
+// copyCur - copies a Parquet CUR file to the dest path unchanged
+func (c *CurConvert) copyCur(ctx context.Context, curObject string) ([]*parquetOutput, error) {
+
+	source := c.getSourceStorage()
+	dest := c.getDestStorage()
+	destObject := c.outputKey("", c.parquetName(curObject))
+
+	// client-side encryption requires a seekable upload, so copy via the temp directory
+	if len(c.destKMSKey) > 0 {
+		localFile, err := c.downloadCur(ctx, curObject)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(localFile)
+		if err := c.uploadCur(ctx, localFile, destObject); err != nil {
+			return nil, err
+		}
+		c.addParquetFile(destObject)
+		return []*parquetOutput{{destKey: destObject}}, nil
+	}
+
+	body, err := source.Get(ctx, curObject)
+	if err != nil {
+		return nil, &SourceFileError{Bucket: source.String(), Key: curObject, Err: err}
+	}
+	defer body.Close()
+
+	if err := dest.Put(ctx, destObject, body); err != nil {
+		return nil, &UploadError{Bucket: dest.String(), Key: destObject, Err: err}
+	}
+
+	c.addParquetFile(destObject)
+	return []*parquetOutput{{destKey: destObject}}, nil
+}
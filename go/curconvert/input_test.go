@@ -0,0 +1,238 @@
+package curconvert
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// zipCSV - returns a zip archive holding the given files, as some CUR files are delivered
+func zipCSV(t *testing.T, files map[string]string) string {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		magic []byte
+		want  string
+	}{
+		{[]byte{0x1f, 0x8b, 0x08, 0x00}, formatGzip},
+		{[]byte("PK\x03\x04"), formatZip},
+		{[]byte("PAR1"), formatParquet},
+		{[]byte("iden"), formatCSV},
+		{[]byte("PK"), formatCSV},
+		{nil, formatCSV},
+	}
+	for _, tt := range tests {
+		if got := detectFormat(tt.magic); got != tt.want {
+			t.Errorf("detectFormat(%q) = %s, want %s", tt.magic, got, tt.want)
+		}
+	}
+}
+
+func TestManifestFormat(t *testing.T) {
+	tests := []struct {
+		manifest map[string]interface{}
+		files    []string
+		want     string
+	}{
+		{manifest: map[string]interface{}{"compression": "GZIP", "contentType": "text/csv"}, want: formatGzip},
+		{manifest: map[string]interface{}{"compression": "ZIP"}, want: formatZip},
+		{manifest: map[string]interface{}{"compression": "Parquet"}, want: formatParquet},
+		{manifest: map[string]interface{}{"contentType": "application/x-parquet"}, want: formatParquet},
+		{manifest: map[string]interface{}{}, files: []string{"export/data/part-0.snappy.parquet"}, want: formatParquet},
+		{manifest: map[string]interface{}{}, files: []string{"export/data/part-0.csv.gz"}, want: ""},
+		{manifest: map[string]interface{}{"contentType": "text/csv"}, want: ""},
+		{manifest: map[string]interface{}{}, want: ""},
+	}
+	for _, tt := range tests {
+		if got := manifestFormat(tt.manifest, tt.files); got != tt.want {
+			t.Errorf("manifestFormat(%v, %v) = %q, want %q", tt.manifest, tt.files, got, tt.want)
+		}
+	}
+}
+
+func TestOpenCSV(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	const csv = "identity/lineitemid,lineitem/usageamount\n1,2.5\n"
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "gzip", content: gzipCSV(t, csv)},
+		{name: "plain", content: csv},
+		{name: "zip", content: zipCSV(t, map[string]string{"cur-1.csv": csv})},
+		{name: "zip with other files", content: zipCSV(t, map[string]string{"README.txt": "readme", "cur-1.csv": csv})},
+		{name: "zip without csv", content: zipCSV(t, map[string]string{"README.txt": "readme", "notes.txt": "notes"}), wantErr: true},
+		{name: "parquet", content: "PAR1....PAR1", wantErr: true},
+	}
+	for _, tt := range tests {
+		c := NewCurConvert("", "", "", "")
+		c.tempDir = dir
+
+		r, release, err := c.openCSV(strings.NewReader(tt.content))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		b, err := ioutil.ReadAll(r)
+		release()
+		if err != nil || string(b) != csv {
+			t.Errorf("%s: read %q (%v), want the CSV content", tt.name, b, err)
+		}
+	}
+
+	// archives not read from a local file are spooled to the temp directory, and removed on release
+	if files, _ := ioutil.ReadDir(dir); len(files) > 0 {
+		t.Errorf("%d spooled files left in the temp directory", len(files))
+	}
+}
+
+func TestOpenCSVZipFile(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	// local archives are read in place
+	local := filepath.Join(dir, "cur-1.csv.zip")
+	if err := ioutil.WriteFile(local, []byte(zipCSV(t, map[string]string{"cur-1.csv": "a,b\n1,2\n"})), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	c := NewCurConvert("", "", "", "")
+	c.tempDir = filepath.Join(dir, "missing")
+	r, release, err := c.openCSV(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != "a,b\n1,2\n" {
+		t.Errorf("read %q (%v)", b, err)
+	}
+}
+
+func TestParquetColumnType(t *testing.T) {
+	tests := []struct {
+		physical  string
+		converted string
+		want      string
+	}{
+		{"BYTE_ARRAY", "UTF8", "STRING"},
+		{"BYTE_ARRAY", "", "STRING"},
+		{"INT64", "TIMESTAMP_MILLIS", "TIMESTAMP"},
+		{"INT64", "TIMESTAMP_MICROS", "TIMESTAMP"},
+		{"INT96", "", "TIMESTAMP"},
+		{"INT32", "DATE", "DATE"},
+		{"INT32", "", "INT"},
+		{"INT64", "", "BIGINT"},
+		{"DOUBLE", "", "DOUBLE"},
+		{"FLOAT", "", "FLOAT"},
+		{"BOOLEAN", "", "BOOLEAN"},
+	}
+	for _, tt := range tests {
+		if got := parquetColumnType(tt.physical, tt.converted); got != tt.want {
+			t.Errorf("parquetColumnType(%s, %s) = %s, want %s", tt.physical, tt.converted, got, tt.want)
+		}
+	}
+}
+
+func TestParquetInputOptions(t *testing.T) {
+	c := NewCurConvert("", "", "", "")
+	if got := c.parquetInputOptions(); got != "" {
+		t.Errorf("no options returned %q", got)
+	}
+	if err := c.SetPartitions([]string{"day"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.parquetInputOptions(); got != "partitions" {
+		t.Errorf("partitioned returned %q, want partitions", got)
+	}
+
+	c = NewCurConvert("", "", "", "")
+	c.SetResourceTagMap(true)
+	if got := c.parquetInputOptions(); got != "resource tag map" {
+		t.Errorf("tag map returned %q, want resource tag map", got)
+	}
+}
+
+func TestCopyCur(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	source := NewLocalStorage(dir + "/source")
+	dest := NewLocalStorage(dir + "/dest")
+	putObject(t, source, "cur/a1/cur-00001.snappy.parquet", "PAR1 parquet PAR1")
+
+	c := NewCurConvert("", "cur/cur-Manifest.json", "", "parquet/202610")
+	c.SetSourceStorage(source)
+	c.SetDestStorage(dest)
+	outputs, err := c.copyCur(context.Background(), "cur/a1/cur-00001.snappy.parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 1 {
+		t.Fatalf("%d outputs, want 1", len(outputs))
+	}
+
+	// Parquet CUR files are copied unchanged
+	if got, want := listKeys(t, dest, "parquet/"), []string{outputs[0].destKey}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dest holds %v, want %v", got, want)
+	}
+	r, err := dest.Get(context.Background(), outputs[0].destKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if b, _ := ioutil.ReadAll(r); string(b) != "PAR1 parquet PAR1" {
+		t.Errorf("copied %q", b)
+	}
+}
+
+func TestGetCURColumnsByPosition(t *testing.T) {
+	c := NewCurConvert("", "", "", "")
+	c.fields = []curField{{name: "lineitem/usageamount", athenaType: "DOUBLE", index: 1}, {name: "product/region", athenaType: "STRING", index: 3}}
+	c.mapFields = []curField{{name: "resource_tags", athenaType: mapType, index: 2}}
+
+	// converted CUR files write MAP columns last
+	want := []CurColumn{{"lineitem/usageamount", "DOUBLE"}, {"product/region", "STRING"}, {"resource_tags", mapType}}
+	if cols, err := c.GetCURColumns(); err != nil || c.GetCURColumnsByPosition() || !reflect.DeepEqual(cols, want) {
+		t.Errorf("converted columns %v (%v), by position %t", cols, err, c.GetCURColumnsByPosition())
+	}
+
+	// copied Parquet CUR files are read by position, so columns are in file order
+	c.inputFormat = formatParquet
+	want = []CurColumn{{"lineitem/usageamount", "DOUBLE"}, {"resource_tags", mapType}, {"product/region", "STRING"}}
+	if cols, err := c.GetCURColumns(); err != nil || !c.GetCURColumnsByPosition() || !reflect.DeepEqual(cols, want) {
+		t.Errorf("Parquet columns %v (%v), by position %t", cols, err, c.GetCURColumnsByPosition())
+	}
+}
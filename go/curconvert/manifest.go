@@ -0,0 +1,211 @@
+package curconvert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// manifestColumn - a column listed by a CUR manifest. key is the column name as given by the manifest, used as the
+// tag name of resource tag columns
+type manifestColumn struct {
+	name    string
+	key     string
+	colType string
+}
+
+// curManifest - columns, report files and the id of the manifest version
+type curManifest struct {
+	columns    []manifestColumn
+	files      []string
+	assemblyID string
+}
+
+// exportPrefixes - CUR 2.0 column name prefixes and the legacy CUR category they map to, longest first
+var exportPrefixes = []struct {
+	prefix   string
+	category string
+}{
+	{"split_line_item_", "splitlineitem"},
+	{"savings_plan_", "savingsplan"},
+	{"reservation_", "reservation"},
+	{"line_item_", "lineitem"},
+	{"identity_", "identity"},
+	{"discount_", "discount"},
+	{"pricing_", "pricing"},
+	{"product_", "product"},
+	{"bill_", "bill"},
+}
+
+//
+// ManifestKey - returns the key of a legacy CUR manifest for the month of t, i.e.
+// <reportPath>/YYYYMM01-YYYYMM01/<reportName>-Manifest.json
+func ManifestKey(reportPath string, reportName string, t time.Time) string {
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+	return reportPath + "/" + start.Format("20060102") + "-" + end.Format("20060102") + "/" + reportName + "-Manifest.json"
+}
+
+//
+// ExportManifestKey - returns the key of a CUR 2.0 Data Exports manifest for the month of t, i.e.
+// <exportPath>/<exportName>/metadata/BILLING_PERIOD=YYYY-MM/<exportName>-Manifest.json
+func ExportManifestKey(exportPath string, exportName string, t time.Time) string {
+	key := exportName + "/metadata/BILLING_PERIOD=" + t.Format("2006-01") + "/" + exportName + "-Manifest.json"
+	if len(exportPath) > 0 {
+		return exportPath + "/" + key
+	}
+	return key
+}
+
+//
+// ReportMonth - a billing period of a report with a manifest, Month is the first of the month in UTC
+type ReportMonth struct {
+	Month        time.Time
+	Manifest     string
+	LastModified time.Time
+}
+
+//
+// ListManifests - discovers the billing periods of a report that have a manifest in s, oldest first. Only the manifest
+// of each billing period folder is returned, not the copies AWS keeps for each assembly
+func ListManifests(ctx context.Context, s Storage, reportPath string, reportName string, dataExport bool) ([]ReportMonth, error) {
+	prefix := reportPath + "/"
+	period := regexp.MustCompile("^" + regexp.QuoteMeta(prefix) + `(\d{8})-\d{8}/` + regexp.QuoteMeta(reportName) + `-Manifest\.json$`)
+	layout := "20060102"
+	if dataExport {
+		prefix = reportName + "/metadata/"
+		if len(reportPath) > 0 {
+			prefix = reportPath + "/" + prefix
+		}
+		period = regexp.MustCompile("^" + regexp.QuoteMeta(prefix) + `BILLING_PERIOD=(\d{4}-\d{2})/` + regexp.QuoteMeta(reportName) + `-Manifest\.json$`)
+		layout = "2006-01"
+	}
+
+	objects, err := s.List(ctx, prefix)
+	if err != nil {
+		return nil, &ManifestError{Bucket: s.String(), Key: prefix, Err: fmt.Errorf("listing manifests: %s", err)}
+	}
+
+	var months []ReportMonth
+	for _, object := range objects {
+		m := period.FindStringSubmatch(object.Key)
+		if m == nil {
+			continue
+		}
+		month, err := time.Parse(layout, m[1])
+		if err != nil {
+			continue
+		}
+		months = append(months, ReportMonth{Month: month, Manifest: object.Key, LastModified: object.LastModified})
+	}
+	sort.Slice(months, func(i, j int) bool { return months[i].Month.Before(months[j].Month) })
+	return months, nil
+}
+
+// exportColumnName - maps a CUR 2.0 column name to the equivalent legacy CUR name, e.g. line_item_usage_start_date to
+// lineitem/usagestartdate, so converted CUR 2.0 reports can be queried as before. Unknown columns are left as is
+func exportColumnName(name string) string {
+	for _, p := range exportPrefixes {
+		if strings.HasPrefix(name, p.prefix) && len(name) > len(p.prefix) {
+			return p.category + "/" + strings.Replace(name[len(p.prefix):], "_", "", -1)
+		}
+	}
+	return name
+}
+
+// parseManifest - reads the columns and report files of either a legacy CUR or CUR 2.0 Data Exports manifest
+func parseManifest(j map[string]interface{}) (curManifest, error) {
+	if _, ok := j["dataFiles"]; ok {
+		return parseExportManifest(j)
+	}
+	return parseLegacyManifest(j)
+}
+
+// parseLegacyManifest - reads a legacy CUR manifest, with category/name columns and reportKeys
+func parseLegacyManifest(j map[string]interface{}) (curManifest, error) {
+	var m curManifest
+
+	cols, ok := j["columns"].([]interface{})
+	if !ok {
+		return m, errors.New("manifest has no columns")
+	}
+	for column := range cols {
+		t, ok := cols[column].(map[string]interface{})
+		if !ok {
+			return m, fmt.Errorf("invalid manifest column %d", column)
+		}
+		category, _ := t["category"].(string)
+		name, _ := t["name"].(string)
+		colType, _ := t["type"].(string)
+		if len(category) < 1 || len(name) < 1 {
+			return m, fmt.Errorf("manifest column %d has no category or name", column)
+		}
+		m.columns = append(m.columns, manifestColumn{name: category + "/" + name, key: name, colType: colType})
+	}
+
+	reportKeys, ok := j["reportKeys"].([]interface{})
+	if !ok {
+		return m, errors.New("manifest has no reportKeys")
+	}
+	for key := range reportKeys {
+		if k, ok := reportKeys[key].(string); ok {
+			m.files = append(m.files, k)
+		}
+	}
+
+	// assemblyId changes every time AWS re-publishes the CUR
+	m.assemblyID, _ = j["assemblyId"].(string)
+	return m, nil
+}
+
+// parseExportManifest - reads a CUR 2.0 Data Exports manifest, with name/type columns and dataFiles given as s3:// URLs
+func parseExportManifest(j map[string]interface{}) (curManifest, error) {
+	var m curManifest
+
+	cols, ok := j["schema"].([]interface{})
+	if !ok {
+		if cols, ok = j["columns"].([]interface{}); !ok {
+			return m, errors.New("manifest has no schema")
+		}
+	}
+	for column := range cols {
+		t, ok := cols[column].(map[string]interface{})
+		if !ok {
+			return m, fmt.Errorf("invalid manifest column %d", column)
+		}
+		name, _ := t["name"].(string)
+		colType, _ := t["type"].(string)
+		if len(name) < 1 {
+			return m, fmt.Errorf("manifest column %d has no name", column)
+		}
+		if !isMapType(colType) {
+			name = exportColumnName(name)
+		}
+		m.columns = append(m.columns, manifestColumn{name: name, key: name, colType: colType})
+	}
+
+	dataFiles, ok := j["dataFiles"].([]interface{})
+	if !ok {
+		return m, errors.New("manifest has no dataFiles")
+	}
+	for file := range dataFiles {
+		f, ok := dataFiles[file].(string)
+		if !ok {
+			continue
+		}
+		// files are listed as s3://bucket/key, keys are relative to the source bucket
+		if u, err := url.Parse(f); err == nil && len(u.Scheme) > 0 {
+			f = strings.TrimPrefix(u.Path, "/")
+		}
+		m.files = append(m.files, f)
+	}
+
+	// executionId changes every time the export is re-run
+	m.assemblyID, _ = j["executionId"].(string)
+	return m, nil
+}
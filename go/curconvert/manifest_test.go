@@ -0,0 +1,155 @@
+package curconvert
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestExportColumnName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"line_item_usage_start_date", "lineitem/usagestartdate"},
+		{"split_line_item_split_cost", "splitlineitem/splitcost"},
+		{"savings_plan_savings_plan_a_r_n", "savingsplan/savingsplanarn"},
+		{"bill_payer_account_id", "bill/payeraccountid"},
+		{"product_instance_type", "product/instancetype"},
+		{"line_item_", "line_item_"},
+		{"resource_tags", "resource_tags"},
+		{"cost_category", "cost_category"},
+	}
+	for _, tt := range tests {
+		if got := exportColumnName(tt.name); got != tt.want {
+			t.Errorf("exportColumnName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		want     curManifest
+		wantErr  bool
+	}{
+		{
+			name: "legacy",
+			manifest: `{"assemblyId": "a1", "columns": [
+				{"category": "lineItem", "name": "UsageAmount", "type": "OptionalBigDecimal"},
+				{"category": "resourceTags", "name": "user:Name"}],
+				"reportKeys": ["cur/20261001-20261101/a1/cur-1.csv.gz", 1]}`,
+			want: curManifest{
+				columns: []manifestColumn{
+					{name: "lineItem/UsageAmount", key: "UsageAmount", colType: "OptionalBigDecimal"},
+					{name: "resourceTags/user:Name", key: "user:Name"},
+				},
+				files:      []string{"cur/20261001-20261101/a1/cur-1.csv.gz"},
+				assemblyID: "a1",
+			},
+		},
+		{
+			name: "export",
+			manifest: `{"executionId": "e1", "schema": [
+				{"name": "line_item_usage_amount", "type": "double"},
+				{"name": "resource_tags", "type": "map<string,string>"}],
+				"dataFiles": ["s3://bucket/export/data/part-0.snappy.parquet", "export/data/part-1.snappy.parquet"]}`,
+			want: curManifest{
+				columns: []manifestColumn{
+					{name: "lineitem/usageamount", key: "lineitem/usageamount", colType: "double"},
+					{name: "resource_tags", key: "resource_tags", colType: "map<string,string>"},
+				},
+				files:      []string{"export/data/part-0.snappy.parquet", "export/data/part-1.snappy.parquet"},
+				assemblyID: "e1",
+			},
+		},
+		{
+			name: "export with columns",
+			manifest: `{"columns": [{"name": "bill_payer_account_id", "type": "string"}],
+				"dataFiles": ["s3://bucket/data/part-0.csv.gz"]}`,
+			want: curManifest{
+				columns: []manifestColumn{{name: "bill/payeraccountid", key: "bill/payeraccountid", colType: "string"}},
+				files:   []string{"data/part-0.csv.gz"},
+			},
+		},
+		{name: "legacy without columns", manifest: `{"reportKeys": []}`, wantErr: true},
+		{name: "legacy without reportKeys", manifest: `{"columns": [{"category": "a", "name": "b"}]}`, wantErr: true},
+		{name: "legacy column without name", manifest: `{"columns": [{"category": "a"}], "reportKeys": []}`, wantErr: true},
+		{name: "legacy invalid column", manifest: `{"columns": ["a"], "reportKeys": []}`, wantErr: true},
+		{name: "export without schema", manifest: `{"dataFiles": []}`, wantErr: true},
+		{name: "export column without name", manifest: `{"schema": [{"type": "string"}], "dataFiles": []}`, wantErr: true},
+		{name: "export invalid dataFiles", manifest: `{"schema": [], "dataFiles": "a"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		var j map[string]interface{}
+		if err := json.Unmarshal([]byte(tt.manifest), &j); err != nil {
+			t.Fatalf("%s: invalid test manifest: %s", tt.name, err)
+		}
+		got, err := parseManifest(j)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestListManifests(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	local := NewLocalStorage(dir)
+	for _, key := range []string{
+		"cur/20261001-20261101/hourly-Manifest.json",
+		"cur/20260901-20261001/hourly-Manifest.json",
+		"cur/20260901-20261001/0a1b2c/hourly-Manifest.json",
+		"cur/20260901-20261001/other-Manifest.json",
+		"export/hourly/metadata/BILLING_PERIOD=2026-10/hourly-Manifest.json",
+	} {
+		putObject(t, local, key, "{}")
+	}
+
+	tests := []struct {
+		name       string
+		reportPath string
+		dataExport bool
+		want       []string
+	}{
+		{
+			name:       "legacy",
+			reportPath: "cur",
+			want:       []string{"cur/20260901-20261001/hourly-Manifest.json", "cur/20261001-20261101/hourly-Manifest.json"},
+		},
+		{
+			name:       "data export",
+			reportPath: "export",
+			dataExport: true,
+			want:       []string{"export/hourly/metadata/BILLING_PERIOD=2026-10/hourly-Manifest.json"},
+		},
+		{name: "no manifests", reportPath: "missing"},
+	}
+	for _, tt := range tests {
+		months, err := ListManifests(context.Background(), local, tt.reportPath, "hourly", tt.dataExport)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, m := range months {
+			got = append(got, m.Manifest)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: manifests %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package curconvert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// sourceReportColumn - name of the column holding the name of the report a row was converted from, when merging
+const sourceReportColumn = "source_report"
+
+// sourceReportIndex - index of the source_report field, whose value is the report name rather than a CSV column
+const sourceReportIndex = -3
+
+// validSourceName - report names are used in parquet file names, so are restricted to characters that need no escaping
+var validSourceName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+//
+// ReportSource - a CUR report merged by MergeCur. Name is written to the source_report column, RoleArn and ExternalID
+// are optional and used to assume a role for reading the report
+type ReportSource struct {
+	Name       string
+	Bucket     string
+	Manifest   string
+	RoleArn    string
+	ExternalID string
+}
+
+//
+// MergeCur - converts several CUR reports, e.g. of different payer accounts, into a single dataset. Each report is
+// converted by its own CurConvert into the same dest path, with a source_report column added and file names prefixed
+// by the report name. The schema registry is always enabled so that every report shares one schema
+type MergeCur struct {
+	sources []*CurConvert
+}
+
+//
+// NewMergeCur - Init struct, configure is called for the CurConvert of each source to apply conversion options
+func NewMergeCur(sources []ReportSource, dBucket string, dObject string, configure func(c *CurConvert) error) (*MergeCur, error) {
+	if len(sources) < 1 {
+		return nil, errors.New("Must supply at least one report source")
+	}
+
+	m := new(MergeCur)
+	names := make(map[string]bool)
+	for _, src := range sources {
+		if !validSourceName.MatchString(src.Name) {
+			return nil, fmt.Errorf("Invalid report source name %s, names may only contain letters, digits, '_' and '-'", src.Name)
+		}
+		if names[src.Name] {
+			return nil, fmt.Errorf("Duplicate report source name %s", src.Name)
+		}
+		names[src.Name] = true
+
+		c := NewCurConvert(src.Bucket, src.Manifest, dBucket, dObject)
+		if len(src.RoleArn) > 0 {
+			if err := c.SetSourceRole(src.RoleArn, src.ExternalID); err != nil {
+				return nil, err
+			}
+		}
+		if configure != nil {
+			if err := configure(c); err != nil {
+				return nil, err
+			}
+		}
+		if c.versioned {
+			return nil, errors.New("Versioning cannot be used when merging reports")
+		}
+		c.sourceReport = src.Name
+		c.SetSchemaRegistry(true)
+		m.sources = append(m.sources, c)
+	}
+	return m, nil
+}
+
+//
+// Converters - returns the CurConvert of each source, in the order the sources were given
+func (m *MergeCur) Converters() []*CurConvert {
+	return m.sources
+}
+
+//
+// SetDestPath - configures the dest path of every source
+func (m *MergeCur) SetDestPath(path string) error {
+	for _, c := range m.sources {
+		if err := c.SetDestPath(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// CheckCURExists - checks the manifest of every source exists, returning the first error
+func (m *MergeCur) CheckCURExists() error {
+	for _, c := range m.sources {
+		if err := c.CheckCURExists(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// ConvertCur - converts every source, see ConvertCurContext
+func (m *MergeCur) ConvertCur() error {
+	return m.ConvertCurContext(aws.BackgroundContext())
+}
+
+//
+// ConvertCurContext - converts each source in turn. The manifests of all sources are first merged into the schema
+// registry, so that every source is written with the union of their columns. Sources that partially fail are
+// returned together as a PartialError once all sources are converted, any other error stops the merge
+func (m *MergeCur) ConvertCurContext(ctx context.Context) error {
+	for _, c := range m.sources {
+		if err := c.parseCur(ctx); err != nil {
+			return err
+		}
+		if err := c.saveSchema(ctx); err != nil {
+			return err
+		}
+	}
+
+	partial := &PartialError{}
+	for _, c := range m.sources {
+		err := c.ConvertCurContext(ctx)
+		if p, ok := err.(*PartialError); ok {
+			partial.Failed += p.Failed
+			partial.Total += p.Total
+			partial.Errs = append(partial.Errs, p.Errs...)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		partial.Total += len(c.CurFiles)
+	}
+	if partial.Failed > 0 {
+		return partial
+	}
+	return nil
+}
+
+//
+// CollectVersions - collects superseded versions of every source, see CurConvert.CollectVersions. Versioning can not
+// be used when merging, so this only removes versions left by conversions made before the reports were merged
+func (m *MergeCur) CollectVersions(ctx context.Context) error {
+	for _, c := range m.sources {
+		if err := c.CollectVersions(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// Plan - plans the conversion of every source, see PlanContext
+func (m *MergeCur) Plan() (ConvertPlan, error) {
+	return m.PlanContext(aws.BackgroundContext())
+}
+
+//
+// PlanContext - plans the conversion of every source, see CurConvert.Plan. Sources are converted in turn, so the plan
+// needs the most temp disk and memory of any source, at the lowest concurrency planned for a source
+func (m *MergeCur) PlanContext(ctx context.Context) (ConvertPlan, error) {
+	var plan ConvertPlan
+	for i, c := range m.sources {
+		p, err := c.PlanContext(ctx)
+		if err != nil {
+			return plan, err
+		}
+		if i == 0 {
+			plan = p
+			continue
+		}
+		plan.Files = append(plan.Files, p.Files...)
+		plan.TotalSize += p.TotalSize
+		if p.TempBytes > plan.TempBytes {
+			plan.TempBytes = p.TempBytes
+		}
+		if p.MemoryBytes > plan.MemoryBytes {
+			plan.MemoryBytes = p.MemoryBytes
+		}
+		if p.Concurrency < plan.Concurrency {
+			plan.Concurrency = p.Concurrency
+		}
+	}
+	return plan, nil
+}
+
+//
+// GetCURColumns - returns the merged columns, which every source shares
+func (m *MergeCur) GetCURColumns() ([]CurColumn, error) {
+	return m.sources[0].GetCURColumns()
+}
+
+//
+// GetCURPartitions - returns the partition columns, see CurConvert.GetCURPartitions
+func (m *MergeCur) GetCURPartitions() []CurColumn {
+	return m.sources[0].GetCURPartitions()
+}
+
+//
+// GetCURPartitionPaths - returns the partition folders of every source, sorted, see CurConvert.GetCURPartitionPaths
+func (m *MergeCur) GetCURPartitionPaths() []string {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, c := range m.sources {
+		for _, p := range c.GetCURPartitionPaths() {
+			if !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+//
+// GetCURColumnsByPosition - always false, Parquet CUR reports can not be merged as they are copied unchanged
+func (m *MergeCur) GetCURColumnsByPosition() bool {
+	return false
+}
+
+//
+// GetCURLocation - returns the dest path key prefix holding the merged CUR
+func (m *MergeCur) GetCURLocation() string {
+	return m.sources[0].GetCURLocation()
+}
+
+//
+// GetCleanObjects - returns the keys deleted by the last clean of every source, see CurConvert.GetCleanObjects
+func (m *MergeCur) GetCleanObjects() []string {
+	var objects []string
+	for _, c := range m.sources {
+		objects = append(objects, c.GetCleanObjects()...)
+	}
+	return objects
+}
+
+//
+// GetConvertStats - returns the stats of every source combined, see CurConvert.GetConvertStats
+func (m *MergeCur) GetConvertStats() ConvertStats {
+	var stats ConvertStats
+	for _, c := range m.sources {
+		s := c.GetConvertStats()
+		stats.Files += s.Files
+		stats.Rows += s.Rows
+	}
+	return stats
+}
+
+//
+// Verify - returns the verification reports of every source combined, see CurConvert.Verify
+func (m *MergeCur) Verify() (VerifyReport, error) {
+	var report VerifyReport
+	var verifyErr error
+	for _, c := range m.sources {
+		r, err := c.Verify()
+		if err != nil && verifyErr == nil {
+			verifyErr = err
+		}
+		report.Files = append(report.Files, r.Files...)
+		report.Source.add(r.Source)
+		report.Parquet.add(r.Parquet)
+		report.Filtered.add(r.Filtered)
+	}
+	return report, verifyErr
+}
+
+// parquetName - returns the parquet file name of a CUR object, prefixed by the report name when merging so that
+// reports with the same file names do not collide
+func (c *CurConvert) parquetName(curObject string) string {
+	if len(c.sourceReport) > 0 {
+		return c.sourceReport + "." + parquetFileName(curObject)
+	}
+	return parquetFileName(curObject)
+}
+
+// ownsOutput - returns true if key is parquet output of this conversion's report, always true unless merging
+func (c *CurConvert) ownsOutput(key string) bool {
+	if len(c.sourceReport) < 1 {
+		return true
+	}
+	return strings.HasPrefix(key[strings.LastIndex(key, "/")+1:], c.sourceReport+".")
+}
+
+// stateKey - returns the key of the conversion state, each report has its own state when merging
+func (c *CurConvert) stateKey() string {
+	if len(c.sourceReport) > 0 {
+		return c.destObject + "/" + strings.TrimSuffix(stateFileName, ".json") + "." + c.sourceReport + ".json"
+	}
+	return c.destObject + "/" + stateFileName
+}
@@ -0,0 +1,117 @@
+package curconvert
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewMergeCur(t *testing.T) {
+	tests := []struct {
+		name      string
+		sources   []ReportSource
+		configure func(c *CurConvert) error
+		wantErr   bool
+	}{
+		{
+			name:    "two sources",
+			sources: []ReportSource{{Name: "payer-a", Bucket: "a"}, {Name: "payer_b", Bucket: "b"}},
+		},
+		{name: "no sources", wantErr: true},
+		{
+			name:    "invalid name",
+			sources: []ReportSource{{Name: "payer/a", Bucket: "a"}},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate name",
+			sources: []ReportSource{{Name: "payer", Bucket: "a"}, {Name: "payer", Bucket: "b"}},
+			wantErr: true,
+		},
+		{
+			name:      "versioned",
+			sources:   []ReportSource{{Name: "payer", Bucket: "a"}},
+			configure: func(c *CurConvert) error { return c.SetVersioning(true, time.Hour) },
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		m, err := NewMergeCur(tt.sources, "dest", "parquet/202610", tt.configure)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		for i, c := range m.Converters() {
+			if c.sourceReport != tt.sources[i].Name || !c.schemaRegistry {
+				t.Errorf("%s: source %d is %q, registry %t", tt.name, i, c.sourceReport, c.schemaRegistry)
+			}
+		}
+	}
+}
+
+func TestMergeNames(t *testing.T) {
+	c := NewCurConvert("", "", "", "parquet/202610")
+	if got := c.parquetName("cur/cur-1.csv.gz"); got != "cur-1.parquet" {
+		t.Errorf("parquetName = %q", got)
+	}
+	if got := c.stateKey(); got != "parquet/202610/"+stateFileName {
+		t.Errorf("stateKey = %q", got)
+	}
+	if !c.ownsOutput("parquet/202610/cur-1.parquet") {
+		t.Error("a conversion that is not merged owns every output")
+	}
+
+	// each report prefixes its files, so reports only clean their own output
+	c.sourceReport = "payer-a"
+	if got := c.parquetName("cur/cur-1.csv.gz"); got != "payer-a.cur-1.parquet" {
+		t.Errorf("merged parquetName = %q", got)
+	}
+	if got := c.stateKey(); got != "parquet/202610/_curconvert_state.payer-a.json" {
+		t.Errorf("merged stateKey = %q", got)
+	}
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{key: "parquet/202610/payer-a.cur-1.parquet", want: true},
+		{key: "parquet/202610/account=1/payer-a.cur-1.parquet", want: true},
+		{key: "parquet/202610/payer-b.cur-1.parquet", want: false},
+		{key: "parquet/202610/payer-a/cur-1.parquet", want: false},
+	}
+	for _, tt := range tests {
+		if got := c.ownsOutput(tt.key); got != tt.want {
+			t.Errorf("ownsOutput(%q) = %t, want %t", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestMergeVerify(t *testing.T) {
+	m, err := NewMergeCur([]ReportSource{{Name: "a", Bucket: "a"}, {Name: "b", Bucket: "b"}}, "dest", "parquet/202610", func(c *CurConvert) error {
+		return c.SetVerify(VerifyWarn)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range m.Converters() {
+		c.resetVerify()
+		c.setVerification(FileVerification{
+			Key:      c.sourceReport + ".csv.gz",
+			Source:   VerifyTotals{Rows: 3},
+			Parquet:  VerifyTotals{Rows: int64(2 - i)},
+			Filtered: VerifyTotals{Rows: 1},
+		})
+	}
+
+	report, err := m.Verify()
+	if err == nil {
+		t.Error("expected the mismatch of source b to fail")
+	}
+	if len(report.Files) != 2 || report.Source.Rows != 6 || report.Parquet.Rows != 3 || report.Filtered.Rows != 2 {
+		t.Errorf("report %+v", report)
+	}
+}
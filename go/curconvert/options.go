@@ -0,0 +1,151 @@
+package curconvert
+
+import "time"
+
+// ConvertOptions - the conversion options of a CurConvert, applied together by SetOptions so that front ends such as
+// curcli and analyzeCUR configure conversions the same way. Start from DefaultOptions, the zero value is not valid
+type ConvertOptions struct {
+	S3               S3Options
+	TmpDir           string
+	FileConcurrency  int
+	Preflight        PreflightMode
+	MemoryLimit      int64
+	DownloadPartSize int64
+	DownloadWorkers  int
+	ResumeDownloads  bool
+	SSE              SSEOptions
+	DecryptSource    bool
+	Streaming        bool
+	Force            bool
+	ColumnTypeFile   string
+	SampleRows       int
+	StringDates      bool
+	Partitions       []string
+	Compression      string
+	RowGroupSize     int64
+	PageSize         int64
+	Dictionary       bool
+	IncludeColumns   []string
+	ExcludeColumns   []string
+	RowFilters       []string
+	ResourceTagMap   bool
+	RedactionFile    string
+	RedactionKey     []byte
+	SchemaRegistry   bool
+	Retries          int
+	RetryDelay       time.Duration
+	RetryMaxDelay    time.Duration
+	FailurePolicy    FailurePolicy
+	FailureThreshold float64
+	Verify           VerifyMode
+	CleanDryRun      bool
+	Versioned        bool
+	Retention        time.Duration
+}
+
+// DefaultOptions - returns the options a CurConvert has when created by NewCurConvert
+func DefaultOptions() ConvertOptions {
+	return ConvertOptions{
+		TmpDir:           defaultTempDir,
+		FileConcurrency:  defaultFileConcurrency,
+		DownloadPartSize: defaultDownloadPartSize,
+		DownloadWorkers:  defaultDownloadConcurrency,
+		ResumeDownloads:  true,
+		Compression:      "SNAPPY",
+		RowGroupSize:     defaultRowGroupSize,
+		PageSize:         defaultPageSize,
+		Dictionary:       true,
+		Retries:          defaultRetryAttempts,
+		RetryDelay:       defaultRetryDelay,
+		RetryMaxDelay:    defaultRetryMaxDelay,
+		FailurePolicy:    FailFast,
+		Verify:           VerifyOff,
+		Retention:        defaultRetention,
+	}
+}
+
+// SetOptions - applies every option of opts, returning the error of the first invalid option
+func (c *CurConvert) SetOptions(opts ConvertOptions) error {
+	if err := c.SetS3Options(opts.S3); err != nil {
+		return err
+	}
+	if err := c.SetTmpLocation(opts.TmpDir); err != nil {
+		return err
+	}
+	if err := c.SetFileConcurrency(opts.FileConcurrency); err != nil {
+		return err
+	}
+	if err := c.SetPreflight(opts.Preflight, opts.MemoryLimit); err != nil {
+		return err
+	}
+	if err := c.SetDownloadOptions(opts.DownloadPartSize, opts.DownloadWorkers, opts.ResumeDownloads); err != nil {
+		return err
+	}
+	if err := c.SetDestSSE(opts.SSE); err != nil {
+		return err
+	}
+	c.SetSourceDecryption(opts.DecryptSource)
+	c.SetStreaming(opts.Streaming)
+	c.SetForce(opts.Force)
+
+	// column types
+	if len(opts.ColumnTypeFile) > 0 {
+		if err := c.SetColumnTypeFile(opts.ColumnTypeFile); err != nil {
+			return err
+		}
+	}
+	if err := c.SetTypeSampling(opts.SampleRows); err != nil {
+		return err
+	}
+	c.SetStringDates(opts.StringDates)
+
+	// parquet output
+	if err := c.SetPartitions(opts.Partitions); err != nil {
+		return err
+	}
+	if err := c.SetCompression(opts.Compression); err != nil {
+		return err
+	}
+	if err := c.SetRowGroupSize(opts.RowGroupSize); err != nil {
+		return err
+	}
+	if err := c.SetPageSize(opts.PageSize); err != nil {
+		return err
+	}
+	c.SetDictionary(opts.Dictionary)
+
+	// columns and rows converted
+	if err := c.SetColumnFilter(opts.IncludeColumns, opts.ExcludeColumns); err != nil {
+		return err
+	}
+	for _, filter := range opts.RowFilters {
+		if err := c.AddRowFilter(filter); err != nil {
+			return err
+		}
+	}
+	c.SetResourceTagMap(opts.ResourceTagMap)
+	if len(opts.RedactionFile) > 0 {
+		if err := c.SetRedactionFile(opts.RedactionFile); err != nil {
+			return err
+		}
+	}
+	if len(opts.RedactionKey) > 0 {
+		if err := c.SetRedactionKey(opts.RedactionKey); err != nil {
+			return err
+		}
+	}
+	c.SetSchemaRegistry(opts.SchemaRegistry)
+
+	// failure handling, verification and publishing
+	if err := c.SetRetry(opts.Retries, opts.RetryDelay, opts.RetryMaxDelay); err != nil {
+		return err
+	}
+	if err := c.SetFailurePolicy(opts.FailurePolicy, opts.FailureThreshold); err != nil {
+		return err
+	}
+	if err := c.SetVerify(opts.Verify); err != nil {
+		return err
+	}
+	c.SetCleanDryRun(opts.CleanDryRun)
+	return c.SetVersioning(opts.Versioned, opts.Retention)
+}
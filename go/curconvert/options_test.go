@@ -0,0 +1,44 @@
+package curconvert
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetOptions(t *testing.T) {
+	// the defaults leave a new CurConvert unchanged
+	c, want := NewCurConvert("", "", "", ""), NewCurConvert("", "", "", "")
+	if err := c.SetOptions(DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if c.compression != want.compression || c.rowGroupSize != want.rowGroupSize || c.pageSize != want.pageSize ||
+		c.plainEncoding != want.plainEncoding || c.retryAttempts != want.retryAttempts || c.retryDelay != want.retryDelay ||
+		c.retryMaxDelay != want.retryMaxDelay || c.retention != want.retention || c.failurePolicy != want.failurePolicy {
+		t.Errorf("default options changed the CurConvert defaults")
+	}
+
+	tests := []struct {
+		name    string
+		set     func(o *ConvertOptions)
+		wantErr bool
+	}{
+		{name: "partitions", set: func(o *ConvertOptions) { o.Partitions = []string{"day", "account"} }},
+		{name: "versioned", set: func(o *ConvertOptions) { o.Versioned, o.Retention = true, time.Hour }},
+		{name: "invalid partition", set: func(o *ConvertOptions) { o.Partitions = []string{"region"} }, wantErr: true},
+		{name: "invalid compression", set: func(o *ConvertOptions) { o.Compression = "LZ4" }, wantErr: true},
+		{name: "no retries", set: func(o *ConvertOptions) { o.Retries = 0 }, wantErr: true},
+		{name: "invalid filter", set: func(o *ConvertOptions) { o.RowFilters = []string{"lineitem/lineitemtype"} }, wantErr: true},
+		{name: "invalid threshold", set: func(o *ConvertOptions) { o.FailurePolicy, o.FailureThreshold = Threshold, 101 }, wantErr: true},
+		{name: "invalid file concurrency", set: func(o *ConvertOptions) { o.FileConcurrency = 0 }, wantErr: true},
+		{name: "invalid memory limit", set: func(o *ConvertOptions) { o.Preflight, o.MemoryLimit = PreflightAbort, -1 }, wantErr: true},
+		{name: "kms key without sse-kms", set: func(o *ConvertOptions) { o.SSE = SSEOptions{Mode: SSES3, KMSKeyID: "alias/cur"} }, wantErr: true},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		tt.set(&opts)
+		err := NewCurConvert("", "", "", "").SetOptions(opts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %t", tt.name, err, tt.wantErr)
+		}
+	}
+}
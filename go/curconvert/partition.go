@@ -0,0 +1,128 @@
+package curconvert
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// partitionColumns - supported partition keys and the CUR column the partition value is taken from
+var partitionColumns = map[string]string{
+	"day":     "lineitem/usagestartdate",
+	"account": "lineitem/usageaccountid",
+	"product": "lineitem/productcode",
+}
+
+// hiveDefaultPartition - partition value used by Hive (and hence Athena) for empty values
+const hiveDefaultPartition = "__HIVE_DEFAULT_PARTITION__"
+
+//
+// SetPartitions - partitions the parquet output into Hive-style folders, e.g. day=2026-10-01/account=123/.
+// Supported keys are day, account and product, folders are nested in the order given
+func (c *CurConvert) SetPartitions(keys []string) error {
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if _, ok := partitionColumns[key]; !ok {
+			return fmt.Errorf("Unsupported partition key %s, must be one of day, account or product", key)
+		}
+		if seen[key] {
+			return fmt.Errorf("Partition key %s given more than once", key)
+		}
+		seen[key] = true
+	}
+	c.partitions = keys
+	return nil
+}
+
+//
+// GetCURPartitions - returns the partition keys of the converted CUR as STRING columns, in folder order
+func (c *CurConvert) GetCURPartitions() []CurColumn {
+	cols := []CurColumn{}
+	for _, key := range c.partitions {
+		cols = append(cols, CurColumn{Name: key, Type: "STRING"})
+	}
+	return cols
+}
+
+//
+// GetCURPartitionPaths - returns the partition folders of the converted CUR relative to GetCURLocation, e.g.
+// day=2026-10-01/account=123, sorted. Empty if output is not partitioned
+func (c *CurConvert) GetCURPartitionPaths() []string {
+	prefix := c.outputPrefix() + "/"
+	seen := make(map[string]bool)
+	var paths []string
+	c.filesLock.Lock()
+	for key := range c.CurParqetFiles {
+		rel := strings.TrimPrefix(key, prefix)
+		if i := strings.LastIndex(rel, "/"); i > 0 && !seen[rel[:i]] {
+			seen[rel[:i]] = true
+			paths = append(paths, rel[:i])
+		}
+	}
+	c.filesLock.Unlock()
+	sort.Strings(paths)
+	return paths
+}
+
+// partitionIndexes - returns the CSV index of the column each partition key is taken from, -1 if not in this CUR
+func (c *CurConvert) partitionIndexes() []int {
+	indexes := make([]int, len(c.partitions))
+	for i, key := range c.partitions {
+		indexes[i] = -1
+		if index, ok := c.columnIndex[partitionColumns[key]]; ok {
+			indexes[i] = index
+		}
+	}
+	return indexes
+}
+
+// partitionPath - returns the partition folder path for a CSV record, e.g. day=2026-10-01/account=123
+func (c *CurConvert) partitionPath(rec []string, indexes []int) string {
+	if len(c.partitions) < 1 {
+		return ""
+	}
+
+	parts := make([]string, len(c.partitions))
+	for i, key := range c.partitions {
+		var v string
+		if indexes[i] >= 0 && indexes[i] < len(rec) {
+			v = rec[indexes[i]]
+		}
+		if key == "day" && len(v) >= 10 {
+			v = v[:10]
+		}
+		parts[i] = key + "=" + partitionValue(v)
+	}
+	return strings.Join(parts, "/")
+}
+
+// partitionValue - restricts a partition value to characters that are safe in object keys and Athena partitions
+func partitionValue(v string) string {
+	if len(v) < 1 {
+		return hiveDefaultPartition
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, v)
+}
+
+// outputKey - returns the dest object key of the parquet file name within partition
+func (c *CurConvert) outputKey(partition string, name string) string {
+	if len(partition) < 1 {
+		return c.outputPrefix() + "/" + name
+	}
+	return c.outputPrefix() + "/" + partition + "/" + name
+}
+
+// outputFile - returns the local temp file for the parquet file name within partition
+func (c *CurConvert) outputFile(partition string, name string) string {
+	if len(partition) < 1 {
+		return c.tempDir + "/" + name
+	}
+	return c.tempDir + "/" + strings.NewReplacer("/", "_", "=", "-").Replace(partition) + "_" + name
+}
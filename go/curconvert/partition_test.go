@@ -0,0 +1,65 @@
+package curconvert
+
+import "testing"
+
+func TestPartitionPath(t *testing.T) {
+	columnIndex := map[string]int{"lineitem/usagestartdate": 0, "lineitem/usageaccountid": 1}
+	tests := []struct {
+		name       string
+		partitions []string
+		rec        []string
+		want       string
+	}{
+		{name: "not partitioned", rec: []string{"2026-10-01T00:00:00Z", "123"}, want: ""},
+		{name: "day", partitions: []string{"day"}, rec: []string{"2026-10-01T00:00:00Z", "123"}, want: "day=2026-10-01"},
+		{
+			name:       "day and account",
+			partitions: []string{"day", "account"},
+			rec:        []string{"2026-10-01T00:00:00Z", "123"},
+			want:       "day=2026-10-01/account=123",
+		},
+		{
+			name:       "account and day",
+			partitions: []string{"account", "day"},
+			rec:        []string{"2026-10-01T00:00:00Z", "123"},
+			want:       "account=123/day=2026-10-01",
+		},
+		{name: "short day", partitions: []string{"day"}, rec: []string{"2026-10", "123"}, want: "day=2026-10"},
+		{name: "empty value", partitions: []string{"account"}, rec: []string{"2026-10-01", ""}, want: "account=" + hiveDefaultPartition},
+		{name: "short record", partitions: []string{"account"}, rec: []string{"2026-10-01"}, want: "account=" + hiveDefaultPartition},
+		{name: "missing column", partitions: []string{"product"}, rec: []string{"2026-10-01", "123"}, want: "product=" + hiveDefaultPartition},
+		{name: "unsafe value", partitions: []string{"account"}, rec: []string{"2026-10-01", "a/b=c d"}, want: "account=a_b_c_d"},
+	}
+	for _, tt := range tests {
+		c := NewCurConvert("", "", "", "")
+		c.columnIndex = columnIndex
+		if err := c.SetPartitions(tt.partitions); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if got := c.partitionPath(tt.rec, c.partitionIndexes()); got != tt.want {
+			t.Errorf("%s: partitionPath(%v) = %q, want %q", tt.name, tt.rec, got, tt.want)
+		}
+	}
+}
+
+func TestSetPartitions(t *testing.T) {
+	c := NewCurConvert("", "", "parquet", "parquet/202610")
+	if err := c.SetPartitions([]string{"region"}); err == nil {
+		t.Error("expected an unsupported partition key to fail")
+	}
+	if err := c.SetPartitions([]string{"day", "day"}); err == nil {
+		t.Error("expected a repeated partition key to fail")
+	}
+	if err := c.SetPartitions([]string{"day", "account"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.GetCURPartitions(); len(got) != 2 || got[0].Name != "day" || got[1].Name != "account" || got[1].Type != "STRING" {
+		t.Errorf("GetCURPartitions = %v", got)
+	}
+	if got := c.outputKey("day=2026-10-01/account=123", "cur-1.parquet"); got != "parquet/202610/day=2026-10-01/account=123/cur-1.parquet" {
+		t.Errorf("outputKey = %s", got)
+	}
+	if got := c.outputKey("", "cur-1.parquet"); got != "parquet/202610/cur-1.parquet" {
+		t.Errorf("outputKey without a partition = %s", got)
+	}
+}
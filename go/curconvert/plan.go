@@ -0,0 +1,320 @@
+package curconvert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// estimates used to plan a conversion, CUR gzip CSV compresses about as well as snappy parquet, plain CSV 4x less
+const (
+	gzipParquetRatio  = 1.0
+	plainParquetRatio = 0.25
+	rowGroupMemRatio  = 2
+	tempHeadroom      = 0.9
+	uploadBufferSize  = 25 * 1024 * 1024
+)
+
+// partitionCounts - the most partitions of each key a CUR file can have, keys without a limit are not listed
+var partitionCounts = map[string]int64{"day": 31}
+
+// unlimitedPartitions - partitions of a CUR file assumed for upload buffers when a partition key has no limit
+const unlimitedPartitions = 50
+
+//
+// PreflightMode - whether ConvertCur checks the resources it needs before converting, and what it does when the temp
+// directory or memory limit is too small
+type PreflightMode int
+
+const (
+	// PreflightOff - resources are not checked, the default
+	PreflightOff PreflightMode = iota
+	// PreflightReduce - file concurrency is reduced until the plan fits, failing if one file at a time does not
+	PreflightReduce
+	// PreflightAbort - the conversion fails if the plan does not fit with the configured file concurrency
+	PreflightAbort
+)
+
+// preflightModes - names accepted by ParsePreflightMode
+var preflightModes = map[string]PreflightMode{
+	"off":    PreflightOff,
+	"reduce": PreflightReduce,
+	"abort":  PreflightAbort,
+}
+
+//
+// ParsePreflightMode - returns the PreflightMode named off, reduce or abort
+func ParsePreflightMode(name string) (PreflightMode, error) {
+	if mode, ok := preflightModes[strings.ToLower(strings.TrimSpace(name))]; ok {
+		return mode, nil
+	}
+	return PreflightOff, fmt.Errorf("Unknown preflight mode %s, must be one of off, reduce or abort", name)
+}
+
+//
+// PlannedFile - a CUR file of a ConvertPlan, with the temp disk and memory estimated to convert it. Output is the dest
+// key of the parquet file, with partition values as '*' when partitioned. Skip is true for files unchanged since the
+// previous conversion
+type PlannedFile struct {
+	Key    string
+	Size   int64
+	Temp   int64
+	Memory int64
+	Output string
+	Skip   bool
+}
+
+//
+// ConvertPlan - the estimated resources of converting a CUR month. TempBytes and MemoryBytes are the peak needed when
+// the largest files are converted together by Concurrency workers. TempFree is the free space of TempDir, or -1 if it
+// could not be read
+type ConvertPlan struct {
+	Files           []PlannedFile
+	TotalSize       int64
+	FileConcurrency int
+	Concurrency     int
+	TempDir         string
+	TempBytes       int64
+	TempFree        int64
+	MemoryBytes     int64
+	MemoryLimit     int64
+	OutputPrefix    string
+	Partitions      []string
+}
+
+// Fits - returns true if the plan needs no more temp disk or memory than is available
+func (p ConvertPlan) Fits() bool {
+	return (p.TempFree < 0 || p.TempBytes <= int64(float64(p.TempFree)*tempHeadroom)) &&
+		(p.MemoryLimit < 1 || p.MemoryBytes <= p.MemoryLimit)
+}
+
+//
+// PlanError - the resources a conversion needs are not available, Plan holds the estimate for reporting
+type PlanError struct {
+	Plan ConvertPlan
+}
+
+func (e *PlanError) Error() string {
+	p := e.Plan
+	if p.TempFree >= 0 && p.TempBytes > int64(float64(p.TempFree)*tempHeadroom) {
+		return fmt.Sprintf("insufficient temp space, dir: %s, needed: %s, free: %s, file concurrency: %d",
+			p.TempDir, FormatBytes(p.TempBytes), FormatBytes(p.TempFree), p.Concurrency)
+	}
+	return fmt.Sprintf("insufficient memory, needed: %s, limit: %s, file concurrency: %d",
+		FormatBytes(p.MemoryBytes), FormatBytes(p.MemoryLimit), p.Concurrency)
+}
+
+//
+// SetPreflight - sets whether ConvertCur plans the conversion before starting it, see Plan. memoryLimit is the bytes
+// of memory the conversion may use, 0 for no limit
+func (c *CurConvert) SetPreflight(mode PreflightMode, memoryLimit int64) error {
+	if memoryLimit < 0 {
+		return errors.New("Memory limit must be zero or more")
+	}
+	c.preflight = mode
+	c.memoryLimit = memoryLimit
+	return nil
+}
+
+//
+// Plan - parses the manifest and HEADs every CUR file to estimate the temp disk and memory of converting them, without
+// converting anything. Concurrency is reduced from fileConcurrency until the plan fits, see ConvertPlan.Fits
+func (c *CurConvert) Plan() (ConvertPlan, error) {
+	return c.PlanContext(aws.BackgroundContext())
+}
+
+//
+// PlanContext - Plan, stopping early when ctx is cancelled
+func (c *CurConvert) PlanContext(ctx context.Context) (ConvertPlan, error) {
+	if err := c.parseCur(ctx); err != nil {
+		return ConvertPlan{}, err
+	}
+	if err := c.retry(ctx, func() error { return c.loadState(ctx) }); err != nil {
+		return ConvertPlan{}, err
+	}
+	return c.plan(ctx)
+}
+
+// plan - estimates the conversion of the parsed manifest, reducing concurrency until it fits
+func (c *CurConvert) plan(ctx context.Context) (ConvertPlan, error) {
+	p := ConvertPlan{
+		FileConcurrency: c.fileConcurrency,
+		TempDir:         c.tempDir,
+		MemoryLimit:     c.memoryLimit,
+		OutputPrefix:    c.outputPrefix(),
+		Partitions:      c.partitions,
+	}
+
+	var outputPartition []string
+	for _, key := range c.partitions {
+		outputPartition = append(outputPartition, key+"=*")
+	}
+
+	source := c.getSourceStorage()
+	for _, object := range c.CurFiles {
+		var info ObjectInfo
+		err := c.retry(ctx, func() error {
+			var err error
+			info, err = source.Stat(ctx, object)
+			return err
+		})
+		if err != nil {
+			return p, &SourceFileError{Bucket: source.String(), Key: object, Err: err}
+		}
+
+		f := PlannedFile{
+			Key:    object,
+			Size:   info.Size,
+			Output: c.outputKey(strings.Join(outputPartition, "/"), c.parquetName(object)),
+		}
+		if _, ok := c.unchanged(ctx, object, info.ETag); ok {
+			f.Skip = true
+		} else {
+			f.Temp, f.Memory = c.estimateFile(object, info.Size)
+		}
+		p.Files = append(p.Files, f)
+		p.TotalSize += info.Size
+	}
+
+	free, err := diskFree(c.tempDir)
+	if err != nil {
+		free = -1
+	}
+	p.TempFree = free
+
+	for p.Concurrency = c.fileConcurrency; ; p.Concurrency-- {
+		p.TempBytes, p.MemoryBytes = peakUsage(p.Files, p.Concurrency)
+		if p.Fits() || p.Concurrency == 1 {
+			break
+		}
+	}
+	if p.Concurrency > len(p.Files) && len(p.Files) > 0 {
+		p.Concurrency = len(p.Files)
+	}
+	return p, nil
+}
+
+// estimateFile - returns the estimated temp disk and memory of converting a CUR file of size bytes. Files are downloaded
+// and converted in the temp directory unless streamed or copied, and parquet-go buffers a row group per output file in
+// memory, so a partitioned file buffers a row group per partition. Streamed partitions share a row group, see
+// shareRowGroups, but each has an upload buffer
+func (c *CurConvert) estimateFile(object string, size int64) (int64, int64) {
+	ratio := gzipParquetRatio
+	if strings.HasSuffix(strings.ToLower(object), ".csv") {
+		ratio = plainParquetRatio
+	}
+	parquetSize := int64(float64(size) * ratio)
+
+	// with no partition limit, e.g. by account, the whole file may be buffered across partitions
+	partitions := c.partitionCount()
+	buffered := c.rowGroupSize * partitions
+	if c.streaming {
+		buffered = c.rowGroupSize
+		if partitions*minStreamRowGroupSize > buffered {
+			buffered = partitions * minStreamRowGroupSize
+		}
+	}
+	if partitions < 1 || buffered > parquetSize {
+		buffered = parquetSize
+	}
+	memory := buffered * rowGroupMemRatio
+	if c.streaming {
+		if partitions < 1 {
+			partitions = unlimitedPartitions
+		}
+		memory += partitions * uploadBufferSize
+	}
+
+	switch {
+	case c.inputFormat == formatParquet:
+		// copied as is, client-side encryption copies via the temp directory
+		if len(c.destKMSKey) > 0 {
+			return size, 0
+		}
+		return 0, 0
+	case c.streaming:
+		// streamed parquet is downloaded again to verify it
+		if c.verifyMode != VerifyOff {
+			return parquetSize, memory
+		}
+		return 0, memory
+	}
+	return size + parquetSize, memory
+}
+
+// partitionCount - returns the most partitions a CUR file can be written to, 0 if there is no limit
+func (c *CurConvert) partitionCount() int64 {
+	count := int64(1)
+	for _, key := range c.partitions {
+		n, ok := partitionCounts[key]
+		if !ok {
+			return 0
+		}
+		count *= n
+	}
+	return count
+}
+
+// peakUsage - returns the temp disk and memory used when the largest files are converted by concurrency workers
+func peakUsage(files []PlannedFile, concurrency int) (int64, int64) {
+	var temp, memory []int64
+	for _, f := range files {
+		if !f.Skip {
+			temp = append(temp, f.Temp)
+			memory = append(memory, f.Memory)
+		}
+	}
+	return sumLargest(temp, concurrency), sumLargest(memory, concurrency)
+}
+
+// sumLargest - returns the sum of the n largest values
+func sumLargest(values []int64, n int) int64 {
+	sort.Slice(values, func(i, j int) bool { return values[i] > values[j] })
+	var sum int64
+	for i := 0; i < n && i < len(values); i++ {
+		sum += values[i]
+	}
+	return sum
+}
+
+// preflightCheck - plans the conversion when preflight is enabled, reducing fileConcurrency to fit or failing with a
+// PlanError. Returns the file concurrency to convert with
+func (c *CurConvert) preflightCheck(ctx context.Context) (int, error) {
+	if c.preflight == PreflightOff {
+		return c.fileConcurrency, nil
+	}
+
+	p, err := c.plan(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if c.preflight == PreflightAbort && p.Concurrency < c.fileConcurrency && p.Concurrency < len(p.Files) {
+		// report the plan as configured rather than as reduced
+		p.Concurrency = c.fileConcurrency
+		p.TempBytes, p.MemoryBytes = peakUsage(p.Files, p.Concurrency)
+		return 0, &PlanError{Plan: p}
+	}
+	if !p.Fits() {
+		return 0, &PlanError{Plan: p}
+	}
+	return p.Concurrency, nil
+}
+
+//
+// FormatBytes - returns a human readable size, e.g. 1.5 GiB
+func FormatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
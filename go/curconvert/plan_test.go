@@ -0,0 +1,125 @@
+package curconvert
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSumLargest(t *testing.T) {
+	tests := []struct {
+		values []int64
+		n      int
+		want   int64
+	}{
+		{values: nil, n: 2, want: 0},
+		{values: []int64{1, 5, 3}, n: 0, want: 0},
+		{values: []int64{1, 5, 3}, n: 1, want: 5},
+		{values: []int64{1, 5, 3}, n: 2, want: 8},
+		{values: []int64{1, 5, 3}, n: 5, want: 9},
+		{values: []int64{4, 4, 4}, n: 2, want: 8},
+	}
+	for _, tt := range tests {
+		if got := sumLargest(append([]int64{}, tt.values...), tt.n); got != tt.want {
+			t.Errorf("sumLargest(%v, %d) = %d, want %d", tt.values, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		b    int64
+		want string
+	}{
+		{b: 0, want: "0 B"},
+		{b: 1023, want: "1023 B"},
+		{b: 1024, want: "1.0 KiB"},
+		{b: 1536 * 1024 * 1024, want: "1.5 GiB"},
+	}
+	for _, tt := range tests {
+		if got := FormatBytes(tt.b); got != tt.want {
+			t.Errorf("FormatBytes(%d) = %q, want %q", tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	// gzip CSV of n bytes is estimated as n bytes of parquet, all buffered as a single row group
+	files := []struct {
+		key  string
+		size int
+	}{
+		{"cur/a1/cur-1.csv.gz", 100},
+		{"cur/a1/cur-2.csv.gz", 200},
+		{"cur/a1/cur-3.csv.gz", 300},
+	}
+	tests := []struct {
+		name            string
+		memoryLimit     int64
+		unchanged       string
+		wantConcurrency int
+		wantMemory      int64
+		wantTemp        int64
+		wantFits        bool
+	}{
+		{name: "no limit", wantConcurrency: 3, wantMemory: 1200, wantTemp: 1200, wantFits: true},
+		{name: "reduced to fit", memoryLimit: 1000, wantConcurrency: 2, wantMemory: 1000, wantTemp: 1000, wantFits: true},
+		{name: "does not fit", memoryLimit: 500, wantConcurrency: 1, wantMemory: 600, wantTemp: 600, wantFits: false},
+		{name: "unchanged file skipped", memoryLimit: 600, unchanged: "cur/a1/cur-3.csv.gz", wantConcurrency: 3, wantMemory: 600, wantTemp: 600, wantFits: true},
+	}
+	for _, tt := range tests {
+		func() {
+			dir, cleanup := testDir(t)
+			defer cleanup()
+			ctx := context.Background()
+
+			source := NewLocalStorage(dir + "/source")
+			dest := NewLocalStorage(dir + "/dest")
+			c := NewCurConvert("", "cur/cur-Manifest.json", "", "parquet/202610")
+			c.SetSourceStorage(source)
+			c.SetDestStorage(dest)
+			c.SetFileConcurrency(3)
+			c.SetPreflight(PreflightReduce, tt.memoryLimit)
+			c.tempDir = dir
+			c.assemblyID = "a1"
+			c.state = ConvertState{AssemblyID: "a1", Files: make(map[string]FileState)}
+			c.prevState = ConvertState{AssemblyID: "a1", Files: make(map[string]FileState)}
+			for _, f := range files {
+				putObject(t, source, f.key, strings.Repeat("x", f.size))
+				c.CurFiles = append(c.CurFiles, f.key)
+			}
+			if len(tt.unchanged) > 0 {
+				info, err := source.Stat(ctx, tt.unchanged)
+				if err != nil {
+					t.Fatal(err)
+				}
+				output := c.outputKey("", c.parquetName(tt.unchanged))
+				putObject(t, dest, output, "parquet")
+				c.prevState.Files[tt.unchanged] = FileState{ETag: info.ETag, OutputKeys: []string{output}}
+			}
+
+			p, err := c.plan(ctx)
+			if err != nil {
+				t.Fatalf("%s: %s", tt.name, err)
+			}
+			if p.Concurrency != tt.wantConcurrency || p.MemoryBytes != tt.wantMemory || p.TempBytes != tt.wantTemp {
+				t.Errorf("%s: concurrency %d, memory %d, temp %d, want %d, %d, %d", tt.name,
+					p.Concurrency, p.MemoryBytes, p.TempBytes, tt.wantConcurrency, tt.wantMemory, tt.wantTemp)
+			}
+			if p.Fits() != tt.wantFits {
+				t.Errorf("%s: fits %t, want %t", tt.name, p.Fits(), tt.wantFits)
+			}
+			if p.TotalSize != 600 || len(p.Files) != len(files) {
+				t.Errorf("%s: %d files of %d bytes, want %d of 600", tt.name, len(p.Files), p.TotalSize, len(files))
+			}
+			for _, f := range p.Files {
+				if f.Skip != (f.Key == tt.unchanged) {
+					t.Errorf("%s: %s skipped %t", tt.name, f.Key, f.Skip)
+				}
+				if want := "parquet/202610/" + parquetFileName(f.Key); f.Output != want {
+					t.Errorf("%s: %s output %s, want %s", tt.name, f.Key, f.Output, want)
+				}
+			}
+		}()
+	}
+}
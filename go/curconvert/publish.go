@@ -0,0 +1,265 @@
+package curconvert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// publishFileName - records the live version of a versioned dest path, the leading '_' stops Athena reading it as data
+const publishFileName = "_curconvert_published.json"
+
+// versionPrefix - prefix of the version folders within a versioned dest path
+const versionPrefix = "v="
+
+// defaultRetention - how long superseded versions are kept for queries still reading them
+const defaultRetention = 24 * time.Hour
+
+//
+// PublishState - the live version of a versioned dest path and when each previous version was superseded. An empty
+// version is the un-versioned output written before versioning was enabled
+type PublishState struct {
+	Current    string               `json:"current"`
+	Published  time.Time            `json:"published"`
+	Superseded map[string]time.Time `json:"superseded,omitempty"`
+}
+
+//
+// SetVersioning - when enabled each conversion is written to a new v=<assemblyId> folder within the dest path and only
+// published, by recording it as the current version, once every file has converted. The live location is returned by
+// GetCURLocation, for an Athena table LOCATION to be switched to. Superseded versions are deleted by CollectVersions once
+// older than retention, which must allow for the table to be switched and queries of the previous version to finish
+func (c *CurConvert) SetVersioning(enabled bool, retention time.Duration) error {
+	if retention < 0 {
+		return errors.New("Version retention must be zero or more")
+	}
+	c.versioned = enabled
+	c.retention = retention
+	return nil
+}
+
+//
+// GetCURLocation - returns the dest path key prefix holding the current converted CUR, including the version folder
+// when versioning is enabled
+func (c *CurConvert) GetCURLocation() string {
+	if len(c.version) > 0 {
+		return c.destObject + "/" + c.version
+	}
+	return c.destObject
+}
+
+// outputPrefix - returns the key prefix parquet output is written to, the staged version when versioning is enabled
+func (c *CurConvert) outputPrefix() string {
+	if c.versioned && len(c.version) > 0 {
+		return c.destObject + "/" + c.version
+	}
+	return c.destObject
+}
+
+// loadPublishState - reads the publish state of the dest path, a missing file is no published version
+func (c *CurConvert) loadPublishState(ctx context.Context) error {
+	c.published = PublishState{Superseded: make(map[string]time.Time)}
+
+	dest := c.getDestStorage()
+	publishObject := c.destObject + "/" + publishFileName
+	body, err := dest.Get(ctx, publishObject)
+	if IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return &UploadError{Bucket: dest.String(), Key: publishObject, Err: err}
+	}
+	defer body.Close()
+
+	if err := json.NewDecoder(body).Decode(&c.published); err != nil {
+		return &UploadError{Bucket: dest.String(), Key: publishObject, Err: err}
+	}
+	if c.published.Superseded == nil {
+		c.published.Superseded = make(map[string]time.Time)
+	}
+	return nil
+}
+
+// savePublishState - writes the publish state of the dest path, a single PUT so the switch of version is atomic
+func (c *CurConvert) savePublishState(ctx context.Context) error {
+	dest := c.getDestStorage()
+	publishObject := c.destObject + "/" + publishFileName
+
+	b, err := json.MarshalIndent(c.published, "", "  ")
+	if err != nil {
+		return &UploadError{Bucket: dest.String(), Key: publishObject, Err: err}
+	}
+	if err := dest.Put(ctx, publishObject, bytes.NewReader(b)); err != nil {
+		return &UploadError{Bucket: dest.String(), Key: publishObject, Err: err}
+	}
+	return nil
+}
+
+// stageVersion - chooses the version folder this conversion is written to. The live version is never written to, so if
+// the CUR assembly is already published a suffixed version is staged, unless every file is unchanged when
+// upToDate is returned and there is nothing to convert. Files are only skipped as unchanged when their previous
+// output is in the live version of the same assembly
+func (c *CurConvert) stageVersion(ctx context.Context) (upToDate bool, err error) {
+	if err := c.loadPublishState(ctx); err != nil {
+		return false, err
+	}
+
+	name := c.assemblyID
+	if len(name) < 1 {
+		name = time.Now().UTC().Format("20060102T150405")
+	}
+	version := versionPrefix + partitionValue(name)
+	current := c.published.Current
+	if current != version && !strings.HasPrefix(current, version+"-") {
+		// previous outputs, if any, are outside the staged version so every file is converted into it
+		c.version = version
+		c.prevState = ConvertState{Files: make(map[string]FileState)}
+		return false, nil
+	}
+
+	// the published version of the assembly, possibly suffixed, can be re-used as is if no file has changed
+	c.version = current
+	source := c.getSourceStorage()
+	upToDate = !c.force
+	var outputKeys []string
+	for _, object := range c.CurFiles {
+		if !upToDate {
+			break
+		}
+		info, err := source.Stat(ctx, object)
+		if err != nil {
+			upToDate = false
+			break
+		}
+		var prev FileState
+		prev, upToDate = c.unchanged(ctx, object, info.ETag)
+		outputKeys = append(outputKeys, prev.OutputKeys...)
+	}
+	if upToDate {
+		for _, key := range outputKeys {
+			c.addParquetFile(key)
+		}
+		return true, nil
+	}
+
+	// previous outputs are in the live version, so all files are converted into the new version
+	c.version = version + "-" + time.Now().UTC().Format("20060102T150405")
+	c.prevState = ConvertState{Files: make(map[string]FileState)}
+	return false, nil
+}
+
+// publishVersion - records the staged version as current, the previous version is kept until the retention has passed
+func (c *CurConvert) publishVersion(ctx context.Context) error {
+	now := time.Now().UTC()
+	if c.published.Current != c.version {
+		c.published.Superseded[c.published.Current] = now
+	}
+	delete(c.published.Superseded, c.version)
+	c.published.Current = c.version
+	c.published.Published = now
+	return c.savePublishState(ctx)
+}
+
+// discardVersion - removes the output of a failed staged version. Runs with a background context so that it completes
+// after the conversion was cancelled
+func (c *CurConvert) discardVersion() {
+	if !c.versioned || len(c.version) < 1 || c.version == c.published.Current {
+		return
+	}
+	ctx := aws.BackgroundContext()
+	dest := c.getDestStorage()
+	objects, err := dest.List(ctx, c.destObject+"/"+c.version+"/")
+	if err != nil {
+		return
+	}
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	dest.Delete(ctx, keys)
+}
+
+// versionOf - returns the version folder of key within the dest path, the empty version for un-versioned output and
+// false for metadata such as the state files
+func (c *CurConvert) versionOf(key string) (string, bool) {
+	rel := strings.TrimPrefix(key, c.destObject+"/")
+	if strings.HasPrefix(rel, versionPrefix) && strings.Contains(rel, "/") {
+		return rel[:strings.Index(rel, "/")], true
+	}
+	if strings.HasPrefix(rel[strings.LastIndex(rel, "/")+1:], "_") {
+		return "", false
+	}
+	return "", true
+}
+
+//
+// CollectVersions - deletes versions other than the published one once superseded for longer than the retention.
+// Versions that were never published, e.g. from a failed conversion, are deleted once their newest object is older
+// than the retention. Nothing is deleted until a version has been published, and un-versioned output written before
+// versioning was enabled is only deleted once the publish state records it as superseded by a published version
+func (c *CurConvert) CollectVersions(ctx context.Context) error {
+	if err := c.loadPublishState(ctx); err != nil {
+		return err
+	}
+	if len(c.published.Current) < 1 {
+		return nil
+	}
+
+	dest := c.getDestStorage()
+	objects, err := dest.List(ctx, c.destObject+"/")
+	if err != nil {
+		return &UploadError{Bucket: dest.String(), Key: c.destObject + "/", Err: fmt.Errorf("listing versions to collect: %s", err)}
+	}
+
+	versions := make(map[string][]ObjectInfo)
+	for _, object := range objects {
+		if version, ok := c.versionOf(object.Key); ok && version != c.published.Current {
+			versions[version] = append(versions[version], object)
+		}
+	}
+
+	now := time.Now()
+	var deleteObjects []string
+	for version, objects := range versions {
+		expires, superseded := c.published.Superseded[version]
+		if !superseded {
+			if len(version) < 1 {
+				continue
+			}
+			for _, object := range objects {
+				if object.LastModified.After(expires) {
+					expires = object.LastModified
+				}
+			}
+		}
+		if now.Sub(expires) < c.retention {
+			continue
+		}
+		for _, object := range objects {
+			deleteObjects = append(deleteObjects, object.Key)
+		}
+		delete(versions, version)
+	}
+	if err := dest.Delete(ctx, deleteObjects); err != nil {
+		return &UploadError{Bucket: dest.String(), Key: c.destObject + "/", Err: fmt.Errorf("deleting superseded versions: %s", err)}
+	}
+
+	// forget versions that no longer exist
+	changed := false
+	for version := range c.published.Superseded {
+		if _, ok := versions[version]; !ok {
+			delete(c.published.Superseded, version)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return c.savePublishState(ctx)
+}
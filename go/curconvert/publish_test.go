@@ -0,0 +1,251 @@
+package curconvert
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStageVersion(t *testing.T) {
+	const (
+		curObject  = "cur/20261001-20261101/a1/cur-1.csv.gz"
+		destObject = "parquet/202610"
+	)
+	tests := []struct {
+		name        string
+		current     string
+		outputKey   string
+		outputs     bool
+		force       bool
+		wantVersion string
+		wantStaged  string
+		wantUpdate  bool
+	}{
+		{name: "unpublished", outputKey: destObject + "/cur-1.parquet", outputs: true, wantVersion: "v=a1"},
+		{name: "unpublished without outputs", wantVersion: "v=a1"},
+		{name: "previous assembly", current: "v=a0", outputKey: destObject + "/v=a0/cur-1.parquet", outputs: true, wantVersion: "v=a1"},
+		{
+			name:        "published and unchanged",
+			current:     "v=a1",
+			outputKey:   destObject + "/v=a1/cur-1.parquet",
+			outputs:     true,
+			wantVersion: "v=a1",
+			wantUpdate:  true,
+		},
+		{
+			name:        "re-published and unchanged",
+			current:     "v=a1-20261001T000000",
+			outputKey:   destObject + "/v=a1-20261001T000000/cur-1.parquet",
+			outputs:     true,
+			wantVersion: "v=a1-20261001T000000",
+			wantUpdate:  true,
+		},
+		{name: "published and output missing", current: "v=a1", outputKey: destObject + "/v=a1/cur-1.parquet", wantStaged: "v=a1-"},
+		{name: "published output elsewhere", current: "v=a1", outputKey: destObject + "/cur-1.parquet", outputs: true, wantStaged: "v=a1-"},
+		{name: "forced", current: "v=a1", outputKey: destObject + "/v=a1/cur-1.parquet", outputs: true, force: true, wantStaged: "v=a1-"},
+		{name: "other assembly prefix", current: "v=a10", outputKey: destObject + "/v=a10/cur-1.parquet", outputs: true, wantVersion: "v=a1"},
+	}
+	for _, tt := range tests {
+		func() {
+			dir, cleanup := testDir(t)
+			defer cleanup()
+			ctx := context.Background()
+
+			source := NewLocalStorage(dir + "/source")
+			dest := NewLocalStorage(dir + "/dest")
+			putObject(t, source, curObject, "csv")
+			info, err := source.Stat(ctx, curObject)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := NewCurConvert("", "cur/20261001-20261101/cur-Manifest.json", "", destObject)
+			c.SetSourceStorage(source)
+			c.SetDestStorage(dest)
+			c.SetVersioning(true, time.Hour)
+			c.SetForce(tt.force)
+			c.assemblyID = "a1"
+			c.CurFiles = []string{curObject}
+			c.state = ConvertState{AssemblyID: "a1", Files: make(map[string]FileState)}
+			c.prevState = ConvertState{
+				AssemblyID: "a1",
+				Files:      map[string]FileState{curObject: {ETag: info.ETag, OutputKeys: []string{tt.outputKey}}},
+			}
+			if len(tt.current) > 0 {
+				c.published = PublishState{Current: tt.current, Superseded: make(map[string]time.Time)}
+				if err := c.savePublishState(ctx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.outputs {
+				putObject(t, dest, tt.outputKey, "parquet")
+			}
+
+			upToDate, err := c.stageVersion(ctx)
+			if err != nil {
+				t.Fatalf("%s: %s", tt.name, err)
+			}
+			if upToDate != tt.wantUpdate {
+				t.Errorf("%s: up to date %t, want %t", tt.name, upToDate, tt.wantUpdate)
+			}
+			if len(tt.wantStaged) > 0 {
+				if !strings.HasPrefix(c.version, tt.wantStaged) || c.version == tt.current {
+					t.Errorf("%s: version %s, want a new version prefixed %s", tt.name, c.version, tt.wantStaged)
+				}
+			} else if c.version != tt.wantVersion {
+				t.Errorf("%s: version %s, want %s", tt.name, c.version, tt.wantVersion)
+			}
+
+			// a staged version is always empty, so no file may be skipped as unchanged
+			_, unchanged := c.unchanged(ctx, curObject, info.ETag)
+			if unchanged != upToDate {
+				t.Errorf("%s: file unchanged %t, want %t", tt.name, unchanged, upToDate)
+			}
+
+			// the outputs of an up to date version are its files, e.g. to load its partitions
+			if upToDate && !c.CurParqetFiles[tt.outputKey] {
+				t.Errorf("%s: parquet files %v, want %s", tt.name, c.CurParqetFiles, tt.outputKey)
+			}
+		}()
+	}
+}
+
+func TestCollectVersions(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	ctx := context.Background()
+	now := time.Now()
+
+	const destObject = "parquet/202610"
+	dest := NewLocalStorage(dir)
+	c := NewCurConvert("", "", "", destObject)
+	c.SetDestStorage(dest)
+	c.SetVersioning(true, time.Hour)
+
+	// nothing is collected until a version is published
+	putObject(t, dest, destObject+"/v=failed/cur-1.parquet", "parquet")
+	old := now.Add(-48 * time.Hour)
+	if err := os.Chtimes(dest.path(destObject+"/v=failed/cur-1.parquet"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CollectVersions(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dest.Stat(ctx, destObject+"/v=failed/cur-1.parquet"); err != nil {
+		t.Errorf("version collected without a published version: %v", err)
+	}
+
+	c.published = PublishState{
+		Current: "v=a2",
+		Superseded: map[string]time.Time{
+			"":     now.Add(-2 * time.Hour),
+			"v=a0": now.Add(-2 * time.Hour),
+			"v=a1": now.Add(-10 * time.Minute),
+			"v=x":  now.Add(-2 * time.Hour),
+		},
+	}
+	if err := c.savePublishState(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	objects := []struct {
+		key      string
+		modified time.Time
+		kept     bool
+	}{
+		{key: destObject + "/cur-1.parquet", modified: now.Add(-48 * time.Hour)},
+		{key: destObject + "/v=a0/cur-1.parquet", modified: now.Add(-48 * time.Hour)},
+		{key: destObject + "/v=a1/cur-1.parquet", modified: now.Add(-48 * time.Hour), kept: true},
+		{key: destObject + "/v=a2/cur-1.parquet", modified: now.Add(-48 * time.Hour), kept: true},
+		{key: destObject + "/v=a2/day=2026-10-01/cur-1.parquet", modified: now.Add(-48 * time.Hour), kept: true},
+		{key: destObject + "/v=failed/cur-1.parquet", modified: now.Add(-2 * time.Hour)},
+		{key: destObject + "/v=staging/cur-1.parquet", modified: now.Add(-10 * time.Minute), kept: true},
+		{key: destObject + "/" + stateFileName, modified: now.Add(-48 * time.Hour), kept: true},
+	}
+	for _, object := range objects {
+		putObject(t, dest, object.key, "parquet")
+		if err := os.Chtimes(dest.path(object.key), object.modified, object.modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.CollectVersions(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, object := range objects {
+		_, err := dest.Stat(ctx, object.key)
+		if kept := err == nil; kept != object.kept {
+			t.Errorf("%s: kept %t, want %t", object.key, kept, object.kept)
+		}
+	}
+
+	// collected versions, and v=x which had no objects, are forgotten
+	if err := c.loadPublishState(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.published.Superseded["v=a1"]; !ok || len(c.published.Superseded) != 1 {
+		t.Errorf("superseded versions %v, want only v=a1", c.published.Superseded)
+	}
+}
+
+func TestCollectVersionsUnversioned(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	ctx := context.Background()
+	old := time.Now().Add(-48 * time.Hour)
+
+	// un-versioned output is kept unless the publish state records it superseded
+	const destObject = "parquet/202610"
+	dest := NewLocalStorage(dir)
+	c := NewCurConvert("", "", "", destObject)
+	c.SetDestStorage(dest)
+	c.SetVersioning(true, time.Hour)
+	c.published = PublishState{Current: "v=a1", Superseded: map[string]time.Time{}}
+	if err := c.savePublishState(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{destObject + "/cur-1.parquet", destObject + "/v=a1/cur-1.parquet"} {
+		putObject(t, dest, key, "parquet")
+		if err := os.Chtimes(dest.path(key), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.CollectVersions(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{destObject + "/cur-1.parquet", destObject + "/v=a1/cur-1.parquet"}
+	if got := listKeys(t, dest, destObject+"/v="); !reflect.DeepEqual(got, want[1:]) {
+		t.Errorf("versions %v, want %v", got, want[1:])
+	}
+	if _, err := dest.Stat(ctx, want[0]); err != nil {
+		t.Errorf("un-versioned output collected: %v", err)
+	}
+}
+
+func TestGetCURPartitionPaths(t *testing.T) {
+	c := NewCurConvert("", "", "", "parquet/202610")
+	c.SetVersioning(true, time.Hour)
+	c.version = "v=a1"
+	for _, key := range []string{
+		"parquet/202610/v=a1/day=2026-10-02/account=123/cur-1.parquet",
+		"parquet/202610/v=a1/day=2026-10-01/account=123/cur-1.parquet",
+		"parquet/202610/v=a1/day=2026-10-01/account=123/cur-2.parquet",
+	} {
+		c.addParquetFile(key)
+	}
+	want := []string{"day=2026-10-01/account=123", "day=2026-10-02/account=123"}
+	if got := c.GetCURPartitionPaths(); !reflect.DeepEqual(got, want) {
+		t.Errorf("partition paths %v, want %v", got, want)
+	}
+
+	// un-partitioned output has no partition paths
+	c = NewCurConvert("", "", "", "parquet/202610")
+	c.addParquetFile("parquet/202610/cur-1.parquet")
+	if got := c.GetCURPartitionPaths(); len(got) > 0 {
+		t.Errorf("un-partitioned paths %v", got)
+	}
+}
@@ -0,0 +1,229 @@
+package curconvert
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// redaction actions
+const (
+	redactDrop     = "drop"
+	redactHash     = "hash"
+	redactTruncate = "truncate"
+	redactReplace  = "replace"
+)
+
+//
+// RedactionRule - a redaction applied to the columns matching Column, a glob (e.g. resourcetags/*) or regular expression
+// prefixed with re: as used by SetColumnFilter. Action is one of drop, hash, truncate (to Length characters) or replace
+// (with Value)
+type RedactionRule struct {
+	Column string `json:"column"`
+	Action string `json:"action"`
+	Length int    `json:"length,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+// redaction - a parsed RedactionRule
+type redaction struct {
+	RedactionRule
+	pattern columnPattern
+}
+
+// String - describes the rule, as recorded in conversion state
+func (r redaction) String() string {
+	switch r.Action {
+	case redactTruncate:
+		return fmt.Sprintf("%s %s %d", r.Action, r.Column, r.Length)
+	case redactReplace:
+		return fmt.Sprintf("%s %s '%s'", r.Action, r.Column, r.Value)
+	}
+	return r.Action + " " + r.Column
+}
+
+// newRedaction - validates and parses a redaction rule
+func newRedaction(rule RedactionRule) (redaction, error) {
+	rule.Action = strings.ToLower(strings.TrimSpace(rule.Action))
+	switch rule.Action {
+	case redactDrop, redactHash, redactReplace:
+	case redactTruncate:
+		if rule.Length < 0 {
+			return redaction{}, fmt.Errorf("Truncate length of column %s must be zero or more", rule.Column)
+		}
+	default:
+		return redaction{}, fmt.Errorf("Unknown redaction action %s for column %s, must be one of drop, hash, truncate or replace", rule.Action, rule.Column)
+	}
+
+	p, err := newColumnPattern(rule.Column)
+	if err != nil {
+		return redaction{}, err
+	}
+	return redaction{RedactionRule: rule, pattern: p}, nil
+}
+
+//
+// SetRedactionFile - loads redaction rules from a JSON file holding a list of RedactionRule, e.g.
+// [{"column": "lineitem/usageaccountid", "action": "hash"}, {"column": "resourcetags/*", "action": "drop"}].
+// Each column is redacted by the first rule it matches, see SetRedactionRules
+func (c *CurConvert) SetRedactionFile(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("Failed to read redaction file %s: %s", file, err)
+	}
+
+	var rules []RedactionRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return fmt.Errorf("Failed to parse redaction file %s: %s", file, err)
+	}
+	if err := c.SetRedactionRules(rules); err != nil {
+		return fmt.Errorf("Invalid redaction file %s: %s", file, err)
+	}
+	return nil
+}
+
+//
+// SetRedactionRules - redacts the values of matching columns as they are converted. Dropped columns are not written,
+// hashed values are replaced by the hex HMAC-SHA256 of the value keyed by SetRedactionKey, so the same value hashes
+// the same in every month converted with the key. Redacted columns other than MAP columns are written as STRING, rules
+// for MAP columns (e.g. resource_tags) apply to each value of the map. Empty values are left empty. Row filters are
+// applied to the original values, partition folders are named from the redacted values
+func (c *CurConvert) SetRedactionRules(rules []RedactionRule) error {
+	var redactions []redaction
+	for _, rule := range rules {
+		r, err := newRedaction(rule)
+		if err != nil {
+			return err
+		}
+		redactions = append(redactions, r)
+	}
+	c.redactions = redactions
+	return nil
+}
+
+//
+// SetRedactionKey - sets the secret key hash redactions are keyed with. The same key must be used for every month for
+// hashed values to join across months
+func (c *CurConvert) SetRedactionKey(key []byte) error {
+	if len(key) < 1 {
+		return errors.New("Must supply a redaction key")
+	}
+	c.redactionKey = key
+	return nil
+}
+
+// redactionFor - returns the first rule matching the normalized column name
+func (c *CurConvert) redactionFor(name string) (redaction, bool) {
+	for _, r := range c.redactions {
+		if r.pattern.match(name) {
+			return r, true
+		}
+	}
+	return redaction{}, false
+}
+
+// dropped - returns true if the column is dropped by a redaction rule
+func (c *CurConvert) dropped(name string) bool {
+	r, ok := c.redactionFor(name)
+	return ok && r.Action == redactDrop
+}
+
+// resolveRedactions - maps the CSV index of each redacted column to its rule, once the CUR columns are known. Fails
+// if hashing without a key or a partition would be named from a dropped column
+func (c *CurConvert) resolveRedactions() error {
+	// MAP columns are redacted per value once parsed, see redactMap
+	mapColumns := make(map[int]bool)
+	for _, f := range c.mapFields {
+		mapColumns[f.index] = true
+	}
+
+	c.redactedCols = make(map[int]redaction)
+	for name, index := range c.columnIndex {
+		r, ok := c.redactionFor(name)
+		if !ok {
+			continue
+		}
+		if r.Action == redactHash && len(c.redactionKey) < 1 {
+			return fmt.Errorf("column %s is hashed but no redaction key is set", name)
+		}
+		if r.Action != redactDrop && !mapColumns[index] {
+			c.redactedCols[index] = r
+		}
+	}
+	for _, key := range c.partitions {
+		if c.dropped(partitionColumns[key]) {
+			return fmt.Errorf("partition %s is taken from column %s, which is dropped by redaction", key, partitionColumns[key])
+		}
+	}
+
+	// redacted values are strings, whatever the type of the original column
+	for i := range c.fields {
+		if _, ok := c.redactedCols[c.fields[i].index]; ok {
+			c.fields[i].athenaType = "STRING"
+		}
+	}
+	return nil
+}
+
+// redactRecord - redacts the values of a CSV record in place
+func (c *CurConvert) redactRecord(rec []string) {
+	for index, r := range c.redactedCols {
+		if index < len(rec) {
+			rec[index] = c.redact(r, rec[index])
+		}
+	}
+}
+
+// redactMap - redacts the values of a MAP column
+func (c *CurConvert) redactMap(f curField, values map[string]string) map[string]string {
+	r, ok := c.redactionFor(f.name)
+	if !ok {
+		return values
+	}
+	for k, v := range values {
+		values[k] = c.redact(r, v)
+	}
+	return values
+}
+
+// redact - returns the value redacted by rule r
+func (c *CurConvert) redact(r redaction, v string) string {
+	if len(v) < 1 {
+		return v
+	}
+	switch r.Action {
+	case redactHash:
+		mac := hmac.New(sha256.New, c.redactionKey)
+		mac.Write([]byte(v))
+		return hex.EncodeToString(mac.Sum(nil))
+	case redactTruncate:
+		if runes := []rune(v); len(runes) > r.Length {
+			return string(runes[:r.Length])
+		}
+		return v
+	case redactReplace:
+		return r.Value
+	}
+	return v
+}
+
+// redactionExprs - returns the redaction rules, as recorded in conversion state. Hashing includes a fingerprint of the
+// key so that changing the key converts every file again
+func (c *CurConvert) redactionExprs() []string {
+	var exprs []string
+	for _, r := range c.redactions {
+		expr := r.String()
+		if r.Action == redactHash && len(c.redactionKey) > 0 {
+			mac := hmac.New(sha256.New, c.redactionKey)
+			mac.Write([]byte("curconvert"))
+			expr += " key:" + hex.EncodeToString(mac.Sum(nil))[:8]
+		}
+		exprs = append(exprs, expr)
+	}
+	return exprs
+}
@@ -0,0 +1,58 @@
+package curconvert
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	key := []byte("secret")
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("123456789012"))
+	hashed := hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name  string
+		rule  RedactionRule
+		value string
+		want  string
+	}{
+		{name: "hash", rule: RedactionRule{Column: "a", Action: "hash"}, value: "123456789012", want: hashed},
+		{name: "hash empty", rule: RedactionRule{Column: "a", Action: "hash"}, value: "", want: ""},
+		{name: "truncate", rule: RedactionRule{Column: "a", Action: "truncate", Length: 4}, value: "123456789012", want: "1234"},
+		{name: "truncate short", rule: RedactionRule{Column: "a", Action: "truncate", Length: 4}, value: "12", want: "12"},
+		{name: "truncate runes", rule: RedactionRule{Column: "a", Action: "truncate", Length: 2}, value: "日本語", want: "日本"},
+		{name: "truncate to zero", rule: RedactionRule{Column: "a", Action: "Truncate", Length: 0}, value: "abc", want: ""},
+		{name: "replace", rule: RedactionRule{Column: "a", Action: "replace", Value: "REDACTED"}, value: "abc", want: "REDACTED"},
+		{name: "replace empty", rule: RedactionRule{Column: "a", Action: "replace", Value: "REDACTED"}, value: "", want: ""},
+	}
+	for _, tt := range tests {
+		c := NewCurConvert("", "", "", "")
+		if err := c.SetRedactionKey(key); err != nil {
+			t.Fatal(err)
+		}
+		r, err := newRedaction(tt.rule)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if got := c.redact(r, tt.value); got != tt.want {
+			t.Errorf("%s: redact(%q) = %q, want %q", tt.name, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestNewRedactionInvalid(t *testing.T) {
+	tests := []RedactionRule{
+		{Column: "a", Action: "mask"},
+		{Column: "a", Action: "truncate", Length: -1},
+		{Column: "re:(", Action: "drop"},
+		{Column: "[", Action: "drop"},
+	}
+	for _, rule := range tests {
+		if _, err := newRedaction(rule); err == nil {
+			t.Errorf("newRedaction(%+v): expected an error", rule)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package curconvert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetryAttempts = 3
+	defaultRetryDelay    = time.Second
+	defaultRetryMaxDelay = 30 * time.Second
+)
+
+//
+// FailurePolicy - how ConvertCur handles CUR files that still fail after all retries
+type FailurePolicy int
+
+const (
+	// FailFast - the first failed file cancels the conversion, the default
+	FailFast FailurePolicy = iota
+	// BestEffort - every file is attempted, failures are reported in a PartialError
+	BestEffort
+	// Threshold - as BestEffort, unless more than the threshold percentage of files fail
+	Threshold
+)
+
+// failurePolicies - names accepted by ParseFailurePolicy
+var failurePolicies = map[string]FailurePolicy{
+	"failfast":   FailFast,
+	"besteffort": BestEffort,
+	"threshold":  Threshold,
+}
+
+//
+// ParseFailurePolicy - returns the FailurePolicy named failfast, besteffort or threshold (case and '-' / '_' insensitive)
+func ParseFailurePolicy(name string) (FailurePolicy, error) {
+	key := strings.ToLower(strings.NewReplacer("-", "", "_", "", " ", "").Replace(name))
+	if policy, ok := failurePolicies[key]; ok {
+		return policy, nil
+	}
+	return FailFast, fmt.Errorf("Unknown failure policy %s, must be one of failfast, besteffort or threshold", name)
+}
+
+//
+// SetRetry - sets the number of attempts made at each stage (download, convert, upload) of a CUR file and the
+// backoff between attempts. The delay doubles after each failed attempt up to maxDelay, with full jitter. Only transient
+// errors (throttling, 5xx responses, network errors and timeouts) are retried
+func (c *CurConvert) SetRetry(attempts int, delay time.Duration, maxDelay time.Duration) error {
+	if attempts < 1 || attempts > 100 {
+		return errors.New("Retry attempts must be between 1-100")
+	}
+	if delay <= 0 || maxDelay < delay {
+		return errors.New("Retry delay must be greater than zero and no more than the max delay")
+	}
+	c.retryAttempts = attempts
+	c.retryDelay = delay
+	c.retryMaxDelay = maxDelay
+	return nil
+}
+
+//
+// SetFailurePolicy - sets how files that fail after all retries are handled. thresholdPercent is only used by the
+// Threshold policy, which fails the conversion if more than that percentage of CUR files fail
+func (c *CurConvert) SetFailurePolicy(policy FailurePolicy, thresholdPercent float64) error {
+	if policy < FailFast || policy > Threshold {
+		return errors.New("Unknown failure policy")
+	}
+	if policy == Threshold && (thresholdPercent < 0 || thresholdPercent > 100) {
+		return errors.New("Failure threshold must be between 0-100 percent")
+	}
+	c.failurePolicy = policy
+	c.failureThreshold = thresholdPercent
+	return nil
+}
+
+// tooManyFailures - returns true if failed of total files failing breaks the failure policy
+func (c *CurConvert) tooManyFailures(failed int, total int) bool {
+	switch c.failurePolicy {
+	case BestEffort:
+		return false
+	case Threshold:
+		return total > 0 && float64(failed)*100/float64(total) > c.failureThreshold
+	}
+	return failed > 0
+}
+
+// retry - calls fn until it succeeds, fails with an error that is not transient, the context is cancelled or
+// retryAttempts attempts have failed, returning the last error. Attempts are separated by an exponential backoff with
+// full jitter
+func (c *CurConvert) retry(ctx context.Context, fn func() error) error {
+	delay := c.retryDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= c.retryAttempts || ctx.Err() != nil || isCanceled(err) || !isTransient(err) {
+			return err
+		}
+
+		wait := time.NewTimer(time.Duration(rand.Int63n(int64(delay)) + 1))
+		select {
+		case <-ctx.Done():
+			wait.Stop()
+			return err
+		case <-wait.C:
+		}
+
+		if delay *= 2; delay > c.retryMaxDelay {
+			delay = c.retryMaxDelay
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package curconvert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// timeoutError - a net.Error that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestTooManyFailures(t *testing.T) {
+	tests := []struct {
+		policy    FailurePolicy
+		threshold float64
+		failed    int
+		total     int
+		want      bool
+	}{
+		{policy: FailFast, failed: 0, total: 10, want: false},
+		{policy: FailFast, failed: 1, total: 10, want: true},
+		{policy: BestEffort, failed: 10, total: 10, want: false},
+		{policy: Threshold, threshold: 20, failed: 2, total: 10, want: false},
+		{policy: Threshold, threshold: 20, failed: 3, total: 10, want: true},
+		{policy: Threshold, threshold: 0, failed: 0, total: 10, want: false},
+		{policy: Threshold, threshold: 0, failed: 1, total: 10, want: true},
+		{policy: Threshold, threshold: 0, failed: 0, total: 0, want: false},
+	}
+	for _, tt := range tests {
+		c := NewCurConvert("", "", "", "")
+		if err := c.SetFailurePolicy(tt.policy, tt.threshold); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.tooManyFailures(tt.failed, tt.total); got != tt.want {
+			t.Errorf("policy %d threshold %.0f: tooManyFailures(%d, %d) = %t, want %t",
+				tt.policy, tt.threshold, tt.failed, tt.total, got, tt.want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	permanent := errors.New("permanent")
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "success", errs: []error{nil}, wantCalls: 1},
+		{name: "transient then success", errs: []error{timeoutError{}, io.ErrUnexpectedEOF, nil}, wantCalls: 3},
+		{name: "wrapped transient", errs: []error{&SourceFileError{Err: fmt.Errorf("get: %w", io.ErrUnexpectedEOF)}, nil}, wantCalls: 2},
+		{name: "throttled", errs: []error{awserr.New("SlowDown", "slow down", nil), nil}, wantCalls: 2},
+		{name: "server error", errs: []error{awserr.NewRequestFailure(awserr.New("InternalError", "", nil), 500, "r"), nil}, wantCalls: 2},
+		{name: "changed", errs: []error{ErrChanged, nil}, wantCalls: 2},
+		{name: "precondition failed", errs: []error{awserr.NewRequestFailure(awserr.New("PreconditionFailed", "", nil), 412, "r"), nil}, wantCalls: 2},
+		{name: "attempts exhausted", errs: []error{timeoutError{}, timeoutError{}, timeoutError{}, nil}, wantCalls: 3, wantErr: timeoutError{}},
+		{name: "permanent", errs: []error{permanent, nil}, wantCalls: 1, wantErr: permanent},
+		{name: "not found", errs: []error{awserr.NewRequestFailure(awserr.New("NoSuchKey", "", nil), 404, "r"), nil}, wantCalls: 1},
+		{name: "verify", errs: []error{&VerifyError{}, nil}, wantCalls: 1},
+		{name: "cancelled", errs: []error{context.Canceled, nil}, wantCalls: 1, wantErr: context.Canceled},
+	}
+	for _, tt := range tests {
+		c := NewCurConvert("", "", "", "")
+		if err := c.SetRetry(3, time.Millisecond, 2*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		calls := 0
+		err := c.retry(context.Background(), func() error {
+			err := tt.errs[calls]
+			calls++
+			return err
+		})
+		if calls != tt.wantCalls {
+			t.Errorf("%s: %d calls, want %d", tt.name, calls, tt.wantCalls)
+		}
+		if (err == nil) != (tt.errs[calls-1] == nil) || (tt.wantErr != nil && err != tt.wantErr) {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.errs[calls-1])
+		}
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+	c := NewCurConvert("", "", "", "")
+	if err := c.SetRetry(5, time.Hour, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := c.retry(ctx, func() error {
+		calls++
+		cancel()
+		return timeoutError{}
+	})
+	if calls != 1 || err == nil {
+		t.Errorf("retry after cancel made %d calls, error %v, want 1 call and an error", calls, err)
+	}
+}
+
+// flakyStorage - a LocalStorage whose first failures Gets fail with err
+type flakyStorage struct {
+	*LocalStorage
+	err      error
+	failures int
+	gets     int
+}
+
+func (f *flakyStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if f.gets++; f.gets <= f.failures {
+		return nil, f.err
+	}
+	return f.LocalStorage.Get(ctx, key)
+}
+
+func TestLoadStateRetry(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	local := NewLocalStorage(dir)
+	putObject(t, local, "parquet/202610/"+stateFileName, `{"assemblyId": "a1", "files": {"cur/a1/cur-1.csv.gz": {"etag": "e1"}}}`)
+
+	tests := []struct {
+		name     string
+		err      error
+		wantGets int
+		wantErr  bool
+	}{
+		{name: "transient", err: timeoutError{}, wantGets: 2},
+		{name: "permanent", err: awserr.NewRequestFailure(awserr.New("AccessDenied", "", nil), 403, "r"), wantGets: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		dest := &flakyStorage{LocalStorage: local, err: tt.err, failures: 1}
+		c := NewCurConvert("", "", "", "parquet/202610")
+		c.SetDestStorage(dest)
+		if err := c.SetRetry(3, time.Millisecond, 2*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		err := c.retry(context.Background(), func() error { return c.loadState(context.Background()) })
+		if (err != nil) != tt.wantErr || dest.gets != tt.wantGets {
+			t.Errorf("%s: %d gets, error %v, want %d gets", tt.name, dest.gets, err, tt.wantGets)
+		}
+		if !tt.wantErr && c.prevState.AssemblyID != "a1" {
+			t.Errorf("%s: state not loaded after retry", tt.name)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package curconvert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+)
+
+// schemaFileName - schema registry stored in the parent of the dest path, shared by every month converted into it
+const schemaFileName = "_curconvert_schema.json"
+
+// missingColumn - index of fields that are in the schema registry but not in the CUR being converted, written as null
+const missingColumn = -2
+
+//
+// SchemaColumn - a column of the schema registry, Type is the Athena type
+type SchemaColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+//
+// SchemaRegistry - the union of the columns of every CUR month converted, in the order they were first seen
+type SchemaRegistry struct {
+	Columns []SchemaColumn `json:"columns"`
+}
+
+//
+// SetSchemaRegistry - when enabled the columns of each converted month are merged into a schema registry stored in the
+// parent of the dest path (e.g. parquet-cur/_curconvert_schema.json). Every month is written with all columns of the
+// registry, in registry order, with columns the month does not have written as null. Months converted before a column
+// was first seen include it when next converted. The registry type of a column takes precedence over default and manifest
+// types, a column type over-ride that conflicts with the registry fails the conversion
+func (c *CurConvert) SetSchemaRegistry(enabled bool) {
+	c.schemaRegistry = enabled
+}
+
+// schemaKey - returns the key of the schema registry
+func (c *CurConvert) schemaKey() string {
+	dir := path.Dir(c.destObject)
+	if dir == "." || dir == "/" {
+		return schemaFileName
+	}
+	return dir + "/" + schemaFileName
+}
+
+// loadSchema - reads the schema registry, a missing registry has no columns
+func (c *CurConvert) loadSchema(ctx context.Context) error {
+	c.schema = SchemaRegistry{}
+	c.schemaChanged = false
+
+	dest := c.getDestStorage()
+	body, err := dest.Get(ctx, c.schemaKey())
+	if IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return &UploadError{Bucket: dest.String(), Key: c.schemaKey(), Err: err}
+	}
+	defer body.Close()
+
+	if err := json.NewDecoder(body).Decode(&c.schema); err != nil {
+		return &UploadError{Bucket: dest.String(), Key: c.schemaKey(), Err: err}
+	}
+	return nil
+}
+
+// saveSchema - writes the schema registry if columns were added by this conversion
+func (c *CurConvert) saveSchema(ctx context.Context) error {
+	if !c.schemaRegistry || !c.schemaChanged {
+		return nil
+	}
+
+	dest := c.getDestStorage()
+	b, err := json.MarshalIndent(c.schema, "", "  ")
+	if err != nil {
+		return &UploadError{Bucket: dest.String(), Key: c.schemaKey(), Err: err}
+	}
+	if err := dest.Put(ctx, c.schemaKey(), bytes.NewReader(b)); err != nil {
+		return &UploadError{Bucket: dest.String(), Key: c.schemaKey(), Err: err}
+	}
+	c.schemaChanged = false
+	return nil
+}
+
+// applySchema - merges the typed fields of the CUR with the schema registry. Fields are re-ordered to the registry,
+// given the registry type and registry columns the CUR does not have are added as missing. Columns new to the registry
+// are appended to it. Redacted columns are always STRING, so a different registry type is a conflict
+func (c *CurConvert) applySchema() error {
+	current := make(map[string]curField, len(c.fields)+len(c.mapFields))
+	var order []string
+	for _, f := range append(append([]curField{}, c.fields...), c.mapFields...) {
+		current[f.name] = f
+		order = append(order, f.name)
+	}
+
+	var fields, mapFields []curField
+	add := func(f curField) {
+		if f.athenaType == mapType {
+			mapFields = append(mapFields, f)
+		} else {
+			fields = append(fields, f)
+		}
+	}
+
+	registered := make(map[string]bool, len(c.schema.Columns))
+	for _, col := range c.schema.Columns {
+		registered[col.Name] = true
+		f, ok := current[col.Name]
+		if !ok {
+			add(curField{name: col.Name, athenaType: col.Type, index: missingColumn})
+			continue
+		}
+		if f.athenaType != col.Type {
+			if (f.athenaType == mapType) != (col.Type == mapType) {
+				return fmt.Errorf("column %s is %s but %s in the schema registry", f.name, f.athenaType, col.Type)
+			}
+			if t, override := c.CurColumnTypes[f.name]; override {
+				return fmt.Errorf("column %s type over-ride %s conflicts with %s in the schema registry", f.name, t, col.Type)
+			}
+			if _, redacted := c.redactedCols[f.index]; redacted {
+				return fmt.Errorf("column %s is redacted so written as STRING, which conflicts with %s in the schema registry", f.name, col.Type)
+			}
+			f.athenaType = col.Type
+		}
+		add(f)
+	}
+
+	for _, name := range order {
+		if registered[name] {
+			continue
+		}
+		f := current[name]
+		c.schema.Columns = append(c.schema.Columns, SchemaColumn{Name: f.name, Type: f.athenaType})
+		c.schemaChanged = true
+		add(f)
+	}
+
+	c.fields = fields
+	c.mapFields = mapFields
+	return nil
+}
@@ -0,0 +1,180 @@
+package curconvert
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplySchema(t *testing.T) {
+	fields := []curField{
+		{name: "lineitem/usagestartdate", athenaType: "TIMESTAMP", index: 0},
+		{name: "lineitem/usageaccountid", athenaType: "STRING", index: 1},
+		{name: "lineitem/unblendedcost", athenaType: "DOUBLE", index: 2},
+	}
+	mapFields := []curField{{name: "resource_tags", athenaType: mapType, index: 3}}
+
+	tests := []struct {
+		name          string
+		schema        []SchemaColumn
+		overrides     map[string]string
+		redacted      []int
+		wantFields    []curField
+		wantMapFields []curField
+		wantSchema    []SchemaColumn
+		wantChanged   bool
+		wantErr       bool
+	}{
+		{
+			name:          "empty registry",
+			wantFields:    fields,
+			wantMapFields: mapFields,
+			wantSchema: []SchemaColumn{
+				{Name: "lineitem/usagestartdate", Type: "TIMESTAMP"},
+				{Name: "lineitem/usageaccountid", Type: "STRING"},
+				{Name: "lineitem/unblendedcost", Type: "DOUBLE"},
+				{Name: "resource_tags", Type: mapType},
+			},
+			wantChanged: true,
+		},
+		{
+			name: "registry order and missing columns",
+			schema: []SchemaColumn{
+				{Name: "lineitem/unblendedcost", Type: "DOUBLE"},
+				{Name: "lineitem/blendedcost", Type: "DOUBLE"},
+				{Name: "resource_tags", Type: mapType},
+				{Name: "lineitem/usageaccountid", Type: "STRING"},
+				{Name: "lineitem/usagestartdate", Type: "TIMESTAMP"},
+			},
+			wantFields: []curField{
+				{name: "lineitem/unblendedcost", athenaType: "DOUBLE", index: 2},
+				{name: "lineitem/blendedcost", athenaType: "DOUBLE", index: missingColumn},
+				{name: "lineitem/usageaccountid", athenaType: "STRING", index: 1},
+				{name: "lineitem/usagestartdate", athenaType: "TIMESTAMP", index: 0},
+			},
+			wantMapFields: mapFields,
+			wantSchema: []SchemaColumn{
+				{Name: "lineitem/unblendedcost", Type: "DOUBLE"},
+				{Name: "lineitem/blendedcost", Type: "DOUBLE"},
+				{Name: "resource_tags", Type: mapType},
+				{Name: "lineitem/usageaccountid", Type: "STRING"},
+				{Name: "lineitem/usagestartdate", Type: "TIMESTAMP"},
+			},
+		},
+		{
+			name: "new columns appended",
+			schema: []SchemaColumn{
+				{Name: "lineitem/usageaccountid", Type: "STRING"},
+				{Name: "resource_tags", Type: mapType},
+			},
+			wantFields: []curField{
+				{name: "lineitem/usageaccountid", athenaType: "STRING", index: 1},
+				{name: "lineitem/usagestartdate", athenaType: "TIMESTAMP", index: 0},
+				{name: "lineitem/unblendedcost", athenaType: "DOUBLE", index: 2},
+			},
+			wantMapFields: mapFields,
+			wantSchema: []SchemaColumn{
+				{Name: "lineitem/usageaccountid", Type: "STRING"},
+				{Name: "resource_tags", Type: mapType},
+				{Name: "lineitem/usagestartdate", Type: "TIMESTAMP"},
+				{Name: "lineitem/unblendedcost", Type: "DOUBLE"},
+			},
+			wantChanged: true,
+		},
+		{
+			name: "registry type takes precedence",
+			schema: []SchemaColumn{
+				{Name: "lineitem/usagestartdate", Type: "STRING"},
+				{Name: "lineitem/usageaccountid", Type: "STRING"},
+				{Name: "lineitem/unblendedcost", Type: "DOUBLE"},
+				{Name: "resource_tags", Type: mapType},
+			},
+			wantFields: []curField{
+				{name: "lineitem/usagestartdate", athenaType: "STRING", index: 0},
+				{name: "lineitem/usageaccountid", athenaType: "STRING", index: 1},
+				{name: "lineitem/unblendedcost", athenaType: "DOUBLE", index: 2},
+			},
+			wantMapFields: mapFields,
+			wantSchema: []SchemaColumn{
+				{Name: "lineitem/usagestartdate", Type: "STRING"},
+				{Name: "lineitem/usageaccountid", Type: "STRING"},
+				{Name: "lineitem/unblendedcost", Type: "DOUBLE"},
+				{Name: "resource_tags", Type: mapType},
+			},
+		},
+		{
+			name:    "map conflict",
+			schema:  []SchemaColumn{{Name: "resource_tags", Type: "STRING"}},
+			wantErr: true,
+		},
+		{
+			name:      "type over-ride conflict",
+			schema:    []SchemaColumn{{Name: "lineitem/unblendedcost", Type: "STRING"}},
+			overrides: map[string]string{"lineitem/unblendedcost": "DOUBLE"},
+			wantErr:   true,
+		},
+		{
+			name:     "redacted conflict",
+			schema:   []SchemaColumn{{Name: "lineitem/usageaccountid", Type: "BIGINT"}},
+			redacted: []int{1},
+			wantErr:  true,
+		},
+		{
+			name: "default type follows registry",
+			schema: []SchemaColumn{
+				{Name: "lineitem/usagestartdate", Type: "TIMESTAMP"},
+				{Name: "lineitem/usageaccountid", Type: "STRING"},
+				{Name: "lineitem/unblendedcost", Type: "STRING"},
+				{Name: "resource_tags", Type: mapType},
+			},
+			wantFields: []curField{
+				{name: "lineitem/usagestartdate", athenaType: "TIMESTAMP", index: 0},
+				{name: "lineitem/usageaccountid", athenaType: "STRING", index: 1},
+				{name: "lineitem/unblendedcost", athenaType: "STRING", index: 2},
+			},
+			wantMapFields: mapFields,
+			wantSchema: []SchemaColumn{
+				{Name: "lineitem/usagestartdate", Type: "TIMESTAMP"},
+				{Name: "lineitem/usageaccountid", Type: "STRING"},
+				{Name: "lineitem/unblendedcost", Type: "STRING"},
+				{Name: "resource_tags", Type: mapType},
+			},
+		},
+	}
+	for _, tt := range tests {
+		c := NewCurConvert("", "", "", "")
+		c.fields = append([]curField{}, fields...)
+		c.mapFields = append([]curField{}, mapFields...)
+		c.schema = SchemaRegistry{Columns: append([]SchemaColumn{}, tt.schema...)}
+		if tt.overrides != nil {
+			c.CurColumnTypes = tt.overrides
+		}
+		c.redactedCols = make(map[int]redaction)
+		for _, index := range tt.redacted {
+			c.redactedCols[index] = redaction{RedactionRule: RedactionRule{Action: redactHash}}
+		}
+
+		err := c.applySchema()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(c.fields, tt.wantFields) {
+			t.Errorf("%s: fields %+v, want %+v", tt.name, c.fields, tt.wantFields)
+		}
+		if !reflect.DeepEqual(c.mapFields, tt.wantMapFields) {
+			t.Errorf("%s: map fields %+v, want %+v", tt.name, c.mapFields, tt.wantMapFields)
+		}
+		if !reflect.DeepEqual(c.schema.Columns, tt.wantSchema) {
+			t.Errorf("%s: schema %+v, want %+v", tt.name, c.schema.Columns, tt.wantSchema)
+		}
+		if c.schemaChanged != tt.wantChanged {
+			t.Errorf("%s: schema changed %t, want %t", tt.name, c.schemaChanged, tt.wantChanged)
+		}
+	}
+}
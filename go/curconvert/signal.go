@@ -0,0 +1,26 @@
+package curconvert
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+//
+// SignalContext - returns a context that is cancelled on SIGINT or SIGTERM, so that a conversion run with
+// ConvertCurContext stops and removes partial files. The returned func must be called to stop watching for signals
+func SignalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs)
+	}()
+	return ctx, cancel
+}
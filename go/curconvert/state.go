@@ -0,0 +1,175 @@
+package curconvert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// stateFileName - conversion state is stored alongside the parquet output, the leading '_' stops Athena reading it as data
+const stateFileName = "_curconvert_state.json"
+
+//
+// ConvertState - record of a previous conversion of a CUR month, used to skip CUR files that have not changed
+type ConvertState struct {
+	AssemblyID string               `json:"assemblyId"`
+	Columns    []string             `json:"columns"`
+	Filters    []string             `json:"filters,omitempty"`
+	Partitions []string             `json:"partitions,omitempty"`
+	Redactions []string             `json:"redactions,omitempty"`
+	Files      map[string]FileState `json:"files"`
+}
+
+//
+// FileState - conversion details of a single CUR file, keyed in ConvertState by the source object key.
+// A CUR file has an output key per partition it contains
+type FileState struct {
+	ETag       string   `json:"etag"`
+	OutputKeys []string `json:"outputKeys"`
+	Rows       int64    `json:"rows"`
+}
+
+//
+// ConvertStats - number of CUR files and rows of the last conversion, including files skipped as unchanged
+type ConvertStats struct {
+	Files int
+	Rows  int64
+}
+
+//
+// GetConvertStats - returns the number of CUR files of the month and the rows converted from them by the last ConvertCur.
+// Failed files are not counted
+func (c *CurConvert) GetConvertStats() ConvertStats {
+	c.filesLock.Lock()
+	defer c.filesLock.Unlock()
+
+	stats := ConvertStats{Files: len(c.CurFiles)}
+	for _, fs := range c.state.Files {
+		stats.Rows += fs.Rows
+	}
+	return stats
+}
+
+// newFileState - returns the state of a CUR file converted into outputs
+func newFileState(etag string, outputs []*parquetOutput) FileState {
+	fs := FileState{ETag: etag}
+	for _, out := range outputs {
+		fs.OutputKeys = append(fs.OutputKeys, out.destKey)
+		fs.Rows += out.rows
+	}
+	return fs
+}
+
+// loadState - reads the state of the previous conversion from the dest path. A missing state file is treated as no
+// previous conversion, which results in every file being converted. Any other failure to read the state is returned,
+// rather than converting every file again
+func (c *CurConvert) loadState(ctx context.Context) error {
+	c.prevState = ConvertState{Files: make(map[string]FileState)}
+	c.state = ConvertState{
+		AssemblyID: c.assemblyID,
+		Columns:    c.stateColumns(),
+		Filters:    c.filterExprs(),
+		Partitions: c.partitions,
+		Redactions: c.redactionExprs(),
+		Files:      make(map[string]FileState),
+	}
+
+	dest := c.getDestStorage()
+	stateObject := c.stateKey()
+	body, err := dest.Get(ctx, stateObject)
+	if IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download conversion state, bucket: %s, object: %s, error: %w", dest, stateObject, err)
+	}
+	defer body.Close()
+
+	var prev ConvertState
+	if err := json.NewDecoder(body).Decode(&prev); err != nil {
+		return fmt.Errorf("failed to parse conversion state, bucket: %s, object: %s, error: %w", dest, stateObject, err)
+	}
+	if prev.Files != nil {
+		c.prevState = prev
+	}
+	return nil
+}
+
+// saveState - writes the state of the current conversion to the dest path
+func (c *CurConvert) saveState(ctx context.Context) error {
+	dest := c.getDestStorage()
+	stateObject := c.stateKey()
+
+	b, err := json.Marshal(c.state)
+	if err != nil {
+		return &UploadError{Bucket: dest.String(), Key: stateObject, Err: err}
+	}
+	if err := dest.Put(ctx, stateObject, bytes.NewReader(b)); err != nil {
+		return &UploadError{Bucket: dest.String(), Key: stateObject, Err: err}
+	}
+	return nil
+}
+
+// setFileState - records the conversion of a CUR file, safe for concurrent use
+func (c *CurConvert) setFileState(curObject string, fs FileState) {
+	c.filesLock.Lock()
+	c.state.Files[curObject] = fs
+	c.filesLock.Unlock()
+}
+
+// unchanged - returns the previous state of curObject if it was converted as part of the same CUR assembly, its
+// ETag has not changed since and all of its parquet output still exists under the current output prefix
+func (c *CurConvert) unchanged(ctx context.Context, curObject string, etag string) (FileState, bool) {
+	if c.force || len(c.assemblyID) < 1 || c.prevState.AssemblyID != c.assemblyID {
+		return FileState{}, false
+	}
+
+	// output columns, filtering, redaction and layout must match too
+	if !sameStrings(c.prevState.Columns, c.state.Columns) || !sameStrings(c.prevState.Filters, c.state.Filters) ||
+		!sameStrings(c.prevState.Partitions, c.state.Partitions) || !sameStrings(c.prevState.Redactions, c.state.Redactions) {
+		return FileState{}, false
+	}
+
+	prev, ok := c.prevState.Files[curObject]
+	if !ok || len(etag) < 1 || prev.ETag != etag || len(prev.OutputKeys) < 1 {
+		return FileState{}, false
+	}
+
+	// output of another version folder is not part of this conversion's output
+	for _, key := range prev.OutputKeys {
+		if !strings.HasPrefix(key, c.outputPrefix()+"/") {
+			return FileState{}, false
+		}
+	}
+
+	for _, key := range prev.OutputKeys {
+		if _, err := c.getDestStorage().Stat(ctx, key); err != nil {
+			return FileState{}, false
+		}
+	}
+	return prev, true
+}
+
+// stateColumns - returns the parquet metadata of every output column
+func (c *CurConvert) stateColumns() []string {
+	columns := append([]string{}, c.CurColumns...)
+	for _, f := range c.mapFields {
+		columns = append(columns, mapMetadata(f))
+	}
+	return columns
+}
+
+// sameStrings - returns true if a and b hold the same strings in the same order
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+package curconvert
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// failingStorage - a LocalStorage whose Gets fail with err
+type failingStorage struct {
+	*LocalStorage
+	err error
+}
+
+func (f *failingStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return nil, f.err
+}
+
+func TestLoadState(t *testing.T) {
+	saved := ConvertState{AssemblyID: "a1", Files: map[string]FileState{"cur/a1/cur-1.csv.gz": {ETag: "e1", OutputKeys: []string{"parquet/202610/cur-1.parquet"}}}}
+	tests := []struct {
+		name    string
+		state   string
+		getErr  error
+		want    ConvertState
+		wantErr bool
+	}{
+		{name: "no previous conversion", want: ConvertState{Files: map[string]FileState{}}},
+		{
+			name:  "previous conversion",
+			state: `{"assemblyId":"a1","files":{"cur/a1/cur-1.csv.gz":{"etag":"e1","outputKeys":["parquet/202610/cur-1.parquet"]}}}`,
+			want:  saved,
+		},
+		{name: "no files", state: `{"assemblyId":"a1"}`, want: ConvertState{Files: map[string]FileState{}}},
+		{name: "corrupt", state: `{"assemblyId":`, wantErr: true},
+		{name: "unreadable", getErr: errors.New("AccessDenied"), wantErr: true},
+	}
+	for _, tt := range tests {
+		func() {
+			dir, cleanup := testDir(t)
+			defer cleanup()
+
+			dest := NewLocalStorage(dir)
+			c := NewCurConvert("", "cur/cur-Manifest.json", "", "parquet/202610")
+			c.SetDestStorage(dest)
+			if tt.getErr != nil {
+				c.SetDestStorage(&failingStorage{LocalStorage: dest, err: tt.getErr})
+			}
+			if len(tt.state) > 0 {
+				putObject(t, dest, "parquet/202610/"+stateFileName, tt.state)
+			}
+
+			err := c.loadState(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%s: error %v, want error %t", tt.name, err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(c.prevState, tt.want) {
+				t.Errorf("%s: previous state %+v, want %+v", tt.name, c.prevState, tt.want)
+			}
+		}()
+	}
+}
+
+func TestSaveState(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	c := NewCurConvert("", "cur/cur-Manifest.json", "", "parquet/202610")
+	c.SetDestStorage(NewLocalStorage(dir))
+	c.assemblyID = "a1"
+	if err := c.loadState(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.setFileState("cur/a1/cur-1.csv.gz", FileState{ETag: "e1", OutputKeys: []string{"parquet/202610/cur-1.parquet"}, Rows: 10})
+	if err := c.saveState(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.loadState(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]FileState{"cur/a1/cur-1.csv.gz": {ETag: "e1", OutputKeys: []string{"parquet/202610/cur-1.parquet"}, Rows: 10}}
+	if c.prevState.AssemblyID != "a1" || !reflect.DeepEqual(c.prevState.Files, want) {
+		t.Errorf("saved state %+v, want assembly a1 and files %+v", c.prevState, want)
+	}
+}
+
+func TestUnchanged(t *testing.T) {
+	const (
+		curObject = "cur/a1/cur-1.csv.gz"
+		output    = "parquet/202610/cur-1.parquet"
+	)
+	tests := []struct {
+		name       string
+		assembly   string
+		prev       ConvertState
+		etag       string
+		noOutput   bool
+		force      bool
+		wantResult bool
+	}{
+		{name: "unchanged", assembly: "a1", prev: ConvertState{AssemblyID: "a1", Files: map[string]FileState{curObject: {ETag: "e1", OutputKeys: []string{output}}}}, etag: "e1", wantResult: true},
+		{name: "changed", assembly: "a1", prev: ConvertState{AssemblyID: "a1", Files: map[string]FileState{curObject: {ETag: "e0", OutputKeys: []string{output}}}}, etag: "e1"},
+		{name: "new assembly", assembly: "a2", prev: ConvertState{AssemblyID: "a1", Files: map[string]FileState{curObject: {ETag: "e1", OutputKeys: []string{output}}}}, etag: "e1"},
+		{name: "no assembly", prev: ConvertState{Files: map[string]FileState{curObject: {ETag: "e1", OutputKeys: []string{output}}}}, etag: "e1"},
+		{name: "not converted", assembly: "a1", prev: ConvertState{AssemblyID: "a1", Files: map[string]FileState{}}, etag: "e1"},
+		{name: "no etag", assembly: "a1", prev: ConvertState{AssemblyID: "a1", Files: map[string]FileState{curObject: {OutputKeys: []string{output}}}}},
+		{name: "output removed", assembly: "a1", prev: ConvertState{AssemblyID: "a1", Files: map[string]FileState{curObject: {ETag: "e1", OutputKeys: []string{output}}}}, etag: "e1", noOutput: true},
+		{name: "partitioning changed", assembly: "a1", prev: ConvertState{AssemblyID: "a1", Partitions: []string{"product/region"}, Files: map[string]FileState{curObject: {ETag: "e1", OutputKeys: []string{output}}}}, etag: "e1"},
+		{name: "forced", assembly: "a1", prev: ConvertState{AssemblyID: "a1", Files: map[string]FileState{curObject: {ETag: "e1", OutputKeys: []string{output}}}}, etag: "e1", force: true},
+	}
+	for _, tt := range tests {
+		func() {
+			dir, cleanup := testDir(t)
+			defer cleanup()
+
+			dest := NewLocalStorage(dir)
+			if !tt.noOutput {
+				putObject(t, dest, output, "parquet")
+			}
+			c := NewCurConvert("", "cur/cur-Manifest.json", "", "parquet/202610")
+			c.SetDestStorage(dest)
+			c.SetForce(tt.force)
+			c.assemblyID = tt.assembly
+			c.prevState = tt.prev
+
+			if _, got := c.unchanged(context.Background(), curObject, tt.etag); got != tt.wantResult {
+				t.Errorf("%s: unchanged %t, want %t", tt.name, got, tt.wantResult)
+			}
+		}()
+	}
+}
@@ -0,0 +1,284 @@
+package curconvert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+//
+// ObjectInfo - details of a single object held within a Storage backend
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
+
+//
+// Storage - abstracts the location CUR files are read from and converted parquet files are written to.
+// Keys are always '/' separated regardless of the backend.
+type Storage interface {
+	// Get - opens an object for reading, caller must close the returned reader
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Download - copies an object into w
+	Download(ctx context.Context, key string, w io.WriterAt) error
+	// Put - writes the content of r to key, replacing any existing object
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Stat - returns object details, IsNotExist(err) is true when the key does not exist
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// List - returns all objects whose key starts with prefix
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// Delete - removes the given keys
+	Delete(ctx context.Context, keys []string) error
+	// String - describes the storage location, used in errors and output
+	String() string
+}
+
+//
+// RangeStorage - a Storage that can read a byte range of an object, allowing interrupted downloads to be resumed
+type RangeStorage interface {
+	Storage
+	// GetRange - opens length bytes of an object from offset for reading, caller must close the returned reader. When
+	// etag is set the read fails, with IsChanged(err) true, unless the object still has that ETag
+	GetRange(ctx context.Context, key string, offset int64, length int64, etag string) (io.ReadCloser, error)
+}
+
+//
+// ErrChanged - returned by RangeStorage.GetRange when the object no longer has the requested ETag
+var ErrChanged = errors.New("object has changed")
+
+//
+// IsChanged - returns true if err, or the error it wraps, indicates the object was replaced since its ETag was read
+func IsChanged(err error) bool {
+	for err != nil {
+		if err == ErrChanged {
+			return true
+		}
+		if aerr, ok := err.(awserr.Error); ok {
+			return aerr.Code() == "PreconditionFailed"
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = u.Unwrap()
+	}
+	return false
+}
+
+//
+// NewStorage - returns a Storage for the given location. Locations prefixed with file:// are treated as local
+// directories, anything else (optionally prefixed with s3://) is treated as a S3 bucket name
+func NewStorage(location string, arn string, externalID string) Storage {
+	if strings.HasPrefix(location, "file://") {
+		return NewLocalStorage(strings.TrimPrefix(location, "file://"))
+	}
+	return NewS3Storage(strings.TrimPrefix(location, "s3://"), arn, externalID)
+}
+
+//
+// IsNotExist - returns true if err, or the error it wraps, indicates the requested object does not exist, regardless
+// of the Storage backend
+func IsNotExist(err error) bool {
+	for err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			return aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound"
+		}
+		if os.IsNotExist(err) {
+			return true
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = u.Unwrap()
+	}
+	return false
+}
+
+//
+// LocalStorage - Storage backed by a local (or network mounted) directory
+type LocalStorage struct {
+	root string
+}
+
+//
+// NewLocalStorage - Init struct, root is the directory keys are relative too
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{root: root}
+}
+
+func (l *LocalStorage) path(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(key))
+}
+
+//
+// String - returns the file:// URL of the storage root
+func (l *LocalStorage) String() string {
+	return "file://" + l.root
+}
+
+//
+// Get - opens the file for key
+func (l *LocalStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(l.path(key))
+}
+
+//
+// Download - copies the file for key into w
+func (l *LocalStorage) Download(ctx context.Context, key string, w io.WriterAt) error {
+	file, err := os.Open(l.path(key))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return copyAt(ctx, w, file)
+}
+
+// copyAt - copies r into w from offset 0, stopping when ctx is cancelled
+func copyAt(ctx context.Context, w io.WriterAt, r io.Reader) error {
+	_, err := copyAtOffset(ctx, w, r, 0)
+	return err
+}
+
+// copyAtOffset - copies r into w from offset, stopping when ctx is cancelled. Returns the number of bytes copied
+func copyAtOffset(ctx context.Context, w io.WriterAt, r io.Reader, offset int64) (int64, error) {
+	buff := make([]byte, 1024*1024)
+	var copied int64
+	for {
+		n, err := r.Read(buff)
+		if n > 0 {
+			if _, werr := w.WriteAt(buff[:n], offset+copied); werr != nil {
+				return copied, werr
+			}
+			copied += int64(n)
+		}
+		if err == io.EOF {
+			return copied, nil
+		}
+		if err != nil {
+			return copied, err
+		}
+		if ctx.Err() != nil {
+			return copied, ctx.Err()
+		}
+	}
+}
+
+//
+// Put - writes r into the file for key. Data is written to a hidden temp file in the same directory first and renamed,
+// so readers never see partial files and concurrent Puts of the same key do not collide
+func (l *LocalStorage) Put(ctx context.Context, key string, r io.Reader) error {
+	dest := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+"-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, &ctxReader{ctx: ctx, r: r}); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := os.Rename(file.Name(), dest); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
+
+// ctxReader - reader that fails with the context error once ctx is cancelled, so long copies can be interrupted
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+//
+// Stat - returns details of the file for key. The ETag is derived from modification time and size
+func (l *LocalStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	fi, err := os.Stat(l.path(key))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		ETag:         fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size()),
+		LastModified: fi.ModTime(),
+	}, nil
+}
+
+//
+// List - walks the directory containing prefix and returns every file whose key starts with prefix. Hidden files, such
+// as the temp files of an in-progress Put, are not listed
+func (l *LocalStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	dir := l.path(path.Dir(prefix))
+	if strings.HasSuffix(prefix, "/") {
+		dir = l.path(prefix)
+	}
+
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		objects = append(objects, ObjectInfo{
+			Key:          key,
+			Size:         fi.Size(),
+			ETag:         fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size()),
+			LastModified: fi.ModTime(),
+		})
+		return nil
+	})
+	return objects, err
+}
+
+//
+// Delete - removes the files for the given keys, keys that do not exist are ignored
+func (l *LocalStorage) Delete(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		if err := os.Remove(l.path(key)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
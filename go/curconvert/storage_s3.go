@@ -0,0 +1,493 @@
+package curconvert
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3crypto"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+//
+// S3Options - connection options for S3 compatible services such as MinIO or Ceph.
+// When Endpoint is set the bucket location lookup is skipped and Region (default us-east-1) is used
+type S3Options struct {
+	Endpoint           string
+	Region             string
+	ForcePathStyle     bool
+	DisableSSL         bool
+	InsecureSkipVerify bool
+}
+
+// server-side encryption modes of SSEOptions
+const (
+	SSES3  = s3.ServerSideEncryptionAes256
+	SSEKMS = s3.ServerSideEncryptionAwsKms
+)
+
+//
+// SSEOptions - server-side encryption of uploaded objects, which Athena reads transparently. Mode is SSES3 or SSEKMS,
+// KMSKeyID is the KMS key of SSEKMS (default the account's aws/s3 key) and BucketKey enables S3 Bucket Keys, reducing
+// KMS requests. An empty Mode uses the default encryption of the bucket
+type SSEOptions struct {
+	Mode      string
+	KMSKeyID  string
+	BucketKey bool
+}
+
+// sseModes - names accepted by ParseSSEMode
+var sseModes = map[string]string{
+	"":        "",
+	"none":    "",
+	"sse-s3":  SSES3,
+	"aes256":  SSES3,
+	"sse-kms": SSEKMS,
+	"aws:kms": SSEKMS,
+}
+
+//
+// ParseSSEMode - returns the SSEOptions mode named none, sse-s3 or sse-kms
+func ParseSSEMode(name string) (string, error) {
+	if mode, ok := sseModes[strings.ToLower(strings.TrimSpace(name))]; ok {
+		return mode, nil
+	}
+	return "", fmt.Errorf("Unknown server-side encryption %s, must be one of none, sse-s3 or sse-kms", name)
+}
+
+// validate - checks the key options are only given with SSE-KMS
+func (o SSEOptions) validate() error {
+	switch o.Mode {
+	case "", SSES3, SSEKMS:
+	default:
+		return fmt.Errorf("Unknown server-side encryption mode %s", o.Mode)
+	}
+	if o.Mode != SSEKMS && (len(o.KMSKeyID) > 0 || o.BucketKey) {
+		return errors.New("A KMS key and bucket key can only be used with SSE-KMS")
+	}
+	return nil
+}
+
+//
+// S3Storage - Storage backed by a S3 bucket, optionally accessed via an assumed role
+type S3Storage struct {
+	bucket     string
+	arn        string
+	externalID string
+	kmsKey     string
+	sse        SSEOptions
+	decrypt    bool
+	opts       S3Options
+
+	partSize        int64
+	partConcurrency int
+
+	lock sync.Mutex
+	sess *session.Session
+}
+
+//
+// NewS3Storage - Init struct, arn and externalID are optional and used to assume a role for all bucket access
+func NewS3Storage(bucket string, arn string, externalID string) *S3Storage {
+	return &S3Storage{bucket: bucket, arn: arn, externalID: externalID}
+}
+
+//
+// SetKMSKey - sets the KMS Master key arn used to client-side encrypt objects on Put
+func (s *S3Storage) SetKMSKey(key string) {
+	s.kmsKey = key
+}
+
+//
+// SetSSE - sets the server-side encryption requested for objects written by Put
+func (s *S3Storage) SetSSE(sse SSEOptions) error {
+	if err := sse.validate(); err != nil {
+		return err
+	}
+	s.sse = sse
+	return nil
+}
+
+//
+// SetDecryption - when enabled objects are read with the s3crypto decryption client, for objects client-side encrypted
+// with KMS (e.g. by SetKMSKey). Downloads are then a single GET rather than concurrent ranged GETs
+func (s *S3Storage) SetDecryption(enabled bool) {
+	s.decrypt = enabled
+}
+
+//
+// SetDownloadOptions - sets the part size and number of concurrent ranged GETs of Download, zero values keep the
+// s3manager defaults
+func (s *S3Storage) SetDownloadOptions(partSize int64, concurrency int) {
+	s.partSize = partSize
+	s.partConcurrency = concurrency
+}
+
+//
+// SetOptions - sets endpoint, addressing and TLS options. A session created with the previous options is discarded, so
+// the options apply to the next request
+func (s *S3Storage) SetOptions(opts S3Options) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.opts = opts
+	s.sess = nil
+}
+
+//
+// String - returns the s3:// URL of the bucket
+func (s *S3Storage) String() string {
+	return "s3://" + s.bucket
+}
+
+func getCreds(arn string, externalID string, sess *session.Session) *credentials.Credentials {
+	if len(arn) < 1 {
+		return nil
+	}
+	if len(externalID) > 0 {
+		return stscreds.NewCredentials(sess, arn, func(p *stscreds.AssumeRoleProvider) {
+			p.ExternalID = &externalID
+		})
+	}
+	return stscreds.NewCredentials(sess, arn, func(p *stscreds.AssumeRoleProvider) {})
+}
+
+func getBucketLocation(bucket string, arn string, externalID string) (string, error) {
+
+	// Init Session
+	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-east-1")})
+	if err != nil {
+		return "", err
+	}
+
+	// if needed set creds for AssumeRole and reset session
+	if len(arn) > 0 {
+		sess = sess.Copy(&aws.Config{Credentials: getCreds(arn, externalID, sess)})
+	}
+
+	// Get Bucket location
+	svc := s3.New(sess)
+	res, err := svc.GetBucketLocation(&s3.GetBucketLocationInput{
+		Bucket: aws.String(bucket),
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	// empty string returned for buckets existing in us-east-1! https://docs.aws.amazon.com/AmazonS3/latest/API/RESTBucketGETlocation.html
+	if res.LocationConstraint == nil || len(*res.LocationConstraint) < 1 {
+		return "us-east-1", nil
+	}
+	return *res.LocationConstraint, nil
+}
+
+// getSession - returns a session in the region of the bucket, the session is created once and re-used until the options
+// change
+func (s *S3Storage) getSession() (*session.Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.sess != nil {
+		return s.sess, nil
+	}
+
+	// get location of bucket, custom endpoints do not support (or need) the lookup
+	var bucketLocation string
+	if len(s.opts.Endpoint) > 0 {
+		bucketLocation = s.opts.Region
+		if len(bucketLocation) < 1 {
+			bucketLocation = "us-east-1"
+		}
+	} else {
+		var err error
+		bucketLocation, err = getBucketLocation(s.bucket, s.arn, s.externalID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Init Session
+	sess, err := session.NewSession(s.sessionConfig(bucketLocation))
+	if err != nil {
+		return nil, err
+	}
+
+	// if needed set creds for AssumeRole and reset session
+	if len(s.arn) > 0 {
+		sess = sess.Copy(&aws.Config{Credentials: getCreds(s.arn, s.externalID, sess)})
+	}
+
+	s.sess = sess
+	return sess, nil
+}
+
+// sessionConfig - returns the session config for the bucket in region, applying the endpoint, addressing and TLS options
+func (s *S3Storage) sessionConfig(region string) *aws.Config {
+	config := &aws.Config{Region: aws.String(region), DisableRestProtocolURICleaning: aws.Bool(true)}
+	if len(s.opts.Endpoint) > 0 {
+		config.Endpoint = aws.String(s.opts.Endpoint)
+	}
+	if s.opts.ForcePathStyle {
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	if s.opts.DisableSSL {
+		config.DisableSSL = aws.Bool(true)
+	}
+	if s.opts.InsecureSkipVerify {
+		config.HTTPClient = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+	}
+	return config
+}
+
+//
+// Get - opens the object for reading
+func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	sess, err := s.getSession()
+	if err != nil {
+		return nil, err
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	var res *s3.GetObjectOutput
+	if s.decrypt {
+		client, cerr := newDecryptionClient(sess)
+		if cerr != nil {
+			return nil, cerr
+		}
+		res, err = client.GetObjectWithContext(ctx, input)
+	} else {
+		res, err = s3.New(sess).GetObjectWithContext(ctx, input)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+//
+// Download - downloads the object into w using concurrent ranged GETs, or a single decrypted GET when decrypting
+func (s *S3Storage) Download(ctx context.Context, key string, w io.WriterAt) error {
+	if s.decrypt {
+		body, err := s.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		return copyAt(ctx, w, body)
+	}
+
+	sess, err := s.getSession()
+	if err != nil {
+		return err
+	}
+
+	downloader := s3manager.NewDownloader(sess, func(d *s3manager.Downloader) {
+		if s.partSize > 0 {
+			d.PartSize = s.partSize
+		}
+		if s.partConcurrency > 0 {
+			d.Concurrency = s.partConcurrency
+		}
+	})
+	_, err = downloader.DownloadWithContext(ctx, w,
+		&s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+	return err
+}
+
+//
+// GetRange - opens length bytes of the object from offset with a ranged GET, conditional on etag when set. Client-side
+// encrypted objects cannot be read by range, so fails when decrypting
+func (s *S3Storage) GetRange(ctx context.Context, key string, offset int64, length int64, etag string) (io.ReadCloser, error) {
+	if s.decrypt {
+		return nil, errors.New("ranged reads are not supported when decrypting")
+	}
+
+	sess, err := s.getSession()
+	if err != nil {
+		return nil, err
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	}
+	if len(etag) > 0 {
+		input.IfMatch = aws.String(etag)
+	}
+	res, err := s3.New(sess).GetObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+//
+// Put - uploads r to key, client-side encrypting with the configured KMS key if set, otherwise requesting the
+// configured server-side encryption
+func (s *S3Storage) Put(ctx context.Context, key string, r io.Reader) error {
+	sess, err := s.getSession()
+	if err != nil {
+		return err
+	}
+
+	if len(s.kmsKey) > 0 {
+		return s.putEncrypted(ctx, sess, key, r)
+	}
+
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   r,
+	}
+	if len(s.sse.Mode) > 0 {
+		input.ServerSideEncryption = aws.String(s.sse.Mode)
+	}
+	if len(s.sse.KMSKeyID) > 0 {
+		input.SSEKMSKeyId = aws.String(s.sse.KMSKeyID)
+	}
+	if s.sse.BucketKey {
+		input.BucketKeyEnabled = aws.Bool(true)
+	}
+	_, err = s3manager.NewUploader(sess).UploadWithContext(ctx, input)
+	return err
+}
+
+func (s *S3Storage) putEncrypted(ctx context.Context, sess *session.Session, key string, r io.Reader) error {
+
+	body, ok := r.(io.ReadSeeker)
+	if !ok {
+		return errors.New("client-side encrypted uploads require a seekable body")
+	}
+
+	// init crypto lib
+	handler := s3crypto.NewKMSKeyGenerator(kms.New(sess), s.kmsKey)
+	encryptionClient := s3crypto.NewEncryptionClient(sess, s3crypto.AESGCMContentCipherBuilder(handler))
+
+	req, _ := encryptionClient.PutObjectRequest(&s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	})
+	req.SetContext(ctx)
+
+	return req.Send()
+}
+
+// newDecryptionClient - returns a s3crypto V2 decryption client for objects encrypted with any KMS key, both with the
+// "kms" key wrap written by SetKMSKey and the "kms+context" key wrap of V2 encryption clients
+func newDecryptionClient(sess *session.Session) (*s3crypto.DecryptionClientV2, error) {
+	registry := s3crypto.NewCryptoRegistry()
+	if err := s3crypto.RegisterAESGCMContentCipher(registry); err != nil {
+		return nil, err
+	}
+	if err := s3crypto.RegisterKMSWrapWithAnyCMK(registry, kms.New(sess)); err != nil {
+		return nil, err
+	}
+	if err := s3crypto.RegisterKMSContextWrapWithAnyCMK(registry, kms.New(sess)); err != nil {
+		return nil, err
+	}
+	return s3crypto.NewDecryptionClientV2(sess, registry)
+}
+
+//
+// Stat - returns object details via a HEAD request
+func (s *S3Storage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	sess, err := s.getSession()
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	res, err := s3.New(sess).HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(res.ContentLength),
+		ETag:         strings.Trim(aws.StringValue(res.ETag), "\""),
+		LastModified: aws.TimeValue(res.LastModified),
+	}, nil
+}
+
+//
+// List - returns all objects under prefix, following continuation tokens until the listing is complete
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	sess, err := s.getSession()
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []ObjectInfo
+	err = s3.New(sess).ListObjectsV2PagesWithContext(ctx,
+		&s3.ListObjectsV2Input{
+			Bucket:  aws.String(s.bucket),
+			Prefix:  aws.String(prefix),
+			MaxKeys: aws.Int64(1000),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for object := range page.Contents {
+				objects = append(objects, ObjectInfo{
+					Key:          aws.StringValue(page.Contents[object].Key),
+					Size:         aws.Int64Value(page.Contents[object].Size),
+					ETag:         strings.Trim(aws.StringValue(page.Contents[object].ETag), "\""),
+					LastModified: aws.TimeValue(page.Contents[object].LastModified),
+				})
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+//
+// Delete - batch deletes the given keys
+func (s *S3Storage) Delete(ctx context.Context, keys []string) error {
+	if len(keys) < 1 {
+		return nil
+	}
+
+	sess, err := s.getSession()
+	if err != nil {
+		return err
+	}
+
+	var deleteObjects []s3manager.BatchDeleteObject
+	for key := range keys {
+		deleteObjects = append(deleteObjects, s3manager.BatchDeleteObject{
+			Object: &s3.DeleteObjectInput{
+				Key:    aws.String(keys[key]),
+				Bucket: aws.String(s.bucket),
+			},
+		})
+	}
+
+	batcher := s3manager.NewBatchDeleteWithClient(s3.New(sess))
+	return batcher.Delete(ctx, &s3manager.DeleteObjectsIterator{
+		Objects: deleteObjects,
+	})
+}
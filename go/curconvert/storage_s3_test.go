@@ -0,0 +1,159 @@
+package curconvert
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func TestS3StorageSession(t *testing.T) {
+	s := NewS3Storage("bucket", "", "")
+	if s.String() != "s3://bucket" {
+		t.Errorf("String = %s, want s3://bucket", s.String())
+	}
+
+	// the session is created once and re-used
+	sess := &session.Session{}
+	s.sess = sess
+	got, err := s.getSession()
+	if err != nil || got != sess {
+		t.Errorf("getSession = %p (%v), want the cached session %p", got, err, sess)
+	}
+
+	// no role is assumed without an arn
+	if creds := getCreds("", "", sess); creds != nil {
+		t.Errorf("getCreds without an arn = %v, want nil", creds)
+	}
+}
+
+func TestS3StorageSessionConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      S3Options
+		endpoint  string
+		pathStyle bool
+		plainHTTP bool
+		insecure  bool
+	}{
+		{name: "default"},
+		{name: "endpoint", opts: S3Options{Endpoint: "https://minio:9000"}, endpoint: "https://minio:9000"},
+		{
+			name:      "path style over http",
+			opts:      S3Options{Endpoint: "http://minio:9000", ForcePathStyle: true, DisableSSL: true},
+			endpoint:  "http://minio:9000",
+			pathStyle: true,
+			plainHTTP: true,
+		},
+		{name: "insecure tls", opts: S3Options{Endpoint: "https://ceph", InsecureSkipVerify: true}, endpoint: "https://ceph", insecure: true},
+	}
+	for _, tt := range tests {
+		s := NewS3Storage("bucket", "", "")
+		s.SetOptions(tt.opts)
+		config := s.sessionConfig("eu-west-1")
+		if aws.StringValue(config.Region) != "eu-west-1" || aws.StringValue(config.Endpoint) != tt.endpoint {
+			t.Errorf("%s: region %s endpoint %s, want eu-west-1 and %s", tt.name,
+				aws.StringValue(config.Region), aws.StringValue(config.Endpoint), tt.endpoint)
+		}
+		if aws.BoolValue(config.S3ForcePathStyle) != tt.pathStyle || aws.BoolValue(config.DisableSSL) != tt.plainHTTP {
+			t.Errorf("%s: path style %t plain http %t, want %t and %t", tt.name,
+				aws.BoolValue(config.S3ForcePathStyle), aws.BoolValue(config.DisableSSL), tt.pathStyle, tt.plainHTTP)
+		}
+		if insecure := config.HTTPClient != nil; insecure != tt.insecure {
+			t.Errorf("%s: custom TLS client %t, want %t", tt.name, insecure, tt.insecure)
+		}
+	}
+}
+
+func TestS3StorageSetOptionsResetsSession(t *testing.T) {
+	s := NewS3Storage("bucket", "", "")
+	s.sess = &session.Session{}
+	s.SetOptions(S3Options{Endpoint: "http://minio:9000"})
+	if s.sess != nil {
+		t.Error("session created before SetOptions was kept")
+	}
+
+	// options set on the converter reach storage that is already in use
+	c := NewCurConvert("bucket", "cur/cur-Manifest.json", "bucket", "parquet/202610")
+	dest := c.getDestStorage().(*S3Storage)
+	dest.sess = &session.Session{}
+	if err := c.SetS3Options(S3Options{Endpoint: "http://minio:9000"}); err != nil {
+		t.Fatal(err)
+	}
+	if dest.sess != nil || dest.opts.Endpoint != "http://minio:9000" {
+		t.Errorf("dest storage options %+v, session reset %t", dest.opts, dest.sess == nil)
+	}
+}
+
+func TestS3StorageDeleteNothing(t *testing.T) {
+	// deleting no keys makes no request, so needs no session
+	if err := NewS3Storage("bucket", "", "").Delete(context.Background(), nil); err != nil {
+		t.Errorf("Delete of no keys: %s", err)
+	}
+}
+
+func TestS3StoragePutEncryptedNotSeekable(t *testing.T) {
+	s := NewS3Storage("bucket", "", "")
+	s.SetKMSKey("arn:aws:kms:us-east-1:123456789012:key/1")
+	body := io.MultiReader(strings.NewReader("parquet"))
+	if err := s.putEncrypted(context.Background(), nil, "parquet/cur-1.parquet", body); err == nil {
+		t.Error("expected client-side encryption of a body that can not seek to fail")
+	}
+}
+
+func TestParseSSEMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "", want: ""},
+		{name: "none", want: ""},
+		{name: "sse-s3", want: SSES3},
+		{name: " AES256 ", want: SSES3},
+		{name: "SSE-KMS", want: SSEKMS},
+		{name: "aws:kms", want: SSEKMS},
+		{name: "sse-c", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSSEMode(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseSSEMode(%q) = %q (%v), want %q, error %t", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSSEOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		sse     SSEOptions
+		wantErr bool
+	}{
+		{name: "bucket default"},
+		{name: "sse-s3", sse: SSEOptions{Mode: SSES3}},
+		{name: "sse-kms key", sse: SSEOptions{Mode: SSEKMS, KMSKeyID: "alias/cur", BucketKey: true}},
+		{name: "unknown mode", sse: SSEOptions{Mode: "sse-c"}, wantErr: true},
+		{name: "key without sse-kms", sse: SSEOptions{Mode: SSES3, KMSKeyID: "alias/cur"}, wantErr: true},
+		{name: "bucket key without sse-kms", sse: SSEOptions{BucketKey: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := NewS3Storage("bucket", "", "").SetSSE(tt.sse); (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %t", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// client-side and server-side encryption are exclusive
+	c := NewCurConvert("", "dest", "", "")
+	if err := c.SetDestKMSKey("alias/cur"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetDestSSE(SSEOptions{Mode: SSES3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ConvertCurContext(context.Background()); err == nil {
+		t.Error("expected client-side with server-side encryption to fail")
+	}
+}
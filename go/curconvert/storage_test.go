@@ -0,0 +1,202 @@
+package curconvert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// testDir - creates a temp directory, removed by the returned func
+func testDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "curconvert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// putObject - writes body to key of s, failing the test on error
+func putObject(t *testing.T, s Storage, key string, body string) {
+	if err := s.Put(context.Background(), key, strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listKeys - returns the sorted keys of s starting with prefix, failing the test on error
+func listKeys(t *testing.T, s Storage, prefix string) []string {
+	objects, err := s.List(context.Background(), prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestNewStorage(t *testing.T) {
+	tests := []struct {
+		location string
+		want     string
+	}{
+		{location: "file:///tmp/cur", want: "file:///tmp/cur"},
+		{location: "s3://bucket", want: "s3://bucket"},
+		{location: "bucket", want: "s3://bucket"},
+	}
+	for _, tt := range tests {
+		if got := NewStorage(tt.location, "", "").String(); got != tt.want {
+			t.Errorf("NewStorage(%q) = %s, want %s", tt.location, got, tt.want)
+		}
+	}
+}
+
+func TestIsNotExist(t *testing.T) {
+	_, missing := os.Stat("/curconvert/does/not/exist")
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "missing file", err: missing, want: true},
+		{name: "no such key", err: awserr.New("NoSuchKey", "", nil), want: true},
+		{name: "not found", err: awserr.New("NotFound", "", nil), want: true},
+		{name: "access denied", err: awserr.New("AccessDenied", "", nil), want: false},
+		{name: "other", err: errors.New("other"), want: false},
+		{name: "nil", err: nil, want: false},
+	}
+	for _, tt := range tests {
+		if got := IsNotExist(tt.err); got != tt.want {
+			t.Errorf("%s: IsNotExist = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsChanged(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "changed", err: ErrChanged, want: true},
+		{name: "wrapped", err: &SourceFileError{Err: fmt.Errorf("range: %w", ErrChanged)}, want: true},
+		{name: "precondition failed", err: awserr.NewRequestFailure(awserr.New("PreconditionFailed", "", nil), 412, "r"), want: true},
+		{name: "no such key", err: awserr.New("NoSuchKey", "", nil), want: false},
+		{name: "nil", err: nil, want: false},
+	}
+	for _, tt := range tests {
+		if got := IsChanged(tt.err); got != tt.want {
+			t.Errorf("%s: IsChanged = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	ctx := context.Background()
+	s := NewLocalStorage(dir)
+
+	putObject(t, s, "cur/a1/cur-1.csv.gz", "first")
+	putObject(t, s, "cur/a1/cur-1.csv.gz", "second")
+	putObject(t, s, "cur/a1/cur-2.csv.gz", "2")
+	putObject(t, s, "cur/a10/cur-1.csv.gz", "10")
+	putObject(t, s, "other/cur-1.csv.gz", "other")
+
+	r, err := s.Get(ctx, "cur/a1/cur-1.csv.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(b) != "second" {
+		t.Errorf("Get = %q (%v), want the replaced content", b, err)
+	}
+
+	info, err := s.Stat(ctx, "cur/a1/cur-1.csv.gz")
+	if err != nil || info.Key != "cur/a1/cur-1.csv.gz" || info.Size != 6 || len(info.ETag) < 1 {
+		t.Errorf("Stat = %+v (%v)", info, err)
+	}
+	if _, err := s.Stat(ctx, "cur/a1/cur-3.csv.gz"); !IsNotExist(err) {
+		t.Errorf("Stat of a missing key returned %v", err)
+	}
+
+	lists := []struct {
+		prefix string
+		want   []string
+	}{
+		{prefix: "cur/a1/", want: []string{"cur/a1/cur-1.csv.gz", "cur/a1/cur-2.csv.gz"}},
+		{prefix: "cur/a1", want: []string{"cur/a1/cur-1.csv.gz", "cur/a1/cur-2.csv.gz", "cur/a10/cur-1.csv.gz"}},
+		{prefix: "cur/a1/cur-2", want: []string{"cur/a1/cur-2.csv.gz"}},
+		{prefix: "missing/", want: nil},
+	}
+	for _, l := range lists {
+		if got := listKeys(t, s, l.prefix); !reflect.DeepEqual(got, l.want) {
+			t.Errorf("List(%q) = %v, want %v", l.prefix, got, l.want)
+		}
+	}
+
+	if err := s.Delete(ctx, []string{"cur/a1/cur-1.csv.gz", "cur/a1/missing.csv.gz"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := listKeys(t, s, "cur/a1/"), []string{"cur/a1/cur-2.csv.gz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List after Delete = %v, want %v", got, want)
+	}
+}
+
+func TestLocalStoragePutConcurrent(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	s := NewLocalStorage(dir)
+
+	// concurrent Puts of the same key each write their own temp file, the last rename wins
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.Put(context.Background(), "cur/cur-1.csv.gz", strings.NewReader(fmt.Sprintf("content %d", i)))
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Put %d: %s", i, err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(s.path("cur/cur-1.csv.gz"))
+	if err != nil || !strings.HasPrefix(string(b), "content ") {
+		t.Errorf("content %q (%v)", b, err)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, "cur"))
+	if err != nil || len(files) != 1 {
+		t.Errorf("%d files left in the directory (%v), want 1", len(files), err)
+	}
+}
+
+func TestLocalStorageListHidesTempFiles(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	s := NewLocalStorage(dir)
+
+	putObject(t, s, "cur/cur-1.csv.gz", "1")
+	if err := ioutil.WriteFile(filepath.Join(dir, "cur", ".cur-2.csv.gz-123"), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := listKeys(t, s, "cur/"), []string{"cur/cur-1.csv.gz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,135 @@
+package curconvert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/xitongsys/parquet-go/ParquetFile"
+)
+
+// streamFile - write-only ParquetFile that passes everything written straight through a pipe, used to feed parquet
+// output into an upload. Reads and seeks are not supported
+type streamFile struct {
+	w *io.PipeWriter
+}
+
+func (f *streamFile) Write(p []byte) (int, error) {
+	return f.w.Write(p)
+}
+
+func (f *streamFile) Close() error {
+	return f.w.Close()
+}
+
+// CloseWithError - closes the pipe so the reading upload fails with err
+func (f *streamFile) CloseWithError(err error) error {
+	return f.w.CloseWithError(err)
+}
+
+func (f *streamFile) Read(p []byte) (int, error) {
+	return 0, errors.New("streamFile does not support Read")
+}
+
+func (f *streamFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("streamFile does not support Seek")
+}
+
+func (f *streamFile) Open(name string) (ParquetFile.ParquetFile, error) {
+	return nil, errors.New("streamFile does not support Open")
+}
+
+func (f *streamFile) Create(name string) (ParquetFile.ParquetFile, error) {
+	return nil, errors.New("streamFile does not support Create")
+}
+
+//
+// StreamCur - Converts a single CUR file without using the temp directory. The source object is gunzipped and parsed as it
+// is read and parquet row groups are uploaded as they are flushed, so memory use is bounded by the row group and upload part
+// sizes rather than the size of the file. When output is partitioned an upload runs for every partition in the file, and
+// the row group size is shared between the partitions so that their buffered rows stay within it.
+// Returns the keys of the uploaded parquet objects
+func (c *CurConvert) StreamCur(curObject string) ([]string, error) {
+	outputs, _, err := c.streamCur(aws.BackgroundContext(), curObject)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, out := range outputs {
+		c.addParquetFile(out.destKey)
+		keys = append(keys, out.destKey)
+	}
+	return keys, nil
+}
+
+// streamCur - streams curObject, returning the uploaded outputs and the totals of the CSV records read. The caller records
+// their keys once they are verified
+func (c *CurConvert) streamCur(ctx context.Context, curObject string) ([]*parquetOutput, csvTotals, error) {
+
+	source := c.getSourceStorage()
+	dest := c.getDestStorage()
+	name := c.parquetName(curObject)
+
+	body, err := source.Get(ctx, curObject)
+	if err != nil {
+		return nil, csvTotals{}, &SourceFileError{Bucket: source.String(), Key: curObject, Err: err}
+	}
+	defer body.Close()
+
+	// parquet for each partition is written into one end of a pipe while an upload consumes the other
+	var uploads sync.WaitGroup
+	var uploadLock sync.Mutex
+	var uploadErr error
+	outputs, totals, err := c.writeParquet(ctx, body, source.String(), curObject, func(partition string) (*parquetOutput, error) {
+		destObject := c.outputKey(partition, name)
+		pr, pw := io.Pipe()
+
+		uploads.Add(1)
+		go func() {
+			defer uploads.Done()
+			err := dest.Put(ctx, destObject, pr)
+			if err != nil {
+				uploadLock.Lock()
+				if uploadErr == nil {
+					uploadErr = &UploadError{Bucket: dest.String(), Key: destObject, Err: err}
+				}
+				uploadLock.Unlock()
+			}
+			// unblock the writer if the upload failed first
+			pr.CloseWithError(err)
+		}()
+
+		return &parquetOutput{partition: partition, destKey: destObject, file: &streamFile{w: pw}}, nil
+	})
+	uploads.Wait()
+
+	// partitions that completed their upload before the failure are removed
+	if uploadErr != nil {
+		return nil, totals, cleanupFailed(uploadErr, c.deleteOutputs(outputs))
+	}
+	if err != nil {
+		return nil, totals, cleanupFailed(err, c.deleteOutputs(outputs))
+	}
+	return outputs, totals, nil
+}
+
+// deleteOutputs - removes uploaded outputs of a CUR file that failed, so they are not left live in the dest path. Runs
+// with a background context so that it completes after the conversion was cancelled
+func (c *CurConvert) deleteOutputs(outputs []*parquetOutput) error {
+	if len(outputs) < 1 {
+		return nil
+	}
+	var keys []string
+	for _, out := range outputs {
+		keys = append(keys, out.destKey)
+	}
+	dest := c.getDestStorage()
+	if err := dest.Delete(aws.BackgroundContext(), keys); err != nil {
+		return &UploadError{Bucket: dest.String(), Key: keys[0], Err: fmt.Errorf("removing %d failed outputs: %s", len(keys), err)}
+	}
+	return nil
+}
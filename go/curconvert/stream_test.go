@@ -0,0 +1,66 @@
+package curconvert
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestStreamFile(t *testing.T) {
+	pr, pw := io.Pipe()
+	read := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadAll(pr)
+		read <- string(b)
+	}()
+
+	f := &streamFile{w: pw}
+	if n, err := f.Write([]byte("PAR1")); n != 4 || err != nil {
+		t.Errorf("Write = %d (%v)", n, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("Close: %s", err)
+	}
+	if got := <-read; got != "PAR1" {
+		t.Errorf("passed through %q", got)
+	}
+
+	// closing with an error fails the reader
+	pr, pw = io.Pipe()
+	f = &streamFile{w: pw}
+	f.CloseWithError(errors.New("conversion failed"))
+	if _, err := ioutil.ReadAll(pr); err == nil || err.Error() != "conversion failed" {
+		t.Errorf("reader error %v, want the conversion error", err)
+	}
+
+	// the file is write-only
+	if _, err := f.Read(make([]byte, 1)); err == nil {
+		t.Error("expected Read to fail")
+	}
+	if _, err := f.Seek(0, 0); err == nil {
+		t.Error("expected Seek to fail")
+	}
+	if _, err := f.Open("cur-1.parquet"); err == nil {
+		t.Error("expected Open to fail")
+	}
+	if _, err := f.Create("cur-1.parquet"); err == nil {
+		t.Error("expected Create to fail")
+	}
+}
+
+func TestStreamCurMissingSource(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	dest := NewLocalStorage(dir + "/dest")
+	c := NewCurConvert("", "cur/cur-Manifest.json", "", "parquet/202610")
+	c.SetSourceStorage(NewLocalStorage(dir + "/source"))
+	c.SetDestStorage(dest)
+	if _, err := c.StreamCur("cur/a1/cur-1.csv.gz"); err == nil {
+		t.Fatal("expected streaming a missing CUR object to fail")
+	}
+	if keys := listKeys(t, dest, "parquet/"); len(keys) > 0 {
+		t.Errorf("uploaded %v", keys)
+	}
+}
@@ -0,0 +1,145 @@
+package curconvert
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// resourceTagColumn - name of the MAP column holding all resource tags when SetResourceTagMap is enabled
+const resourceTagColumn = "resource_tags"
+
+// mapType - Athena type of MAP columns, CUR MAP columns always have string keys and values
+const mapType = "map<string,string>"
+
+// tagColumn - a resourceTags column of the CUR, key is the tag name as given in the manifest (e.g. user:CostCenter)
+type tagColumn struct {
+	key   string
+	index int
+}
+
+//
+// SetResourceTagMap - when enabled all resourceTags columns are written into a single MAP<string,string> column named
+// resource_tags, keyed by tag name (e.g. user:CostCenter), rather than a column per tag. This keeps the table schema
+// stable as cost allocation tags are activated. Empty tag values are omitted from the map
+func (c *CurConvert) SetResourceTagMap(enabled bool) {
+	c.tagMap = enabled
+}
+
+// isTagColumn - returns true if the normalized column name is a resource tag
+func isTagColumn(name string) bool {
+	return strings.HasPrefix(name, "resourcetags/")
+}
+
+// isMapType - returns true if a manifest column type is a MAP, as used by CUR 2.0 for e.g. resource_tags
+func isMapType(t string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(t)), "map")
+}
+
+// mapMetadata - returns the parquet metadata of a MAP column, as recorded in conversion state
+func mapMetadata(f curField) string {
+	return "name=" + f.name + ", type=MAP, repetitiontype=OPTIONAL"
+}
+
+// addTagMap - adds the resource_tags MAP column collecting the resource tag columns, if enabled and the CUR does not
+// already provide one
+func (c *CurConvert) addTagMap() {
+	if !c.tagMap {
+		return
+	}
+	for _, f := range c.mapFields {
+		if f.name == resourceTagColumn {
+			return
+		}
+	}
+	c.mapFields = append(c.mapFields, curField{name: resourceTagColumn, athenaType: mapType, index: -1})
+}
+
+// tagValues - returns the non-empty resource tags of a CSV record
+func (c *CurConvert) tagValues(rec []string) map[string]string {
+	tags := make(map[string]string)
+	for _, t := range c.tagColumns {
+		if t.index < len(rec) && len(rec[t.index]) > 0 {
+			tags[t.key] = rec[t.index]
+		}
+	}
+	return tags
+}
+
+// mapValues - returns the value of a MAP column for a CSV record. The resource_tags column built by SetResourceTagMap
+// is collected from the tag columns, other MAP columns are held in the CSV as JSON objects. Values that are not valid
+// JSON objects are written as null
+func (c *CurConvert) mapValues(f curField, rec []string) map[string]string {
+	if f.index == missingColumn {
+		return nil
+	}
+	if f.index < 0 {
+		return c.tagValues(rec)
+	}
+	if f.index >= len(rec) || len(rec[f.index]) < 1 {
+		return nil
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(rec[f.index]), &raw); err != nil {
+		return nil
+	}
+	values := make(map[string]string, len(raw))
+	for k, v := range raw {
+		switch v := v.(type) {
+		case nil:
+			continue
+		case string:
+			values[k] = v
+		default:
+			b, _ := json.Marshal(v)
+			values[k] = string(b)
+		}
+	}
+	return c.redactMap(f, values)
+}
+
+// jsonSchemaField - an element of a parquet-go JSON schema
+type jsonSchemaField struct {
+	Tag    string
+	Fields []jsonSchemaField `json:",omitempty"`
+}
+
+// jsonSchema - returns the parquet-go JSON schema of the converted CUR, the CUR columns followed by the MAP columns
+func (c *CurConvert) jsonSchema() (string, error) {
+	root := jsonSchemaField{Tag: "name=parquet_go_root, repetitiontype=REQUIRED"}
+	for _, md := range c.CurColumns {
+		root.Fields = append(root.Fields, jsonSchemaField{Tag: md})
+	}
+	for _, f := range c.mapFields {
+		root.Fields = append(root.Fields, jsonSchemaField{
+			Tag: mapMetadata(f),
+			Fields: []jsonSchemaField{
+				{Tag: "name=key, type=UTF8, encoding=PLAIN_DICTIONARY"},
+				{Tag: "name=value, type=UTF8, encoding=PLAIN_DICTIONARY, repetitiontype=OPTIONAL"},
+			},
+		})
+	}
+
+	b, err := json.Marshal(root)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// jsonRecord - returns the JSON record written by the JSON writer for the converted values of a CSV record
+func (c *CurConvert) jsonRecord(rec []string, values []interface{}) (string, error) {
+	j := make(map[string]interface{}, len(values)+len(c.mapFields))
+	for k := range c.fields {
+		j[c.fields[k].name] = values[k]
+	}
+	for _, f := range c.mapFields {
+		j[f.name] = c.mapValues(f, rec)
+	}
+
+	b, err := json.Marshal(j)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
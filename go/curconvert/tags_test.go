@@ -0,0 +1,149 @@
+package curconvert
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/xitongsys/parquet-go/parquet"
+)
+
+// tagConvert - returns a converter writing resource tags as a MAP column, for a CUR of two columns and two tags
+func tagConvert() *CurConvert {
+	c := NewCurConvert("", "", "", "")
+	c.SetResourceTagMap(true)
+	c.fields = []curField{
+		{name: "lineitem/usageamount", athenaType: "DOUBLE", index: 0},
+		{name: "product/region", athenaType: "STRING", index: 2},
+	}
+	for _, f := range c.fields {
+		c.CurColumns = append(c.CurColumns, columnMetadata(f, true))
+	}
+	c.tagColumns = []tagColumn{{key: "user:CostCenter", index: 1}, {key: "user:Team", index: 3}}
+	c.addTagMap()
+	return c
+}
+
+func TestTagValues(t *testing.T) {
+	c := tagConvert()
+	tests := []struct {
+		rec  []string
+		want map[string]string
+	}{
+		{rec: []string{"1", "cc1", "us-east-1", "platform"}, want: map[string]string{"user:CostCenter": "cc1", "user:Team": "platform"}},
+		{rec: []string{"1", "", "us-east-1", "platform"}, want: map[string]string{"user:Team": "platform"}},
+		{rec: []string{"1", "cc1", "us-east-1"}, want: map[string]string{"user:CostCenter": "cc1"}},
+		{rec: []string{"1", "", "", ""}, want: map[string]string{}},
+	}
+	for _, tt := range tests {
+		if got := c.tagValues(tt.rec); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tagValues(%q) = %v, want %v", tt.rec, got, tt.want)
+		}
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	c := tagConvert()
+	schema, err := c.jsonSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var root jsonSchemaField
+	if err := json.Unmarshal([]byte(schema), &root); err != nil {
+		t.Fatalf("schema %s is not JSON: %s", schema, err)
+	}
+	if len(root.Fields) != 3 {
+		t.Fatalf("schema has %d fields, want the 2 CUR columns and the tag map", len(root.Fields))
+	}
+	for i, md := range c.CurColumns {
+		if root.Fields[i].Tag != md {
+			t.Errorf("field %d is %s, want %s", i, root.Fields[i].Tag, md)
+		}
+	}
+	tags := root.Fields[2]
+	if tags.Tag != mapMetadata(c.mapFields[0]) || len(tags.Fields) != 2 {
+		t.Errorf("tag map field %+v", tags)
+	}
+}
+
+func TestJSONRecord(t *testing.T) {
+	c := tagConvert()
+	j, err := c.jsonRecord([]string{"1.5", "", "us-east-1", "platform"}, []interface{}{1.5, "us-east-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(j), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"lineitem/usageamount": 1.5,
+		"product/region":       "us-east-1",
+		"resource_tags":        map[string]interface{}{"user:Team": "platform"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("jsonRecord = %v, want %v", got, want)
+	}
+
+	// empty numeric values are written as null
+	j, err = c.jsonRecord([]string{"", "", "", ""}, []interface{}{nil, ""})
+	if err != nil || j != `{"lineitem/usageamount":null,"product/region":"","resource_tags":{}}` {
+		t.Errorf("jsonRecord of empty values = %s (%v)", j, err)
+	}
+}
+
+func TestNewWriterTagMap(t *testing.T) {
+	c := tagConvert()
+	if err := c.SetCompression("gzip"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the parquet output is discarded
+	pr, pw := io.Pipe()
+	go io.Copy(ioutil.Discard, pr)
+	out := &parquetOutput{file: &streamFile{w: pw}}
+	if err := c.newWriter(out); err != nil {
+		t.Fatal(err)
+	}
+	if out.writer == nil || out.writer.CompressionType != parquet.CompressionCodec_GZIP || out.writer.RowGroupSize != c.rowGroupSize {
+		t.Fatalf("writer %+v not configured", out.writer)
+	}
+
+	// records are written with their tags via the JSON writer, the MAP column is collected from the tag columns
+	if err := out.write([]string{"1.5", "cc1", "us-east-1", "platform"}, []interface{}{1.5, "us-east-1"}); err != nil {
+		t.Errorf("write: %s", err)
+	}
+	if err := out.writer.WriteStop(); err != nil {
+		t.Errorf("WriteStop: %s", err)
+	}
+	closeFile(out.file, nil)
+}
+
+func TestMapValues(t *testing.T) {
+	c := tagConvert()
+	f := curField{name: "cost_category", athenaType: mapType, index: 0}
+	tests := []struct {
+		value string
+		want  map[string]string
+	}{
+		{value: `{"team": "platform", "env": null}`, want: map[string]string{"team": "platform"}},
+		{value: `{"count": 2, "nested": {"a": true}}`, want: map[string]string{"count": "2", "nested": `{"a":true}`}},
+		{value: `{}`, want: map[string]string{}},
+		{value: "", want: nil},
+		{value: "not json", want: nil},
+	}
+	for _, tt := range tests {
+		if got := c.mapValues(f, []string{tt.value}); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mapValues(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+
+	// the resource_tags column added by SetResourceTagMap is collected from the tag columns
+	if got := c.mapValues(c.mapFields[0], []string{"1", "cc1", "us-east-1", ""}); !reflect.DeepEqual(got, map[string]string{"user:CostCenter": "cc1"}) {
+		t.Errorf("resource_tags = %v", got)
+	}
+}
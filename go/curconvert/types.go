@@ -0,0 +1,318 @@
+package curconvert
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// curField - a column of the converted CUR, index is the position of the column in the source CSV
+type curField struct {
+	name       string
+	athenaType string
+	index      int
+}
+
+// parquetTypes - maps supported Athena column types to the parquet type used when writing
+var parquetTypes = map[string]string{
+	"STRING":    "UTF8",
+	"DOUBLE":    "DOUBLE",
+	"BIGINT":    "INT64",
+	"BOOLEAN":   "BOOLEAN",
+	"TIMESTAMP": "TIMESTAMP_MILLIS",
+}
+
+// dateColumns - CUR date columns written as TIMESTAMP (unless disabled) when the manifest does not type them
+var dateColumns = map[string]bool{
+	"lineitem/usagestartdate":     true,
+	"lineitem/usageenddate":       true,
+	"bill/billingperiodstartdate": true,
+	"bill/billingperiodenddate":   true,
+}
+
+// defaultColumnTypes - CUR cost and usage columns written as DOUBLE unless over-ridden, whatever the manifest types them
+var defaultColumnTypes = map[string]string{
+	"lineitem/usageamount":                      "DOUBLE",
+	"lineitem/normalizationfactor":              "DOUBLE",
+	"lineitem/normalizedusageamount":            "DOUBLE",
+	"lineitem/unblendedrate":                    "DOUBLE",
+	"lineitem/unblendedcost":                    "DOUBLE",
+	"lineitem/blendedrate":                      "DOUBLE",
+	"lineitem/blendedcost":                      "DOUBLE",
+	"pricing/publicondemandcost":                "DOUBLE",
+	"pricing/publicondemandrate":                "DOUBLE",
+	"reservation/normalizedunitsperreservation": "DOUBLE",
+	"reservation/totalreservednormalizedunits":  "DOUBLE",
+	"reservation/totalreservedunits":            "DOUBLE",
+	"reservation/unitsperreservation":           "DOUBLE",
+}
+
+// timestampLayouts - ISO-8601 variants seen in CUR date columns, tried in order
+var timestampLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// normalizeType - returns the Athena type for t, which may be given as either an Athena or parquet type name
+func normalizeType(t string) (string, bool) {
+	t = strings.ToUpper(strings.TrimSpace(t))
+	if _, ok := parquetTypes[t]; ok {
+		return t, true
+	}
+	for athenaType, parquetType := range parquetTypes {
+		if parquetType == t {
+			return athenaType, true
+		}
+	}
+	return "", false
+}
+
+// manifestType - maps the type of a column given in the CUR manifest (e.g. OptionalBigDecimal) to an Athena type.
+// An empty string is returned for types that give no better information than STRING
+func manifestType(t string) string {
+	t = strings.ToLower(t)
+	switch {
+	case strings.Contains(t, "decimal") || strings.Contains(t, "double"):
+		return "DOUBLE"
+	case strings.Contains(t, "datetime") || strings.Contains(t, "timestamp"):
+		return "TIMESTAMP"
+	case strings.Contains(t, "bool"):
+		return "BOOLEAN"
+	case (strings.Contains(t, "int") && !strings.Contains(t, "interval")) || strings.Contains(t, "long"):
+		return "BIGINT"
+	}
+	return ""
+}
+
+// sampleType - infers an Athena type from sampled CSV values. Every non-empty value must parse for a type to be chosen.
+// Numbers with leading zeros (e.g. account IDs) are kept as STRING so that IDs are not mangled, identifier columns whose
+// sampled values have no leading zeros should be given a STRING over-ride, see SetColumnTypeFile
+func sampleType(values []string) string {
+	isBool, isInt, isFloat := true, true, true
+	seen := 0
+	for _, v := range values {
+		if len(v) < 1 {
+			continue
+		}
+		seen++
+		if _, err := strconv.ParseBool(v); err != nil || (v != "true" && v != "false") {
+			isBool = false
+		}
+		zero := leadingZero(v)
+		if _, err := strconv.ParseInt(v, 10, 64); err != nil || zero {
+			isInt = false
+		}
+		if _, err := strconv.ParseFloat(v, 64); err != nil || zero {
+			isFloat = false
+		}
+	}
+
+	switch {
+	case seen < 1:
+		return "STRING"
+	case isBool:
+		return "BOOLEAN"
+	case isInt:
+		return "BIGINT"
+	case isFloat:
+		return "DOUBLE"
+	}
+	return "STRING"
+}
+
+// leadingZero - returns true if the number v has a leading zero that is not followed by a decimal point, e.g. 000123
+func leadingZero(v string) bool {
+	v = strings.TrimLeft(v, "+-")
+	return len(v) > 1 && v[0] == '0' && v[1] != '.'
+}
+
+// parquetValue - converts a CSV value into the value the parquet writer expects for the column type. Empty values of
+// non STRING columns are written as null. Other values that do not parse as the column type are an error, as types may
+// be inferred from a sample of rows that the rest of the file does not match
+func parquetValue(v string, athenaType string) (interface{}, error) {
+	if len(v) < 1 && athenaType != "STRING" {
+		return nil, nil
+	}
+
+	var value interface{}
+	var err error
+	switch athenaType {
+	case "DOUBLE":
+		value, err = strconv.ParseFloat(v, 64)
+	case "BIGINT":
+		value, err = strconv.ParseInt(v, 10, 64)
+	case "BOOLEAN":
+		value, err = strconv.ParseBool(v)
+	case "TIMESTAMP":
+		t, ok := parseTimestamp(v)
+		if !ok {
+			return nil, fmt.Errorf("invalid %s value %q", athenaType, v)
+		}
+		value = t.UnixNano() / int64(time.Millisecond)
+	default:
+		value = v
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value %q", athenaType, v)
+	}
+	return value, nil
+}
+
+// parseTimestamp - parses an ISO-8601 CUR date, values without a zone are taken as UTC
+func parseTimestamp(v string) (time.Time, bool) {
+	if len(v) < 1 {
+		return time.Time{}, false
+	}
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+//
+// SetStringDates - when enabled CUR date columns are written as ISO-8601 strings rather than TIMESTAMP columns,
+// for compatibility with queries written against previous conversions
+func (c *CurConvert) SetStringDates(enabled bool) {
+	c.stringDates = enabled
+}
+
+// columnMetadata - returns the parquet CSV writer metadata for a field
+func columnMetadata(f curField, dictionary bool) string {
+	encoding := "PLAIN"
+	if dictionary {
+		encoding = "PLAIN_DICTIONARY"
+	}
+	md := "name=" + f.name + ", type=" + parquetTypes[f.athenaType] + ", encoding=" + encoding
+	if f.athenaType != "STRING" || f.index == missingColumn {
+		md += ", repetitiontype=OPTIONAL"
+	}
+	return md
+}
+
+//
+// SetColumnTypeFile - loads column type over-rides from a JSON file mapping column names to a type, e.g.
+// {"lineitem/usageamount": "DOUBLE"}. Supported types are DOUBLE, BIGINT, TIMESTAMP, BOOLEAN and STRING
+func (c *CurConvert) SetColumnTypeFile(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("Failed to read column type file %s: %s", file, err)
+	}
+
+	var types map[string]string
+	if err := json.Unmarshal(b, &types); err != nil {
+		return fmt.Errorf("Failed to parse column type file %s: %s", file, err)
+	}
+
+	for column, t := range types {
+		athenaType, ok := normalizeType(t)
+		if !ok {
+			return fmt.Errorf("Invalid type %s for column %s in column type file %s", t, column, file)
+		}
+		c.CurColumnTypes[strings.ToLower(column)] = athenaType
+	}
+	return nil
+}
+
+//
+// SetTypeSampling - when rows > 0 the first rows of the first CUR file are sampled to infer types for columns
+// that have no over-ride and are not given a specific type by the manifest. A later value that does not parse as the
+// inferred type fails the conversion of its file, over-ride the type of such columns with SetColumnTypeFile
+func (c *CurConvert) SetTypeSampling(rows int) error {
+	if rows < 0 {
+		return fmt.Errorf("Type sampling rows must be zero or more")
+	}
+	c.sampleRows = rows
+	return nil
+}
+
+// sampleCur - reads up to c.sampleRows rows of curObject and returns the values seen for each CSV column index
+func (c *CurConvert) sampleCur(ctx context.Context, curObject string) (map[int][]string, error) {
+	source := c.getSourceStorage()
+	body, err := source.Get(ctx, curObject)
+	if err != nil {
+		return nil, &SourceFileError{Bucket: source.String(), Key: curObject, Err: err}
+	}
+	defer body.Close()
+
+	r, release, err := c.openCSV(body)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	cr := csv.NewReader(r)
+	if _, err := cr.Read(); err != nil {
+		return nil, err
+	}
+
+	values := make(map[int][]string)
+	for i := 0; i < c.sampleRows; i++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for k := range rec {
+			values[k] = append(values[k], rec[k])
+		}
+	}
+	return values, nil
+}
+
+// resolveTypes - sets the Athena type of every field, in order of precedence from CurColumnTypes over-rides,
+// defaultColumnTypes, the manifest column type, known CUR date columns, sampled data and finally STRING
+func (c *CurConvert) resolveTypes(ctx context.Context, manifestTypes map[int]string) error {
+	var samples map[int][]string
+	if c.sampleRows > 0 && len(c.CurFiles) > 0 {
+		var err error
+		if samples, err = c.sampleCur(ctx, c.CurFiles[0]); err != nil {
+			return err
+		}
+	}
+
+	for i := range c.fields {
+		f := &c.fields[i]
+		if t, ok := c.CurColumnTypes[f.name]; ok {
+			athenaType, valid := normalizeType(t)
+			if !valid {
+				return fmt.Errorf("Invalid type over-ride %s for column %s", t, f.name)
+			}
+			f.athenaType = athenaType
+			continue
+		}
+		if t, ok := defaultColumnTypes[f.name]; ok {
+			f.athenaType = t
+			continue
+		}
+		t := manifestType(manifestTypes[f.index])
+		if len(t) < 1 && dateColumns[f.name] {
+			t = "TIMESTAMP"
+		}
+		if t == "TIMESTAMP" && c.stringDates {
+			t = "STRING"
+		}
+		if len(t) > 0 {
+			f.athenaType = t
+			continue
+		}
+		if samples != nil {
+			f.athenaType = sampleType(samples[f.index])
+			continue
+		}
+		f.athenaType = "STRING"
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package curconvert
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// gzipCSV - returns csv gzipped, as CUR files are delivered
+func gzipCSV(t *testing.T, csv string) string {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write([]byte(csv)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestSampleType(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{[]string{"1.5", "", "2"}, "DOUBLE"},
+		{[]string{"0.5", "-0.25"}, "DOUBLE"},
+		{[]string{"1", "-2", "+3"}, "BIGINT"},
+		{[]string{"0", "10"}, "BIGINT"},
+		{[]string{"123456789012"}, "BIGINT"},
+		{[]string{"000123456789"}, "STRING"},
+		{[]string{"0123"}, "STRING"},
+		{[]string{"0123.5"}, "STRING"},
+		{[]string{"-012"}, "STRING"},
+		{[]string{"true", "false", ""}, "BOOLEAN"},
+		{[]string{"true", "1"}, "STRING"},
+		{[]string{"True"}, "STRING"},
+		{[]string{"us-east-1", "1"}, "STRING"},
+		{[]string{"", ""}, "STRING"},
+		{nil, "STRING"},
+	}
+	for _, tt := range tests {
+		if got := sampleType(tt.values); got != tt.want {
+			t.Errorf("sampleType(%q) = %s, want %s", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestManifestType(t *testing.T) {
+	tests := []struct {
+		manifest string
+		want     string
+	}{
+		{"OptionalBigDecimal", "DOUBLE"},
+		{"BigDecimal", "DOUBLE"},
+		{"double", "DOUBLE"},
+		{"boolean", "BOOLEAN"},
+		{"Integer", "BIGINT"},
+		{"bigint", "BIGINT"},
+		{"long", "BIGINT"},
+		{"DateTime", "TIMESTAMP"},
+		{"OptionalDateTime", "TIMESTAMP"},
+		{"timestamp", "TIMESTAMP"},
+		{"Interval", ""},
+		{"String", ""},
+		{"OptionalString", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := manifestType(tt.manifest); got != tt.want {
+			t.Errorf("manifestType(%q) = %q, want %q", tt.manifest, got, tt.want)
+		}
+	}
+}
+
+func TestParquetValue(t *testing.T) {
+	tests := []struct {
+		value      string
+		athenaType string
+		want       interface{}
+		wantErr    bool
+	}{
+		{value: "1.5", athenaType: "DOUBLE", want: 1.5},
+		{value: "", athenaType: "DOUBLE", want: nil},
+		{value: "n/a", athenaType: "DOUBLE", wantErr: true},
+		{value: "42", athenaType: "BIGINT", want: int64(42)},
+		{value: "4.2", athenaType: "BIGINT", wantErr: true},
+		{value: "true", athenaType: "BOOLEAN", want: true},
+		{value: "yes", athenaType: "BOOLEAN", wantErr: true},
+		{value: "2026-10-01T00:00:00Z", athenaType: "TIMESTAMP", want: int64(1790812800000)},
+		{value: "", athenaType: "TIMESTAMP", want: nil},
+		{value: "2026-10-01T00:00Z", athenaType: "TIMESTAMP", want: int64(1790812800000)},
+		{value: "2026-10-01", athenaType: "TIMESTAMP", want: int64(1790812800000)},
+		{value: "October", athenaType: "TIMESTAMP", wantErr: true},
+		{value: "", athenaType: "STRING", want: ""},
+		{value: "n/a", athenaType: "STRING", want: "n/a"},
+	}
+	for _, tt := range tests {
+		got, err := parquetValue(tt.value, tt.athenaType)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parquetValue(%q, %s): error %v, want error %t", tt.value, tt.athenaType, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parquetValue(%q, %s) = %v, want %v", tt.value, tt.athenaType, got, tt.want)
+		}
+	}
+}
+
+func TestParseCurTypes(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	source := NewLocalStorage(dir + "/source")
+	putObject(t, source, "cur/cur-Manifest.json", `{
+		"assemblyId": "a1",
+		"columns": [
+			{"category": "lineItem", "name": "UsageAmount", "type": "String"},
+			{"category": "lineItem", "name": "Quantity", "type": "OptionalBigDecimal"},
+			{"category": "lineItem", "name": "UsageAccountId", "type": "String"},
+			{"category": "lineItem", "name": "Count", "type": "String"},
+			{"category": "product", "name": "Code", "type": "String"},
+			{"category": "product", "name": "Region", "type": "String"},
+			{"category": "lineItem", "name": "UsageStartDate", "type": "String"}
+		],
+		"reportKeys": ["cur/a1/cur-1.csv.gz"]
+	}`)
+	putObject(t, source, "cur/a1/cur-1.csv.gz", gzipCSV(t, "a,b,c,d,e,f,g\n1,2.5,123456789012,4,0123,us-east-1,2026-10-01T00:00:00Z\n2,3,123456789013,5,0124,,2026-10-01T01:00:00Z\n"))
+
+	typeFile := dir + "/types.json"
+	if err := ioutil.WriteFile(typeFile, []byte(`{"lineItem/UsageAccountId": "string"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCurConvert("", "cur/cur-Manifest.json", "", "parquet/202610")
+	c.SetSourceStorage(source)
+	if err := c.SetColumnTypeFile(typeFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetTypeSampling(10); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ParseCur(); err != nil {
+		t.Fatal(err)
+	}
+
+	// over-rides, then manifest types and date columns, then sampled types
+	cols, err := c.GetCURColumns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CurColumn{
+		{Name: "lineitem/usageamount", Type: "DOUBLE"},
+		{Name: "lineitem/quantity", Type: "DOUBLE"},
+		{Name: "lineitem/usageaccountid", Type: "STRING"},
+		{Name: "lineitem/count", Type: "BIGINT"},
+		{Name: "product/code", Type: "STRING"},
+		{Name: "product/region", Type: "STRING"},
+		{Name: "lineitem/usagestartdate", Type: "TIMESTAMP"},
+	}
+	if !reflect.DeepEqual(cols, want) {
+		t.Errorf("columns %v, want %v", cols, want)
+	}
+}
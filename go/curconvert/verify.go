@@ -0,0 +1,325 @@
+package curconvert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xitongsys/parquet-go/ParquetFile"
+	"github.com/xitongsys/parquet-go/ParquetReader"
+	"github.com/xitongsys/parquet-go/SchemaHandler"
+)
+
+// verifyBatchRows - number of values read at a time when summing a parquet column
+const verifyBatchRows = 100000
+
+// costColumns - CUR cost columns totalled when verifying, in the order of the VerifyTotals fields
+var costColumns = [2]string{"lineitem/unblendedcost", "lineitem/blendedcost"}
+
+//
+// VerifyMode - whether converted parquet is re-read and compared with the source CUR, and how mismatches are handled
+type VerifyMode int
+
+const (
+	// VerifyOff - converted parquet is not verified, the default
+	VerifyOff VerifyMode = iota
+	// VerifyWarn - mismatches are reported by Verify but do not fail the conversion
+	VerifyWarn
+	// VerifyFail - a mismatch fails the CUR file, as handled by the failure policy
+	VerifyFail
+)
+
+// verifyModes - names accepted by ParseVerifyMode
+var verifyModes = map[string]VerifyMode{
+	"off":  VerifyOff,
+	"warn": VerifyWarn,
+	"fail": VerifyFail,
+}
+
+//
+// ParseVerifyMode - returns the VerifyMode named off, warn or fail
+func ParseVerifyMode(name string) (VerifyMode, error) {
+	if mode, ok := verifyModes[strings.ToLower(strings.TrimSpace(name))]; ok {
+		return mode, nil
+	}
+	return VerifyOff, fmt.Errorf("Unknown verify mode %s, must be one of off, warn or fail", name)
+}
+
+//
+// VerifyTotals - row count and cost totals of CUR data. Costs are only totalled for cost columns converted as DOUBLE.
+// InvalidCosts counts source cost values that are not numbers, which are written as null so never match
+type VerifyTotals struct {
+	Rows          int64
+	UnblendedCost float64
+	BlendedCost   float64
+	InvalidCosts  int64
+}
+
+// add - adds the totals of t to v
+func (v *VerifyTotals) add(t VerifyTotals) {
+	v.Rows += t.Rows
+	v.UnblendedCost += t.UnblendedCost
+	v.BlendedCost += t.BlendedCost
+	v.InvalidCosts += t.InvalidCosts
+}
+
+// equal - returns true if v and t match, allowing for floating point rounding of cost totals
+func (v VerifyTotals) equal(t VerifyTotals) bool {
+	return v.Rows == t.Rows && v.InvalidCosts == t.InvalidCosts &&
+		sameCost(v.UnblendedCost, t.UnblendedCost) && sameCost(v.BlendedCost, t.BlendedCost)
+}
+
+func (v VerifyTotals) String() string {
+	if v.InvalidCosts > 0 {
+		return fmt.Sprintf("rows: %d, unblended cost: %f, blended cost: %f, invalid costs: %d", v.Rows, v.UnblendedCost, v.BlendedCost, v.InvalidCosts)
+	}
+	return fmt.Sprintf("rows: %d, unblended cost: %f, blended cost: %f", v.Rows, v.UnblendedCost, v.BlendedCost)
+}
+
+// sameCost - compares cost totals with a relative tolerance
+func sameCost(a float64, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Abs(a))
+}
+
+//
+// FileVerification - totals of a CUR file as read from the source CSV, as read from the written parquet, and of the
+// source records dropped by row filters. Skipped is set for files that were not converted by this run (unchanged since
+// the previous conversion or Parquet CUR copied as is)
+type FileVerification struct {
+	Key      string
+	Source   VerifyTotals
+	Parquet  VerifyTotals
+	Filtered VerifyTotals
+	Skipped  bool
+}
+
+//
+// Match - returns true if the source totals equal the parquet totals plus those of the filtered records
+func (f FileVerification) Match() bool {
+	written := f.Parquet
+	written.add(f.Filtered)
+	return f.Skipped || f.Source.equal(written)
+}
+
+//
+// VerifyReport - verification of a conversion, Source, Parquet and Filtered are the totals of the month over the
+// verified files
+type VerifyReport struct {
+	Files    []FileVerification
+	Source   VerifyTotals
+	Parquet  VerifyTotals
+	Filtered VerifyTotals
+}
+
+//
+// Mismatches - returns the files whose parquet totals do not match the source
+func (r VerifyReport) Mismatches() []FileVerification {
+	var mismatches []FileVerification
+	for _, f := range r.Files {
+		if !f.Match() {
+			mismatches = append(mismatches, f)
+		}
+	}
+	return mismatches
+}
+
+// verifyResults - verification of each CUR file converted, safe for concurrent use
+type verifyResults struct {
+	lock  sync.Mutex
+	files map[string]FileVerification
+}
+
+//
+// SetVerify - sets whether converted parquet is re-read and its row count and cost totals compared with the source CUR
+func (c *CurConvert) SetVerify(mode VerifyMode) error {
+	if mode < VerifyOff || mode > VerifyFail {
+		return errors.New("Unknown verify mode")
+	}
+	c.verifyMode = mode
+	return nil
+}
+
+//
+// Verify - returns the verification report of the last ConvertCur, and a VerifyError for the first mismatched file
+// if any did not match. Verification must be enabled with SetVerify before converting
+func (c *CurConvert) Verify() (VerifyReport, error) {
+	if c.verifyMode == VerifyOff {
+		return VerifyReport{}, errors.New("Verification is not enabled, see SetVerify")
+	}
+
+	c.verified.lock.Lock()
+	defer c.verified.lock.Unlock()
+
+	var report VerifyReport
+	for _, f := range c.verified.files {
+		report.Files = append(report.Files, f)
+		if !f.Skipped {
+			report.Source.add(f.Source)
+			report.Parquet.add(f.Parquet)
+			report.Filtered.add(f.Filtered)
+		}
+	}
+	sort.Slice(report.Files, func(i, j int) bool { return report.Files[i].Key < report.Files[j].Key })
+
+	if mismatches := report.Mismatches(); len(mismatches) > 0 {
+		m := mismatches[0]
+		return report, &VerifyError{Bucket: c.getSourceStorage().String(), Key: m.Key, Source: m.Source, Parquet: m.Parquet, Filtered: m.Filtered}
+	}
+	return report, nil
+}
+
+// resetVerify - clears the results of any previous conversion
+func (c *CurConvert) resetVerify() {
+	c.verified.lock.Lock()
+	c.verified.files = make(map[string]FileVerification)
+	c.verified.lock.Unlock()
+}
+
+// setVerification - records the verification of a CUR file, replacing that of any previous attempt
+func (c *CurConvert) setVerification(f FileVerification) {
+	if c.verifyMode == VerifyOff {
+		return
+	}
+	c.verified.lock.Lock()
+	c.verified.files[f.Key] = f
+	c.verified.lock.Unlock()
+}
+
+// costIndexes - returns the CSV index of each of costColumns, or -1 if it is not in the CUR or not converted as DOUBLE.
+// Redacted columns are converted as STRING, so cost values are never redacted
+func (c *CurConvert) costIndexes() [2]int {
+	indexes := [2]int{-1, -1}
+	for _, f := range c.fields {
+		for i, name := range costColumns {
+			if f.name == name && f.athenaType == "DOUBLE" && f.index >= 0 {
+				indexes[i] = f.index
+			}
+		}
+	}
+	return indexes
+}
+
+// csvTotals - totals of every record read from a CUR file, and of the records of those dropped by row filters
+type csvTotals struct {
+	source   VerifyTotals
+	filtered VerifyTotals
+}
+
+// addRecord - adds a record and its raw CSV cost values to v. Empty values are null in both the CUR and parquet,
+// values that are not numbers are counted as invalid
+func (v *VerifyTotals) addRecord(rec []string, costs [2]int) {
+	v.Rows++
+	sums := [2]*float64{&v.UnblendedCost, &v.BlendedCost}
+	for i, index := range costs {
+		if index < 0 || index >= len(rec) || len(rec[index]) < 1 {
+			continue
+		}
+		f, err := strconv.ParseFloat(rec[index], 64)
+		if err != nil {
+			v.InvalidCosts++
+			continue
+		}
+		*sums[i] += f
+	}
+}
+
+// verifyOutputs - re-reads the parquet written for curObject and compares it with the totals of the CSV records read
+// while converting. Outputs without a localFile (i.e. streamed) are downloaded from the dest path to be read
+func (c *CurConvert) verifyOutputs(ctx context.Context, curObject string, read csvTotals, outputs []*parquetOutput) error {
+	if c.verifyMode == VerifyOff {
+		return nil
+	}
+
+	f := FileVerification{Key: curObject, Source: read.source, Filtered: read.filtered}
+	for _, out := range outputs {
+		totals, err := c.outputTotals(ctx, out)
+		if err != nil {
+			return err
+		}
+		f.Parquet.add(totals)
+	}
+	c.setVerification(f)
+
+	if !f.Match() && c.verifyMode == VerifyFail {
+		return &VerifyError{Bucket: c.getSourceStorage().String(), Key: curObject, Source: f.Source, Parquet: f.Parquet, Filtered: f.Filtered}
+	}
+	return nil
+}
+
+// outputTotals - returns the row count and cost totals read from the parquet of out
+func (c *CurConvert) outputTotals(ctx context.Context, out *parquetOutput) (VerifyTotals, error) {
+	if len(out.localFile) > 0 {
+		return c.parquetTotals(out.localFile)
+	}
+
+	dest := c.getDestStorage()
+	localFile := c.tempDir + "/verify_" + strings.Replace(out.destKey, "/", "_", -1)
+	file, err := os.Create(localFile)
+	if err != nil {
+		return VerifyTotals{}, &UploadError{Bucket: dest.String(), Key: out.destKey, Err: err}
+	}
+	defer os.Remove(localFile)
+	err = dest.Download(ctx, out.destKey, file)
+	file.Close()
+	if err != nil {
+		return VerifyTotals{}, &UploadError{Bucket: dest.String(), Key: out.destKey, Err: fmt.Errorf("downloading for verification: %s", err)}
+	}
+	return c.parquetTotals(localFile)
+}
+
+// parquetTotals - reads the row count and sums the cost columns of a local parquet file
+func (c *CurConvert) parquetTotals(localFile string) (VerifyTotals, error) {
+	pf, err := ParquetFile.NewLocalFileReader(localFile)
+	if err != nil {
+		return VerifyTotals{}, err
+	}
+	defer pf.Close()
+
+	pr, err := ParquetReader.NewParquetColumnReader(pf, 1)
+	if err != nil {
+		return VerifyTotals{}, fmt.Errorf("failed to read parquet for verification, file: %s, error: %s", localFile, err)
+	}
+	defer pr.ReadStop()
+
+	totals := VerifyTotals{Rows: pr.GetNumRows()}
+	costs := c.costIndexes()
+	sums := [2]*float64{&totals.UnblendedCost, &totals.BlendedCost}
+	for i, name := range costColumns {
+		if costs[i] < 0 {
+			continue
+		}
+		path, ok := parquetColumnPath(pr.SchemaHandler, name)
+		if !ok {
+			return totals, fmt.Errorf("column %s missing from parquet file %s", name, localFile)
+		}
+		for read := int64(0); read < totals.Rows; read += verifyBatchRows {
+			values, _, _, err := pr.ReadColumnByPath(path, verifyBatchRows)
+			if err != nil {
+				return totals, fmt.Errorf("failed to read column %s of parquet file %s, error: %s", name, localFile, err)
+			}
+			for _, v := range values {
+				if f, ok := v.(float64); ok {
+					*sums[i] += f
+				}
+			}
+		}
+	}
+	return totals, nil
+}
+
+// parquetColumnPath - returns the reader path of the top level column name
+func parquetColumnPath(sh *SchemaHandler.SchemaHandler, name string) (string, bool) {
+	for _, path := range sh.ValueColumns {
+		exPath := sh.InPathToExPath[path]
+		if exPath[strings.LastIndex(exPath, ".")+1:] == name {
+			return path, true
+		}
+	}
+	return "", false
+}
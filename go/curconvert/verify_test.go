@@ -0,0 +1,201 @@
+package curconvert
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// deleteFailingStorage - a LocalStorage whose Deletes fail with err
+type deleteFailingStorage struct {
+	*LocalStorage
+	err error
+}
+
+func (f *deleteFailingStorage) Delete(ctx context.Context, keys []string) error {
+	return f.err
+}
+
+func TestParseVerifyMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    VerifyMode
+		wantErr bool
+	}{
+		{name: "off", want: VerifyOff},
+		{name: " Warn ", want: VerifyWarn},
+		{name: "FAIL", want: VerifyFail},
+		{name: "strict", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseVerifyMode(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseVerifyMode(%q) = %d (%v), want %d", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestAddRecord(t *testing.T) {
+	var v VerifyTotals
+	costs := [2]int{1, 3}
+	v.addRecord([]string{"1", "1.25", "x", "2.5"}, costs)
+	v.addRecord([]string{"2", "", "x", "n/a"}, costs)
+	v.addRecord([]string{"3", "0.75"}, costs)
+
+	want := VerifyTotals{Rows: 3, UnblendedCost: 2, BlendedCost: 2.5, InvalidCosts: 1}
+	if !v.equal(want) {
+		t.Errorf("totals %s, want %s", v, want)
+	}
+
+	// columns not converted as DOUBLE are not totalled
+	var rows VerifyTotals
+	rows.addRecord([]string{"1", "1.25"}, [2]int{-1, -1})
+	if !rows.equal(VerifyTotals{Rows: 1}) {
+		t.Errorf("totals without cost columns %s", rows)
+	}
+}
+
+func TestFileVerificationMatch(t *testing.T) {
+	tests := []struct {
+		name string
+		f    FileVerification
+		want bool
+	}{
+		{
+			name: "match",
+			f:    FileVerification{Source: VerifyTotals{Rows: 2, UnblendedCost: 1.5}, Parquet: VerifyTotals{Rows: 2, UnblendedCost: 1.5}},
+			want: true,
+		},
+		{
+			name: "filtered",
+			f: FileVerification{
+				Source:   VerifyTotals{Rows: 3, UnblendedCost: 2},
+				Parquet:  VerifyTotals{Rows: 2, UnblendedCost: 1.5},
+				Filtered: VerifyTotals{Rows: 1, UnblendedCost: 0.5},
+			},
+			want: true,
+		},
+		{
+			name: "row dropped",
+			f:    FileVerification{Source: VerifyTotals{Rows: 3, UnblendedCost: 2}, Parquet: VerifyTotals{Rows: 2, UnblendedCost: 1.5}},
+			want: false,
+		},
+		{
+			name: "rounding",
+			f:    FileVerification{Source: VerifyTotals{Rows: 1, BlendedCost: 0.1 + 0.2}, Parquet: VerifyTotals{Rows: 1, BlendedCost: 0.3}},
+			want: true,
+		},
+		{
+			name: "invalid cost",
+			f:    FileVerification{Source: VerifyTotals{Rows: 1, InvalidCosts: 1}, Parquet: VerifyTotals{Rows: 1}},
+			want: false,
+		},
+		{name: "skipped", f: FileVerification{Source: VerifyTotals{Rows: 1}, Skipped: true}, want: true},
+	}
+	for _, tt := range tests {
+		if got := tt.f.Match(); got != tt.want {
+			t.Errorf("%s: Match() = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	c := NewCurConvert("", "", "", "")
+	if _, err := c.Verify(); err == nil {
+		t.Error("expected Verify to fail when not enabled")
+	}
+
+	if err := c.SetVerify(VerifyWarn); err != nil {
+		t.Fatal(err)
+	}
+	c.resetVerify()
+	c.setVerification(FileVerification{Key: "cur-2.csv.gz", Source: VerifyTotals{Rows: 2}, Parquet: VerifyTotals{Rows: 1}})
+	c.setVerification(FileVerification{Key: "cur-1.csv.gz", Source: VerifyTotals{Rows: 3}, Parquet: VerifyTotals{Rows: 2}, Filtered: VerifyTotals{Rows: 1}})
+	c.setVerification(FileVerification{Key: "cur-0.csv.gz", Skipped: true})
+
+	report, err := c.Verify()
+	var ve *VerifyError
+	if !errors.As(err, &ve) || ve.Key != "cur-2.csv.gz" {
+		t.Errorf("error %v, want a VerifyError for cur-2.csv.gz", err)
+	}
+	if len(report.Files) != 3 || report.Files[0].Key != "cur-0.csv.gz" {
+		t.Errorf("files %+v, want 3 sorted by key", report.Files)
+	}
+	if report.Source.Rows != 5 || report.Parquet.Rows != 3 || report.Filtered.Rows != 1 {
+		t.Errorf("month totals source %s, parquet %s, filtered %s", report.Source, report.Parquet, report.Filtered)
+	}
+	if m := report.Mismatches(); len(m) != 1 || m[0].Key != "cur-2.csv.gz" {
+		t.Errorf("mismatches %+v", m)
+	}
+}
+
+func TestWriteParquetTotals(t *testing.T) {
+	c := NewCurConvert("", "", "", "parquet/202610")
+	c.fields = []curField{
+		{name: "lineitem/lineitemtype", athenaType: "STRING", index: 0},
+		{name: "lineitem/unblendedcost", athenaType: "DOUBLE", index: 1},
+	}
+	c.columnIndex = map[string]int{"lineitem/lineitemtype": 0, "lineitem/unblendedcost": 1}
+	for _, f := range c.fields {
+		c.CurColumns = append(c.CurColumns, columnMetadata(f, true))
+	}
+	if err := c.AddRowFilter("lineitem/lineitemtype != 'Tax'"); err != nil {
+		t.Fatal(err)
+	}
+
+	open := func(partition string) (*parquetOutput, error) {
+		pr, pw := io.Pipe()
+		go io.Copy(ioutil.Discard, pr)
+		return &parquetOutput{partition: partition, destKey: "parquet/202610/cur-1.parquet", file: &streamFile{w: pw}}, nil
+	}
+	csv := "a,b\nUsage,1.5\nTax,0.25\nUsage,\nUsage,2\n"
+	outputs, totals, err := c.writeParquet(context.Background(), strings.NewReader(csv), "bucket", "cur/cur-1.csv", open)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every record is counted in the source totals, before row filters are applied
+	if want := (VerifyTotals{Rows: 4, UnblendedCost: 3.75}); !totals.source.equal(want) {
+		t.Errorf("source totals %s, want %s", totals.source, want)
+	}
+	if want := (VerifyTotals{Rows: 1, UnblendedCost: 0.25}); !totals.filtered.equal(want) {
+		t.Errorf("filtered totals %s, want %s", totals.filtered, want)
+	}
+	if len(outputs) != 1 || outputs[0].rows != 3 {
+		t.Errorf("%d outputs, want 1 of 3 rows", len(outputs))
+	}
+}
+
+func TestDeleteOutputs(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	local := NewLocalStorage(dir)
+	putObject(t, local, "parquet/202610/cur-1.parquet", "PAR1")
+	putObject(t, local, "parquet/202610/cur-2.parquet", "PAR1")
+	outputs := []*parquetOutput{{destKey: "parquet/202610/cur-1.parquet"}, {destKey: "parquet/202610/cur-2.parquet"}}
+
+	c := NewCurConvert("", "", "", "parquet/202610")
+	c.SetDestStorage(local)
+	if err := c.deleteOutputs(outputs); err != nil {
+		t.Fatal(err)
+	}
+	if keys := listKeys(t, local, "parquet/"); len(keys) > 0 {
+		t.Errorf("outputs %v not removed", keys)
+	}
+
+	// a failure to remove outputs is attached to the error of the failed file
+	c.SetDestStorage(&deleteFailingStorage{LocalStorage: local, err: errors.New("AccessDenied")})
+	verr := &VerifyError{Key: "cur/cur-1.csv.gz"}
+	err := cleanupFailed(verr, c.deleteOutputs(outputs))
+	var ve *VerifyError
+	if !errors.As(err, &ve) || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("error %v, want the VerifyError with the cleanup failure attached", err)
+	}
+	if err := cleanupFailed(verr, nil); err != verr {
+		t.Errorf("cleanupFailed without a cleanup error = %v", err)
+	}
+}
@@ -0,0 +1,272 @@
+package curconvert
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/xitongsys/parquet-go/ParquetFile"
+	"github.com/xitongsys/parquet-go/ParquetWriter"
+	"github.com/xitongsys/parquet-go/parquet"
+)
+
+// default parquet writer sizes, those of parquet-go
+const (
+	defaultRowGroupSize = 128 * 1024 * 1024
+	defaultPageSize     = 8 * 1024
+)
+
+// minStreamRowGroupSize - smallest row group a streamed partition is flushed at, see shareRowGroups
+const minStreamRowGroupSize = 8 * 1024 * 1024
+
+// compressionCodecs - supported parquet compression codecs by name
+var compressionCodecs = map[string]parquet.CompressionCodec{
+	"UNCOMPRESSED": parquet.CompressionCodec_UNCOMPRESSED,
+	"SNAPPY":       parquet.CompressionCodec_SNAPPY,
+	"GZIP":         parquet.CompressionCodec_GZIP,
+	"ZSTD":         parquet.CompressionCodec_ZSTD,
+}
+
+//
+// SetCompression - sets the parquet compression codec, one of SNAPPY (default), GZIP, ZSTD or UNCOMPRESSED
+func (c *CurConvert) SetCompression(codec string) error {
+	cc, ok := compressionCodecs[strings.ToUpper(codec)]
+	if !ok {
+		return fmt.Errorf("Unsupported compression codec %s, must be one of SNAPPY, GZIP, ZSTD or UNCOMPRESSED", codec)
+	}
+	c.compression = cc
+	return nil
+}
+
+//
+// SetRowGroupSize - sets the target size in bytes of parquet row groups, default 128MB. Larger row groups compress and
+// scan better in Athena but are held in memory while written, per partition and per concurrently converted file
+func (c *CurConvert) SetRowGroupSize(bytes int64) error {
+	if bytes < 1 {
+		return fmt.Errorf("Row group size must be greater than zero")
+	}
+	c.rowGroupSize = bytes
+	return nil
+}
+
+//
+// SetPageSize - sets the target size in bytes of parquet pages within a row group, default 8KB
+func (c *CurConvert) SetPageSize(bytes int64) error {
+	if bytes < 1 {
+		return fmt.Errorf("Page size must be greater than zero")
+	}
+	c.pageSize = bytes
+	return nil
+}
+
+//
+// SetDictionary - enables (default) or disables dictionary encoding of columns. Dictionary encoding greatly reduces the
+// size of the many low cardinality CUR columns, disabling it only helps for data with mostly unique values
+func (c *CurConvert) SetDictionary(enabled bool) {
+	c.plainEncoding = !enabled
+}
+
+// parquetOutput - a parquet file written from a CUR file. One is produced per partition, or a single output if
+// partitioning is not enabled. localFile is only set when writing to the temp directory
+type parquetOutput struct {
+	partition string
+	localFile string
+	destKey   string
+	rows      int64
+
+	file   ParquetFile.ParquetFile
+	writer *ParquetWriter.ParquetWriter
+	write  func(rec []string, values []interface{}) error
+}
+
+// openOutput - creates the output for a partition of the CUR file being converted, file and destKey must be set
+type openOutput func(partition string) (*parquetOutput, error)
+
+// shareRowGroups - divides rowGroupSize between the open partition writers of a streamed CUR file, so that the rows
+// buffered in memory stay bounded by rowGroupSize however many partitions the file has. Row groups are no smaller than
+// minStreamRowGroupSize, above which memory grows with the number of partitions
+func (c *CurConvert) shareRowGroups(outputs []*parquetOutput) {
+	size := c.rowGroupSize / int64(len(outputs))
+	if size < minStreamRowGroupSize {
+		size = minStreamRowGroupSize
+	}
+	if size > c.rowGroupSize {
+		size = c.rowGroupSize
+	}
+	for _, out := range outputs {
+		out.writer.RowGroupSize = size
+	}
+}
+
+// newWriter - creates the parquet writer of out. The CSV writer is used unless the CUR has MAP columns, which the
+// CSV writer does not support, when records are written via the JSON writer
+func (c *CurConvert) newWriter(out *parquetOutput) error {
+	if len(c.mapFields) > 0 {
+		schema, err := c.jsonSchema()
+		if err != nil {
+			return err
+		}
+		w, err := ParquetWriter.NewJSONWriter(schema, out.file, int64(c.concurrency))
+		if err != nil {
+			return err
+		}
+		out.writer = &w.ParquetWriter
+		out.write = func(rec []string, values []interface{}) error {
+			j, err := c.jsonRecord(rec, values)
+			if err != nil {
+				return err
+			}
+			return w.Write(j)
+		}
+	} else {
+		w, err := ParquetWriter.NewCSVWriter(c.CurColumns, out.file, int64(c.concurrency))
+		if err != nil {
+			return err
+		}
+		out.writer = &w.ParquetWriter
+		out.write = func(rec []string, values []interface{}) error {
+			return w.Write(values)
+		}
+	}
+
+	out.writer.CompressionType = c.compression
+	out.writer.RowGroupSize = c.rowGroupSize
+	out.writer.PageSize = c.pageSize
+	return nil
+}
+
+// closeFile - closes a parquet file, passing err through to files that support it (e.g. so a streaming upload is aborted)
+func closeFile(f ParquetFile.ParquetFile, err error) error {
+	if cf, ok := f.(interface {
+		CloseWithError(error) error
+	}); ok && err != nil {
+		return cf.CloseWithError(err)
+	}
+	return f.Close()
+}
+
+// writeParquet - reads CSV CUR data of key in bucket from in and writes it as parquet into the outputs created by
+// open, one per partition. Outputs are closed before returning, along with the totals of the CSV records read for
+// verification. Errors are returned as a ConversionError
+func (c *CurConvert) writeParquet(ctx context.Context, in io.Reader, bucket string, key string, open openOutput) ([]*parquetOutput, csvTotals, error) {
+
+	// decompress input as needed
+	r, release, err := c.openCSV(in)
+	if err != nil {
+		return nil, csvTotals{}, &ConversionError{Bucket: bucket, Key: key, Err: err}
+	}
+	defer release()
+
+	// init csv reader
+	cr := csv.NewReader(r)
+
+	// read and ignore header record
+	_, err = cr.Read()
+	if err == io.EOF {
+		return nil, csvTotals{}, &ConversionError{Bucket: bucket, Key: key, Err: errors.New("CUR file has no header")}
+	}
+	if err != nil {
+		return nil, csvTotals{}, &ConversionError{Bucket: bucket, Key: key, Err: err}
+	}
+
+	outputs := make(map[string]*parquetOutput)
+	var ordered []*parquetOutput
+	var row int64
+	var totals csvTotals
+	abort := func(err error) ([]*parquetOutput, csvTotals, error) {
+		for _, out := range ordered {
+			closeFile(out.file, err)
+		}
+		return ordered, totals, &ConversionError{Bucket: bucket, Key: key, Row: row, Err: err}
+	}
+	create := func(partition string) (*parquetOutput, error) {
+		out, err := open(partition)
+		if err != nil {
+			return nil, err
+		}
+		ordered = append(ordered, out)
+		outputs[partition] = out
+
+		// init Parquet writer
+		if err := c.newWriter(out); err != nil {
+			return out, err
+		}
+		if c.streaming {
+			c.shareRowGroups(ordered)
+		}
+		return out, nil
+	}
+
+	// read all remaining records of CSV file and write to parquet, the writer flushes a row group once rowGroupSize is reached
+	partitionIndexes := c.partitionIndexes()
+	costs := c.costIndexes()
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		row++
+		if err != nil {
+			return abort(err)
+		}
+		if row%1000 == 0 && ctx.Err() != nil {
+			return abort(ctx.Err())
+		}
+		totals.source.addRecord(rec, costs)
+		if !c.keepRow(rec) {
+			totals.filtered.addRecord(rec, costs)
+			continue
+		}
+		c.redactRecord(rec)
+
+		partition := c.partitionPath(rec, partitionIndexes)
+		out, ok := outputs[partition]
+		if !ok {
+			if out, err = create(partition); err != nil {
+				return abort(err)
+			}
+		}
+
+		recParquet := make([]interface{}, len(c.fields))
+		for k := range c.fields {
+			if c.fields[k].index >= 0 && c.fields[k].index < len(rec) {
+				v, err := parquetValue(rec[c.fields[k].index], c.fields[k].athenaType)
+				if err != nil {
+					return abort(fmt.Errorf("column %s: %s", c.fields[k].name, err))
+				}
+				recParquet[k] = v
+			} else if c.fields[k].index == sourceReportIndex {
+				recParquet[k] = c.sourceReport
+			} else if c.fields[k].athenaType == "STRING" && c.fields[k].index != missingColumn {
+				recParquet[k] = ""
+			}
+		}
+		if err := out.write(rec, recParquet); err != nil {
+			return abort(err)
+		}
+		out.rows++
+	}
+
+	// un-partitioned CUR files with no (matching) rows still produce an (empty) parquet file
+	if len(ordered) < 1 && len(c.partitions) < 1 {
+		if _, err := create(""); err != nil {
+			return abort(err)
+		}
+	}
+
+	// write remaining rows and footer
+	for _, out := range ordered {
+		if err := out.writer.WriteStop(); err != nil {
+			return abort(err)
+		}
+	}
+	for _, out := range ordered {
+		if err := closeFile(out.file, nil); err != nil {
+			return ordered, totals, &ConversionError{Bucket: bucket, Key: key, Row: row, Err: err}
+		}
+	}
+	return ordered, totals, nil
+}
@@ -0,0 +1,136 @@
+package curconvert
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/xitongsys/parquet-go/ParquetWriter"
+	"github.com/xitongsys/parquet-go/parquet"
+)
+
+func TestWriterOptions(t *testing.T) {
+	c := NewCurConvert("", "", "", "")
+	if c.compression != parquet.CompressionCodec_SNAPPY || c.rowGroupSize != defaultRowGroupSize || c.pageSize != defaultPageSize {
+		t.Errorf("defaults compression %v row group %d page %d", c.compression, c.rowGroupSize, c.pageSize)
+	}
+
+	if err := c.SetCompression("zstd"); err != nil || c.compression != parquet.CompressionCodec_ZSTD {
+		t.Errorf("SetCompression(zstd) = %v, codec %v", err, c.compression)
+	}
+	if err := c.SetCompression("lzo"); err == nil {
+		t.Error("expected an unsupported codec to fail")
+	}
+	if err := c.SetRowGroupSize(0); err == nil {
+		t.Error("expected a zero row group size to fail")
+	}
+	if err := c.SetPageSize(-1); err == nil {
+		t.Error("expected a negative page size to fail")
+	}
+}
+
+func TestColumnMetadata(t *testing.T) {
+	tests := []struct {
+		field      curField
+		dictionary bool
+		want       string
+	}{
+		{curField{name: "product/region", athenaType: "STRING"}, true, "name=product/region, type=UTF8, encoding=PLAIN_DICTIONARY"},
+		{curField{name: "product/region", athenaType: "STRING"}, false, "name=product/region, type=UTF8, encoding=PLAIN"},
+		{
+			curField{name: "lineitem/usageamount", athenaType: "DOUBLE"},
+			true,
+			"name=lineitem/usageamount, type=DOUBLE, encoding=PLAIN_DICTIONARY, repetitiontype=OPTIONAL",
+		},
+	}
+	for _, tt := range tests {
+		if got := columnMetadata(tt.field, tt.dictionary); got != tt.want {
+			t.Errorf("columnMetadata(%+v, %t) = %s, want %s", tt.field, tt.dictionary, got, tt.want)
+		}
+	}
+}
+
+func TestShareRowGroups(t *testing.T) {
+	outputs := func(n int) []*parquetOutput {
+		var outs []*parquetOutput
+		for i := 0; i < n; i++ {
+			outs = append(outs, &parquetOutput{writer: &ParquetWriter.ParquetWriter{}})
+		}
+		return outs
+	}
+	tests := []struct {
+		name         string
+		rowGroupSize int64
+		partitions   int
+		want         int64
+	}{
+		{name: "one partition", rowGroupSize: 128 * 1024 * 1024, partitions: 1, want: 128 * 1024 * 1024},
+		{name: "shared", rowGroupSize: 128 * 1024 * 1024, partitions: 4, want: 32 * 1024 * 1024},
+		{name: "minimum", rowGroupSize: 128 * 1024 * 1024, partitions: 100, want: minStreamRowGroupSize},
+		{name: "below minimum", rowGroupSize: 1024 * 1024, partitions: 2, want: 1024 * 1024},
+	}
+	for _, tt := range tests {
+		c := NewCurConvert("", "", "", "")
+		if err := c.SetRowGroupSize(tt.rowGroupSize); err != nil {
+			t.Fatal(err)
+		}
+		outs := outputs(tt.partitions)
+		c.shareRowGroups(outs)
+		for _, out := range outs {
+			if out.writer.RowGroupSize != tt.want {
+				t.Errorf("%s: row group size %d, want %d", tt.name, out.writer.RowGroupSize, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestWriteParquetConversionError(t *testing.T) {
+	c := NewCurConvert("", "", "", "parquet/202610")
+	c.fields = []curField{
+		{name: "lineitem/usageamount", athenaType: "DOUBLE", index: 0},
+		{name: "product/region", athenaType: "STRING", index: 1},
+	}
+	for _, f := range c.fields {
+		c.CurColumns = append(c.CurColumns, columnMetadata(f, true))
+	}
+
+	// output is discarded
+	open := func(partition string) (*parquetOutput, error) {
+		pr, pw := io.Pipe()
+		go io.Copy(ioutil.Discard, pr)
+		return &parquetOutput{partition: partition, destKey: "parquet/202610/cur-1.parquet", file: &streamFile{w: pw}}, nil
+	}
+
+	tests := []struct {
+		name    string
+		csv     string
+		wantRow int64
+		wantErr bool
+	}{
+		{name: "valid", csv: "a,b\n1.5,us-east-1\n,\n"},
+		{name: "no header", csv: "", wantErr: true},
+		{name: "invalid value", csv: "a,b\n1.5,us-east-1\nn/a,us-east-1\n", wantRow: 2, wantErr: true},
+		{name: "invalid csv", csv: "a,b\n1.5,us-east-1\n\"1.5,us-east-1\n", wantRow: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		outputs, _, err := c.writeParquet(context.Background(), strings.NewReader(tt.csv), "bucket", "cur/cur-1.csv", open)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil {
+			if len(outputs) != 1 || outputs[0].rows != 2 {
+				t.Errorf("%s: %d outputs, want 1 of 2 rows", tt.name, len(outputs))
+			}
+			continue
+		}
+		var ce *ConversionError
+		if !errors.As(err, &ce) || ce.Key != "cur/cur-1.csv" || ce.Row != tt.wantRow {
+			t.Errorf("%s: error %#v, want a ConversionError at row %d", tt.name, err, tt.wantRow)
+		}
+	}
+}
@@ -1,15 +1,98 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 
 	"github.com/andyfase/CURDashboard/go/curconvert"
 	"github.com/urfave/cli"
 )
 
+// splitList - splits a comma separated flag value, an empty value is an empty list
+func splitList(v string) []string {
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// converter - a CUR Converter, or a merge of several CUR reports
+type converter interface {
+	CheckCURExists() error
+	ConvertCurContext(ctx context.Context) error
+	GetCleanObjects() []string
+	GetConvertStats() curconvert.ConvertStats
+	Verify() (curconvert.VerifyReport, error)
+	CollectVersions(ctx context.Context) error
+	GetCURLocation() string
+	PlanContext(ctx context.Context) (curconvert.ConvertPlan, error)
+}
+
+// monthResult - the outcome of converting a month with backfill
+type monthResult struct {
+	month  time.Time
+	stats  curconvert.ConvertStats
+	status string
+	failed bool
+}
+
+// concatFlags - returns the flags of every group, in order
+func concatFlags(groups ...[]cli.Flag) []cli.Flag {
+	var flags []cli.Flag
+	for _, group := range groups {
+		flags = append(flags, group...)
+	}
+	return flags
+}
+
+// parseSource - parses a --source flag of comma separated key=value pairs into the report source of month start
+func parseSource(v string, start time.Time, dataExport bool) (curconvert.ReportSource, error) {
+	var src curconvert.ReportSource
+	var reportPath, reportName string
+	for _, kv := range splitList(v) {
+		i := strings.Index(kv, "=")
+		if i < 1 {
+			return src, fmt.Errorf("Invalid source %s, expected key=value pairs", v)
+		}
+		switch value := kv[i+1:]; kv[:i] {
+		case "name":
+			src.Name = value
+		case "bucket":
+			src.Bucket = value
+		case "path":
+			reportPath = value
+		case "report":
+			reportName = value
+		case "role":
+			src.RoleArn = value
+		case "externalID":
+			src.ExternalID = value
+		default:
+			return src, fmt.Errorf("Invalid source %s, unknown key %s", v, kv[:i])
+		}
+	}
+	if len(src.Name) < 1 || len(src.Bucket) < 1 || len(reportName) < 1 {
+		return src, fmt.Errorf("Invalid source %s, name, bucket and report are required", v)
+	}
+
+	src.Manifest = curconvert.ManifestKey(reportPath, reportName, start)
+	if dataExport {
+		src.Manifest = curconvert.ExportManifestKey(reportPath, reportName, start)
+	}
+	return src, nil
+}
+
 func main() {
 
 	app := cli.NewApp()
@@ -17,122 +100,765 @@ func main() {
 	app.Usage = "Command Line Interface for download, conversion and re-upload of the AWS CUR from/to a S3 Bucket."
 	app.Version = "1.0.0"
 
+	// conversion options set directly by flags, the remaining flags are parsed into opts by parseOptions
+	opts := curconvert.DefaultOptions()
 	var sourceBucket, destBucket, destPath, reportPath, reportName, inputDate, sourceRoleArn, sourceExternalID, destRoleArn, destExternalID string
+	var partitions, includeColumns, excludeColumns, failurePolicy, verify, redactionKeyFile, sse, preflight string
+	var fromMonth, toMonth string
+	var monthConcurrency int
+	var rowFilters, sources cli.StringSlice
+	var noDictionary, noResume, dataExport bool
+
+	// sourceFlags - flags locating the source CUR report
+	sourceFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:        "sourceBucket, sb",
+			Usage:       "Source Bucket which contains the CUR. Use file:///path to read a CUR from a local directory",
+			Destination: &sourceBucket,
+		},
+		cli.StringFlag{
+			Name:        "reportPath, rp",
+			Usage:       "CUR Report Path - defined when creating the AWS report",
+			Value:       "",
+			Destination: &reportPath,
+		},
+		cli.StringFlag{
+			Name:        "reportName, rn",
+			Usage:       "CUR Report Name - defined when creating the AWS report",
+			Destination: &reportName,
+		},
+		cli.BoolFlag{
+			Name:        "dataExport, de",
+			Usage:       "Report is a CUR 2.0 Data Export, reportName is then the export name and reportPath the export S3 path prefix. (Optional)",
+			Destination: &dataExport,
+		},
+		cli.StringFlag{
+			Name:        "sourceRole, sr",
+			Usage:       "Source Role ARN to assume when downloading CUR. (Optional) define if required to assume cross account role for download",
+			Value:       "",
+			Destination: &sourceRoleArn,
+		},
+		cli.StringFlag{
+			Name:        "sourceExternalID, sextid",
+			Usage:       "Source External ID used when assuming source role. (Optional) ",
+			Value:       "",
+			Destination: &sourceExternalID,
+		},
+	}
+
+	// s3Flags - flags configuring a custom S3 endpoint
+	s3Flags := []cli.Flag{
+		cli.StringFlag{
+			Name:        "endpoint, e",
+			Usage:       "Custom S3 endpoint URL e.g. http://minio:9000. (Optional) define to use a S3 compatible service such as MinIO or Ceph",
+			Value:       "",
+			Destination: &opts.S3.Endpoint,
+		},
+		cli.StringFlag{
+			Name:        "region",
+			Usage:       "Region to sign requests for when using a custom endpoint. (Optional) defaults to us-east-1",
+			Value:       "",
+			Destination: &opts.S3.Region,
+		},
+		cli.BoolFlag{
+			Name:        "pathStyle, ps",
+			Usage:       "Use path-style S3 addressing (bucket in path rather than hostname). (Optional) typically required for MinIO",
+			Destination: &opts.S3.ForcePathStyle,
+		},
+		cli.BoolFlag{
+			Name:        "disableSSL",
+			Usage:       "Connect to the S3 endpoint using plain HTTP. (Optional)",
+			Destination: &opts.S3.DisableSSL,
+		},
+		cli.BoolFlag{
+			Name:        "insecureTLS",
+			Usage:       "Skip TLS certificate verification of the S3 endpoint. (Optional) for self-signed test endpoints only",
+			Destination: &opts.S3.InsecureSkipVerify,
+		},
+	}
+
+	// convertFlags - flags configuring the destination and conversion, shared by convert and backfill
+	convertFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:        "destBucket, db",
+			Usage:       "Destination Bucket. (Optional) define if not the same as source. Use file:///path to write to a local directory",
+			Destination: &destBucket,
+		},
+		cli.StringFlag{
+			Name:        "destPath, dp",
+			Usage:       "Destination Path to store converted CUR. (Optional) defaults to parquet-cur/YYYYMM/",
+			Value:       "",
+			Destination: &destPath,
+		},
+		cli.StringSliceFlag{
+			Name:  "source",
+			Usage: "CUR report to merge e.g. \"name=payer1,bucket=b1,path=cur,report=hourly,role=arn,externalID=id\", may be repeated. (Optional) replaces sourceBucket, reportPath and reportName",
+			Value: &sources,
+		},
+		cli.StringFlag{
+			Name:        "destRole, dr",
+			Usage:       "Destination Role ARN to assume when uploading CUR. (Optional) define if required to assume cross account role for upload",
+			Value:       "",
+			Destination: &destRoleArn,
+		},
+		cli.StringFlag{
+			Name:        "destExternalID, dextid",
+			Usage:       "Source External ID used when assuming destination role. (Optional) ",
+			Value:       "",
+			Destination: &destExternalID,
+		},
+		cli.StringFlag{
+			Name:        "sse",
+			Usage:       "Server-side encryption of uploaded parquet, one of none, sse-s3 or sse-kms. (Optional) defaults to the bucket default encryption",
+			Value:       "none",
+			Destination: &sse,
+		},
+		cli.StringFlag{
+			Name:        "sseKmsKey",
+			Usage:       "KMS key ID or ARN used with sse-kms. (Optional) defaults to the aws/s3 key",
+			Value:       "",
+			Destination: &opts.SSE.KMSKeyID,
+		},
+		cli.BoolFlag{
+			Name:        "sseBucketKey",
+			Usage:       "Enable S3 Bucket Keys with sse-kms to reduce KMS requests. (Optional)",
+			Destination: &opts.SSE.BucketKey,
+		},
+		cli.BoolFlag{
+			Name:        "decryptSource",
+			Usage:       "Decrypt CUR objects that were client-side encrypted with KMS as they are read. (Optional)",
+			Destination: &opts.DecryptSource,
+		},
+		cli.BoolFlag{
+			Name:        "stream",
+			Usage:       "Stream each CUR file through conversion and upload without using local disk. (Optional)",
+			Destination: &opts.Streaming,
+		},
+		cli.StringFlag{
+			Name:        "tmpDir",
+			Usage:       "Directory CUR files are downloaded and converted in. (Optional) defaults to /tmp",
+			Value:       opts.TmpDir,
+			Destination: &opts.TmpDir,
+		},
+		cli.IntFlag{
+			Name:        "fileConcurrency, fc",
+			Usage:       "Number of CUR files converted in parallel. (Optional) defaults to 30",
+			Value:       opts.FileConcurrency,
+			Destination: &opts.FileConcurrency,
+		},
+		cli.Int64Flag{
+			Name:        "downloadPartSize",
+			Usage:       "Size in bytes of the byte ranges each CUR file is downloaded in. (Optional) defaults to 32MB",
+			Value:       opts.DownloadPartSize,
+			Destination: &opts.DownloadPartSize,
+		},
+		cli.IntFlag{
+			Name:        "downloadConcurrency",
+			Usage:       "Number of byte ranges of a CUR file downloaded in parallel. (Optional) defaults to 5",
+			Value:       opts.DownloadWorkers,
+			Destination: &opts.DownloadWorkers,
+		},
+		cli.BoolFlag{
+			Name:        "noResume",
+			Usage:       "Do not keep interrupted downloads as .partial files in tmpDir to resume on the next attempt or run. (Optional)",
+			Destination: &noResume,
+		},
+		cli.StringFlag{
+			Name:        "preflight",
+			Usage:       "Check the temp space and memory the conversion needs first, one of off, reduce (lower fileConcurrency to fit) or abort. (Optional) defaults to off",
+			Value:       "off",
+			Destination: &preflight,
+		},
+		cli.Int64Flag{
+			Name:        "memoryLimit",
+			Usage:       "Bytes of memory the conversion may use when planning. (Optional) defaults to 0, no limit",
+			Value:       opts.MemoryLimit,
+			Destination: &opts.MemoryLimit,
+		},
+		cli.BoolFlag{
+			Name:        "force, f",
+			Usage:       "Convert every CUR file, even those unchanged since the previous conversion. (Optional)",
+			Destination: &opts.Force,
+		},
+		cli.StringFlag{
+			Name:        "columnTypes, ct",
+			Usage:       "JSON file mapping column names to DOUBLE, BIGINT, TIMESTAMP, BOOLEAN or STRING. (Optional) over-rides manifest types",
+			Value:       "",
+			Destination: &opts.ColumnTypeFile,
+		},
+		cli.IntFlag{
+			Name:        "sampleRows",
+			Usage:       "Number of rows to sample to infer types of columns without a manifest type. (Optional) defaults to 0, no sampling",
+			Value:       opts.SampleRows,
+			Destination: &opts.SampleRows,
+		},
+		cli.BoolFlag{
+			Name:        "stringDates",
+			Usage:       "Write CUR date columns as ISO-8601 strings rather than timestamps. (Optional)",
+			Destination: &opts.StringDates,
+		},
+		cli.StringFlag{
+			Name:        "includeColumns, ic",
+			Usage:       "Comma separated column globs (e.g. lineitem/*) or re: prefixed regexes to convert. (Optional) defaults to all columns",
+			Value:       "",
+			Destination: &includeColumns,
+		},
+		cli.StringFlag{
+			Name:        "excludeColumns, ec",
+			Usage:       "Comma separated column globs (e.g. resourcetags/*) or re: prefixed regexes not to convert. (Optional)",
+			Value:       "",
+			Destination: &excludeColumns,
+		},
+		cli.StringSliceFlag{
+			Name:  "filter",
+			Usage: "Only convert rows matching the filter e.g. \"lineitem/lineitemtype != 'Tax'\", may be repeated. (Optional)",
+			Value: &rowFilters,
+		},
+		cli.BoolFlag{
+			Name:        "tagMap",
+			Usage:       "Write all resource tags into a single map<string,string> column named resource_tags. (Optional)",
+			Destination: &opts.ResourceTagMap,
+		},
+		cli.StringFlag{
+			Name:        "redactionFile",
+			Usage:       "JSON file of column redaction rules (drop, hash, truncate or replace) applied while converting. (Optional)",
+			Value:       "",
+			Destination: &opts.RedactionFile,
+		},
+		cli.StringFlag{
+			Name:        "redactionKeyFile",
+			Usage:       "File holding the secret key hash redaction rules are keyed with. (Optional) required when hashing",
+			Value:       "",
+			Destination: &redactionKeyFile,
+		},
+		cli.BoolFlag{
+			Name:        "schemaRegistry",
+			Usage:       "Merge columns with the schema registry of the parent of destPath so every month shares one schema. (Optional)",
+			Destination: &opts.SchemaRegistry,
+		},
+		cli.IntFlag{
+			Name:        "retries",
+			Usage:       "Attempts made at each stage (download, convert, upload) of a CUR file. (Optional) defaults to 3",
+			Value:       opts.Retries,
+			Destination: &opts.Retries,
+		},
+		cli.DurationFlag{
+			Name:        "retryDelay",
+			Usage:       "Delay before the first retry, doubled after each failed attempt with jitter. (Optional) defaults to 1s",
+			Value:       opts.RetryDelay,
+			Destination: &opts.RetryDelay,
+		},
+		cli.DurationFlag{
+			Name:        "retryMaxDelay",
+			Usage:       "Maximum delay between retries. (Optional) defaults to 30s",
+			Value:       opts.RetryMaxDelay,
+			Destination: &opts.RetryMaxDelay,
+		},
+		cli.StringFlag{
+			Name:        "failurePolicy, fp",
+			Usage:       "Handling of CUR files that fail after all retries, one of failfast, besteffort or threshold. (Optional) defaults to failfast",
+			Value:       "failfast",
+			Destination: &failurePolicy,
+		},
+		cli.Float64Flag{
+			Name:        "failureThreshold",
+			Usage:       "Percentage of CUR files allowed to fail with the threshold failure policy. (Optional) defaults to 0",
+			Value:       opts.FailureThreshold,
+			Destination: &opts.FailureThreshold,
+		},
+		cli.StringFlag{
+			Name:        "verify",
+			Usage:       "Re-read converted parquet and compare row counts and cost totals with the CUR, one of off, warn or fail. (Optional) defaults to off",
+			Value:       "off",
+			Destination: &verify,
+		},
+		cli.BoolFlag{
+			Name:        "cleanDryRun",
+			Usage:       "List the stale objects of destPath that would be deleted after conversion, without deleting them. (Optional)",
+			Destination: &opts.CleanDryRun,
+		},
+		cli.BoolFlag{
+			Name:        "versioned",
+			Usage:       "Write the conversion into a new v=<assemblyId> folder of destPath, published once every file has converted. (Optional)",
+			Destination: &opts.Versioned,
+		},
+		cli.DurationFlag{
+			Name:        "retention",
+			Usage:       "How long superseded versions are kept before being deleted. (Optional) defaults to 24h",
+			Value:       opts.Retention,
+			Destination: &opts.Retention,
+		},
+		cli.StringFlag{
+			Name:        "partitions, pt",
+			Usage:       "Comma separated list of day, account or product to write Hive-style partition folders. (Optional) defaults to no partitioning",
+			Value:       "",
+			Destination: &partitions,
+		},
+		cli.StringFlag{
+			Name:        "compression, c",
+			Usage:       "Parquet compression codec, one of SNAPPY, GZIP, ZSTD or UNCOMPRESSED. (Optional) defaults to SNAPPY",
+			Value:       opts.Compression,
+			Destination: &opts.Compression,
+		},
+		cli.Int64Flag{
+			Name:        "rowGroupSize",
+			Usage:       "Target parquet row group size in bytes. (Optional) defaults to 128MB",
+			Value:       opts.RowGroupSize,
+			Destination: &opts.RowGroupSize,
+		},
+		cli.Int64Flag{
+			Name:        "pageSize",
+			Usage:       "Target parquet page size in bytes. (Optional) defaults to 8KB",
+			Value:       opts.PageSize,
+			Destination: &opts.PageSize,
+		},
+		cli.BoolFlag{
+			Name:        "noDictionary",
+			Usage:       "Disable parquet dictionary encoding of columns. (Optional)",
+			Destination: &noDictionary,
+		},
+	}
+
+	// monthFlag - the month to convert, shared by convert and plan
+	monthFlag := cli.StringFlag{
+		Name:        "month, m",
+		Usage:       "Month of CUR to convert. (Optional) do not define for current CUR. Format YYYYMM",
+		Value:       "",
+		Destination: &inputDate,
+	}
+
+	// checkFlags - validates the source and destination flags of command, defaulting the destination to the source
+	checkFlags := func(c *cli.Context, command string) {
+		if len(sourceBucket) < 1 && len(sources) < 1 {
+			cli.ShowCommandHelp(c, command)
+			log.Fatalln("Must supply a source bucket")
+		}
+
+		if len(destBucket) < 1 && len(sources) > 0 {
+			cli.ShowCommandHelp(c, command)
+			log.Fatalln("Must supply a destination bucket when merging sources")
+		}
+
+		if len(destBucket) < 1 {
+			destBucket = sourceBucket
+		}
+	}
+
+	// parseOptions - parses the convert flags that are not set directly into opts
+	parseOptions := func() {
+		var err error
+		if opts.FailurePolicy, err = curconvert.ParseFailurePolicy(failurePolicy); err != nil {
+			log.Fatalln(err)
+		}
+		if opts.Verify, err = curconvert.ParseVerifyMode(verify); err != nil {
+			log.Fatalln(err)
+		}
+		opts.Partitions = splitList(partitions)
+		opts.Dictionary = !noDictionary
+		opts.ResumeDownloads = !noResume
+		opts.IncludeColumns = splitList(includeColumns)
+		opts.ExcludeColumns = splitList(excludeColumns)
+		opts.RowFilters = rowFilters
+		if opts.SSE.Mode, err = curconvert.ParseSSEMode(sse); err != nil {
+			log.Fatalln(err)
+		}
+		if opts.Preflight, err = curconvert.ParsePreflightMode(preflight); err != nil {
+			log.Fatalln(err)
+		}
+
+		// Read the redaction key, surrounding whitespace such as a trailing newline is not part of the key
+		if len(redactionKeyFile) > 0 {
+			b, err := ioutil.ReadFile(redactionKeyFile)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			opts.RedactionKey = bytes.TrimSpace(b)
+		}
+	}
+
+	// monthStart - returns the month set by monthFlag, or the current month
+	monthStart := func() time.Time {
+		if len(inputDate) < 6 {
+			return time.Now()
+		}
+		start, _ := time.Parse("200601", inputDate)
+		return start
+	}
+
+	// newConverter - returns a CUR Converter for the month of start, configured by the convert flags to use the temp
+	// directory workDir
+	newConverter := func(start time.Time, workDir string) (converter, error) {
+		// Set defined format for CUR manifest, legacy CUR manifests are within a YYYYMM01-YYYYMM01 folder
+		manifest := curconvert.ManifestKey(reportPath, reportName, start)
+		if dataExport {
+			manifest = curconvert.ExportManifestKey(reportPath, reportName, start)
+		}
+
+		// Set or extend destPath
+		monthPath := "parquet-cur/" + start.Format("200601")
+		if len(destPath) > 0 {
+			monthPath = destPath + "/" + start.Format("200601")
+		}
+
+		// configure - applies the conversion options to a CUR Converter, using the temp directory workDir
+		configure := func(cur *curconvert.CurConvert) error {
+			monthOpts := opts
+			monthOpts.TmpDir = workDir
+			if err := cur.SetOptions(monthOpts); err != nil {
+				return err
+			}
+
+			// Set Destination Role if required
+			if len(destRoleArn) > 1 {
+				return cur.SetDestRole(destRoleArn, destExternalID)
+			}
+			return nil
+		}
+
+		// Init CUR Converter, merging every source into one dataset when sources are given
+		var cc converter
+		if len(sources) > 0 {
+			var merge []curconvert.ReportSource
+			for _, v := range sources {
+				src, err := parseSource(v, start, dataExport)
+				if err != nil {
+					return nil, err
+				}
+				merge = append(merge, src)
+			}
+			mc, err := curconvert.NewMergeCur(merge, destBucket, monthPath, configure)
+			if err != nil {
+				return nil, err
+			}
+			cc = mc
+		} else {
+			sc := curconvert.NewCurConvert(sourceBucket, manifest, destBucket, monthPath)
+			if err := configure(sc); err != nil {
+				return nil, err
+			}
+
+			// Set Source Role if required
+			if len(sourceRoleArn) > 1 {
+				if err := sc.SetSourceRole(sourceRoleArn, sourceExternalID); err != nil {
+					return nil, err
+				}
+			}
+			cc = sc
+		}
+		return cc, nil
+	}
+
+	// backfillMonth - converts the month of start, returning its outcome for the backfill summary
+	backfillMonth := func(ctx context.Context, start time.Time) monthResult {
+		result := monthResult{month: start}
+		if ctx.Err() != nil {
+			result.status = "CANCELLED"
+			result.failed = true
+			return result
+		}
+
+		// Each month has its own temp directory, as CUR file names repeat every month. It is removed with any partial
+		// downloads once the month is done, failed months are downloaded again by the next backfill
+		workDir := opts.TmpDir + "/curconvert-" + start.Format("200601")
+		if err := os.MkdirAll(workDir, 0755); err != nil {
+			result.status = "FAILED: " + err.Error()
+			result.failed = true
+			return result
+		}
+		defer os.RemoveAll(workDir)
+
+		cc, err := newConverter(start, workDir)
+		if err != nil {
+			result.status = "FAILED: " + err.Error()
+			result.failed = true
+			return result
+		}
+
+		// Months before the report was created, or not yet published, have no manifest
+		if err := cc.CheckCURExists(); err != nil {
+			result.status = "NO MANIFEST"
+			if !curconvert.IsNotExist(err) {
+				result.status = "FAILED: " + err.Error()
+				result.failed = true
+			}
+			return result
+		}
+
+		err = cc.ConvertCurContext(ctx)
+		result.stats = cc.GetConvertStats()
+		switch e := err.(type) {
+		case nil:
+			result.status = "OK"
+		case *curconvert.PartialError:
+			result.status = fmt.Sprintf("PARTIAL: %d of %d files failed", e.Failed, e.Total)
+		default:
+			result.status = "FAILED: " + err.Error()
+			result.failed = true
+			return result
+		}
+
+		// Delete versions superseded for longer than the retention, anything left is collected on the next backfill
+		if opts.Versioned {
+			if err := cc.CollectVersions(ctx); err != nil {
+				log.Println(err)
+			}
+		}
+		return result
+	}
+
 	app.Commands = []cli.Command{
 		{
 			Name:  "convert",
 			Usage: "Perform CUR Conversion",
-			Flags: []cli.Flag{
-				cli.StringFlag{
-					Name:        "sourceBucket, sb",
-					Usage:       "Source Bucket which contains the CUR",
-					Destination: &sourceBucket,
-				},
-				cli.StringFlag{
-					Name:        "destBucket, db",
-					Usage:       "Destination Bucket. (Optional) define if not the same as source",
-					Destination: &destBucket,
-				},
-				cli.StringFlag{
-					Name:        "destPath, dp",
-					Usage:       "Destination Path to store converted CUR. (Optional) defaults to parquet-cur/YYYYMM/",
-					Value:       "",
-					Destination: &destPath,
-				},
-				cli.StringFlag{
-					Name:        "reportPath, rp",
-					Usage:       "CUR Report Path - defined when creating the AWS report",
-					Value:       "",
-					Destination: &reportPath,
-				},
-				cli.StringFlag{
-					Name:        "reportName, rn",
-					Usage:       "CUR Report Name - defined when creating the AWS report",
-					Destination: &reportName,
-				},
-				cli.StringFlag{
-					Name:        "month, m",
-					Usage:       "Month of CUR to convert. (Optional) do not define for current CUR. Format YYYYMM",
-					Value:       "",
-					Destination: &inputDate,
-				},
-				cli.StringFlag{
-					Name:        "sourceRole, sr",
-					Usage:       "Source Role ARN to assume when downloading CUR. (Optional) define if required to assume cross account role for download",
-					Value:       "",
-					Destination: &sourceRoleArn,
-				},
-				cli.StringFlag{
-					Name:        "sourceExternalID, sextid",
-					Usage:       "Source External ID used when assuming source role. (Optional) ",
-					Value:       "",
-					Destination: &sourceExternalID,
-				},
-				cli.StringFlag{
-					Name:        "destRole, dr",
-					Usage:       "Destination Role ARN to assume when uploading CUR. (Optional) define if required to assume cross account role for upload",
-					Value:       "",
-					Destination: &destRoleArn,
-				},
-				cli.StringFlag{
-					Name:        "destExternalID, dextid",
-					Usage:       "Source External ID used when assuming destination role. (Optional) ",
-					Value:       "",
-					Destination: &destExternalID,
-				},
-			},
+			Flags: concatFlags(sourceFlags, []cli.Flag{monthFlag}, convertFlags, s3Flags),
 			Action: func(c *cli.Context) error {
 
-				if len(sourceBucket) < 1 {
-					cli.ShowCommandHelp(c, "convert")
-					log.Fatalln("Must supply a source bucket")
+				checkFlags(c, "convert")
+				parseOptions()
+
+				start := monthStart()
 
+				// Init CUR Converter
+				cc, err := newConverter(start, opts.TmpDir)
+				if err != nil {
+					log.Fatalln(err)
 				}
 
-				if len(destBucket) < 1 {
-					destBucket = sourceBucket
+				// Convert CUR, interrupting stops conversion and removes partial files
+				ctx, cancel := curconvert.SignalContext()
+				defer cancel()
+				if err := cc.ConvertCurContext(ctx); err != nil {
+					if _, partial := err.(*curconvert.PartialError); !partial {
+						log.Fatalln(err)
+					}
+					log.Println(err)
 				}
 
-				var start time.Time
-				if len(inputDate) < 6 {
-					start = time.Now()
-				} else {
-					start, _ = time.Parse("200601", inputDate)
+				// List stale objects that were not deleted
+				if opts.CleanDryRun {
+					for _, key := range cc.GetCleanObjects() {
+						fmt.Println("Would delete " + key)
+					}
 				}
 
-				// Generate CUR Date Format which is YYYYMM01-YYYYMM01
-				end := start.AddDate(0, 1, 0)
-				curDate := start.Format("200601") + "01-" + end.Format("200601") + "01"
+				// Print verification of each converted file and the month
+				if opts.Verify != curconvert.VerifyOff {
+					report, err := cc.Verify()
+					for _, f := range report.Files {
+						switch {
+						case f.Skipped:
+							fmt.Println("SKIPPED  " + f.Key)
+						case f.Match():
+							fmt.Println("OK       " + f.Key + " " + f.Parquet.String())
+						default:
+							fmt.Println("MISMATCH " + f.Key + " source " + f.Source.String() + ", parquet " + f.Parquet.String() + ", filtered " + f.Filtered.String())
+						}
+					}
+					fmt.Println("Month totals, source " + report.Source.String() + ", parquet " + report.Parquet.String() + ", filtered " + report.Filtered.String())
+					if err != nil {
+						log.Println(err)
+					}
+				}
 
-				// Set defined format for CUR manifest
-				manifest := reportPath + "/" + curDate + "/" + reportName + "-Manifest.json"
+				// Delete versions superseded for longer than the retention
+				if opts.Versioned {
+					if err := cc.CollectVersions(ctx); err != nil {
+						log.Println(err)
+					}
+				}
 
-				// Set or extend destPath
-				if len(destPath) < 1 {
-					destPath = "parquet-cur/" + start.Format("200601")
-				} else {
-					destPath += "/" + start.Format("200601")
+				// Local destinations are already prefixed with file://
+				if !strings.Contains(destBucket, "://") {
+					destBucket = "s3://" + destBucket
 				}
+				fmt.Println("CUR conversion completed and available at " + destBucket + "/" + cc.GetCURLocation() + "/")
+				return nil
+			},
+		},
+		{
+			Name:  "plan",
+			Usage: "Estimate the temp space and memory of converting a CUR month and print the output layout, without converting",
+			Flags: concatFlags(sourceFlags, []cli.Flag{monthFlag}, convertFlags, s3Flags),
+			Action: func(c *cli.Context) error {
 
-				// Init CUR Converter
-				cc := curconvert.NewCurConvert(sourceBucket, manifest, destBucket, destPath)
+				checkFlags(c, "plan")
+				parseOptions()
+
+				cc, err := newConverter(monthStart(), opts.TmpDir)
+				if err != nil {
+					log.Fatalln(err)
+				}
+
+				ctx, cancel := curconvert.SignalContext()
+				defer cancel()
+				plan, err := cc.PlanContext(ctx)
+				if err != nil {
+					log.Fatalln(err)
+				}
 
-				// Set Source Role if required
-				if len(sourceRoleArn) > 1 {
-					cc.SetSourceRole(sourceRoleArn, sourceExternalID)
+				// Print each CUR file with its estimates and parquet output
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(w, "FILE\tSIZE\tTEMP\tMEMORY\tACTION\tOUTPUT")
+				skipped := 0
+				for _, f := range plan.Files {
+					action := "CONVERT"
+					if f.Skip {
+						action = "SKIP"
+						skipped++
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", f.Key, curconvert.FormatBytes(f.Size), curconvert.FormatBytes(f.Temp), curconvert.FormatBytes(f.Memory), action, f.Output)
 				}
+				w.Flush()
 
-				// Set Destination Role if required
-				if len(destRoleArn) > 1 {
-					cc.SetDestRole(destRoleArn, destExternalID)
+				// Print the peak resources of the month
+				free := "unknown"
+				if plan.TempFree >= 0 {
+					free = curconvert.FormatBytes(plan.TempFree)
+				}
+				limit := "none"
+				if plan.MemoryLimit > 0 {
+					limit = curconvert.FormatBytes(plan.MemoryLimit)
+				}
+				if !strings.Contains(destBucket, "://") {
+					destBucket = "s3://" + destBucket
+				}
+				fmt.Println()
+				fmt.Printf("Files:            %d, %d unchanged, %s total\n", len(plan.Files), skipped, curconvert.FormatBytes(plan.TotalSize))
+				fmt.Printf("File concurrency: %d configured, %d planned\n", plan.FileConcurrency, plan.Concurrency)
+				fmt.Printf("Temp space:       %s needed, %s free in %s\n", curconvert.FormatBytes(plan.TempBytes), free, plan.TempDir)
+				fmt.Printf("Memory:           %s needed, limit %s\n", curconvert.FormatBytes(plan.MemoryBytes), limit)
+				fmt.Printf("Output:           %s/%s/\n", destBucket, plan.OutputPrefix)
+				if len(plan.Partitions) > 0 {
+					fmt.Printf("Partitions:       %s\n", strings.Join(plan.Partitions, ", "))
 				}
 
-				// Convert CUR
-				if err := cc.ConvertCur(); err != nil {
+				if !plan.Fits() {
+					log.Fatalln((&curconvert.PlanError{Plan: plan}).Error())
+				}
+				if plan.Concurrency < plan.FileConcurrency && plan.Concurrency < len(plan.Files) {
+					fmt.Printf("File concurrency must be reduced to %d to fit, use --preflight reduce or --fileConcurrency %d\n", plan.Concurrency, plan.Concurrency)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "list",
+			Usage: "List the months of the CUR report that have a manifest",
+			Flags: concatFlags(sourceFlags, s3Flags),
+			Action: func(c *cli.Context) error {
+
+				if len(sourceBucket) < 1 || len(reportName) < 1 {
+					cli.ShowCommandHelp(c, "list")
+					log.Fatalln("Must supply a source bucket and report name")
+				}
+
+				source := curconvert.NewStorage(sourceBucket, sourceRoleArn, sourceExternalID)
+				if s3s, ok := source.(*curconvert.S3Storage); ok {
+					s3s.SetOptions(opts.S3)
+				}
+
+				ctx, cancel := curconvert.SignalContext()
+				defer cancel()
+				months, err := curconvert.ListManifests(ctx, source, reportPath, reportName, dataExport)
+				if err != nil {
 					log.Fatalln(err)
 				}
 
-				fmt.Println("CUR conversion completed and available at s3://" + destBucket + "/" + destPath + "/")
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(w, "MONTH\tLAST MODIFIED\tMANIFEST")
+				for _, m := range months {
+					fmt.Fprintf(w, "%s\t%s\t%s\n", m.Month.Format("200601"), m.LastModified.Format(time.RFC3339), m.Manifest)
+				}
+				w.Flush()
+				return nil
+			},
+		},
+		{
+			Name:  "backfill",
+			Usage: "Convert every month of a range of CUR months and print a summary",
+			Flags: concatFlags(sourceFlags, []cli.Flag{
+				cli.StringFlag{
+					Name:        "from",
+					Usage:       "First month to convert. Format YYYYMM",
+					Destination: &fromMonth,
+				},
+				cli.StringFlag{
+					Name:        "to",
+					Usage:       "Last month to convert. (Optional) defaults to the current month. Format YYYYMM",
+					Destination: &toMonth,
+				},
+				cli.IntFlag{
+					Name:        "monthConcurrency, mc",
+					Usage:       "Number of months converted in parallel, each in its own folder of the temp directory. Must be 1 with schemaRegistry or source. (Optional) defaults to 1",
+					Value:       1,
+					Destination: &monthConcurrency,
+				},
+			}, convertFlags, s3Flags),
+			Action: func(c *cli.Context) error {
+
+				checkFlags(c, "backfill")
+				parseOptions()
+
+				first, err := time.Parse("200601", fromMonth)
+				if err != nil {
+					cli.ShowCommandHelp(c, "backfill")
+					log.Fatalln("Must supply a from month in the format YYYYMM")
+				}
+				now := time.Now().UTC()
+				last := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+				if len(toMonth) > 0 {
+					if last, err = time.Parse("200601", toMonth); err != nil {
+						log.Fatalln("Invalid to month, format is YYYYMM")
+					}
+				}
+				if last.Before(first) {
+					log.Fatalln("The to month must not be before the from month")
+				}
+				if monthConcurrency < 1 {
+					log.Fatalln("Month concurrency must be 1 or more")
+				}
+				// Months would read and write the shared schema registry concurrently, merging always uses it
+				if monthConcurrency > 1 && (opts.SchemaRegistry || len(sources) > 0) {
+					log.Fatalln("Month concurrency must be 1 when using the schema registry or merging sources")
+				}
+
+				var months []time.Time
+				for m := first; !m.After(last); m = m.AddDate(0, 1, 0) {
+					months = append(months, m)
+				}
+
+				// Convert months, interrupting stops conversion and removes partial files
+				ctx, cancel := curconvert.SignalContext()
+				defer cancel()
+				results := make([]monthResult, len(months))
+				limit := make(chan struct{}, monthConcurrency)
+				var wg sync.WaitGroup
+				for i, month := range months {
+					// a month starts once another finishes, so at most monthConcurrency goroutines exist
+					limit <- struct{}{}
+					wg.Add(1)
+					go func(i int, month time.Time) {
+						defer wg.Done()
+						defer func() { <-limit }()
+						results[i] = backfillMonth(ctx, month)
+					}(i, month)
+				}
+				wg.Wait()
+
+				// Print summary of every month
+				failed := 0
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(w, "MONTH\tFILES\tROWS\tSTATUS")
+				for _, r := range results {
+					fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", r.month.Format("200601"), r.stats.Files, r.stats.Rows, r.status)
+					if r.failed {
+						failed++
+					}
+				}
+				w.Flush()
+				if failed > 0 {
+					log.Fatalf("%d of %d months failed to convert", failed, len(results))
+				}
 				return nil
 			},
 		},